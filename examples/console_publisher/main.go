@@ -1,25 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/satori/go.uuid"
 
 	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/publishers/filter"
 	"github.com/naveego/navigator-go/publishers/protocol"
 	"github.com/naveego/navigator-go/publishers/server"
+	"github.com/naveego/navigator-go/settings"
+	"github.com/naveego/navigator-go/shapes"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
 
-	logrus.SetOutput(os.Stdout)
+	log := logrus.New()
+	log.Out = os.Stdout
 
 	if len(os.Args) < 1 {
 		fmt.Println("Not enough arguments.")
@@ -30,14 +37,16 @@ func main() {
 
 	addr := os.Args[1]
 
-	logrus.SetLevel(logrus.DebugLevel)
+	log.Level = logrus.DebugLevel
 
-	srv := server.NewPublisherServer(addr, &publisherHandler{})
+	logger := logging.NewLogrus(log)
+
+	srv := server.NewPublisherServer(addr, &publisherHandler{log: logger}, server.WithLogger(logger))
 
 	go func() {
 		err := srv.ListenAndServe()
 		if err != nil {
-			logrus.Fatal("Error shutting down server: ", err)
+			log.Fatal("Error shutting down server: ", err)
 		}
 	}()
 
@@ -51,6 +60,7 @@ func main() {
 }
 
 type publisherHandler struct {
+	log      logging.Logger
 	inited   bool
 	count    int
 	interval time.Duration
@@ -58,7 +68,7 @@ type publisherHandler struct {
 }
 
 func (h *publisherHandler) TestConnection(request protocol.TestConnectionRequest) (protocol.TestConnectionResponse, error) {
-	logrus.Debugf("TestConnection: %#v", request)
+	h.log.Debug("TestConnection", "metadata", request.Metadata, "settings", settingsSchema.Redact(request.Settings))
 
 	return protocol.TestConnectionResponse{
 		Success: true,
@@ -67,7 +77,12 @@ func (h *publisherHandler) TestConnection(request protocol.TestConnectionRequest
 }
 
 func (h *publisherHandler) DiscoverShapes(request protocol.DiscoverShapesRequest) (protocol.DiscoverShapesResponse, error) {
-	logrus.Debugf("DiscoverShapes: %#v", request)
+	h.log.Debug("DiscoverShapes", "metadata", request.Metadata, "settings", settingsSchema.Redact(request.Settings))
+
+	var s publisherSettings
+	if err := settings.Decode(request.Settings, &s); err == nil && s.File != "" {
+		return discoverFileShapes(s.File)
+	}
 
 	return protocol.DiscoverShapesResponse{
 		Shapes: pipeline.ShapeDefinitions{
@@ -90,11 +105,91 @@ func (h *publisherHandler) DiscoverShapes(request protocol.DiscoverShapesRequest
 	}, nil
 }
 
-func (h *publisherHandler) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
-	var err error
+// discoverSampleSize is the number of data points sampled from a file to discover its shapes.
+const discoverSampleSize = 100
+
+// discoverFileShapes infers the shapes of the data points in a file from a sample of them.
+func discoverFileShapes(path string) (protocol.DiscoverShapesResponse, error) {
+	fileBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return protocol.DiscoverShapesResponse{}, fmt.Errorf("error opening file '%s': %s", path, err)
+	}
+
+	var dataPoints []pipeline.DataPoint
+	if err := json.Unmarshal(fileBytes, &dataPoints); err != nil {
+		return protocol.DiscoverShapesResponse{}, fmt.Errorf("error reading file '%s': %s", path, err)
+	}
+	if len(dataPoints) > discoverSampleSize {
+		dataPoints = dataPoints[:discoverSampleSize]
+	}
+
+	var names []string
+	inferrers := map[string]*shapes.Inferrer{}
+	for _, dp := range dataPoints {
+		in, ok := inferrers[dp.Entity]
+		if !ok {
+			in = shapes.NewInferrer(dp.Entity)
+			inferrers[dp.Entity] = in
+			names = append(names, dp.Entity)
+		}
+		in.AddDataPoint(dp)
+	}
+
+	var resp protocol.DiscoverShapesResponse
+	for _, name := range names {
+		resp.Shapes = append(resp.Shapes, inferrers[name].Shape())
+	}
+	return resp, nil
+}
+
+// settingsSchema describes the settings accepted by Init. Either file,
+// or count and interval, should be set.
+var settingsSchema = &settings.Schema{
+	Type: "object",
+	Properties: map[string]*settings.Schema{
+		"file": {
+			Type:        "string",
+			Description: "A JSON file holding an array of data points to publish.",
+			MinLength:   settings.Int(1),
+		},
+		"count": {
+			Type:        "integer",
+			Description: "The number of generated items to publish.",
+			Minimum:     settings.Float64(1),
+		},
+		"interval": {
+			Type:        "string",
+			Format:      "duration",
+			Description: "How long to wait between data points.",
+		},
+	},
+	AdditionalProperties: settings.Bool(false),
+}
+
+func (h *publisherHandler) SettingsSchema(request protocol.SettingsSchemaRequest) (protocol.SettingsSchemaResponse, error) {
+	return protocol.SettingsSchemaResponse{
+		Init: settingsSchema,
+	}, nil
+}
+
+// publisherSettings are the settings accepted by Init.
+type publisherSettings struct {
+	File     string        `mapstructure:"file"`
+	Count    int           `mapstructure:"count"`
+	Interval time.Duration `mapstructure:"interval" default:"1s"`
+}
+
+func (h *publisherHandler) Init(ctx context.Context, request protocol.InitRequest) (protocol.InitResponse, error) {
+	var s publisherSettings
+	if err := settings.Decode(request.Settings, &s); err != nil {
+		return protocol.InitResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
 
-	if rawFilePath, hasFilePath := request.Settings["file"]; hasFilePath {
-		h.filePath = rawFilePath.(string)
+	if s.File != "" {
+		h.filePath = s.File
 		return protocol.InitResponse{
 			Success: true,
 			Message: fmt.Sprintf("Initialized. Will publish lines from '%s'.", h.filePath),
@@ -102,17 +197,8 @@ func (h *publisherHandler) Init(request protocol.InitRequest) (protocol.InitResp
 
 	}
 
-	h.count = int(request.Settings["count"].(float64))
-	intervalString := request.Settings["interval"].(string)
-	if intervalString != "" {
-		h.interval, err = time.ParseDuration(intervalString)
-		if err != nil {
-			return protocol.InitResponse{
-				Success: false,
-				Message: "Invalid interval in settings.",
-			}, err
-		}
-	}
+	h.count = s.Count
+	h.interval = s.Interval
 
 	if h.count > 0 && h.interval > 0 {
 		h.inited = true
@@ -129,7 +215,7 @@ func (h *publisherHandler) Init(request protocol.InitRequest) (protocol.InitResp
 	}, fmt.Errorf("invalid count or interval in settings: count=%v, interval=%v", h.count, h.interval)
 }
 
-func (h *publisherHandler) Dispose(protocol.DisposeRequest) (protocol.DisposeResponse, error) {
+func (h *publisherHandler) Dispose(ctx context.Context, request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
 
 	h.filePath = ""
 	h.inited = false
@@ -142,8 +228,23 @@ func (h *publisherHandler) Dispose(protocol.DisposeRequest) (protocol.DisposeRes
 	}, nil
 }
 
-func (h *publisherHandler) Publish(request protocol.PublishRequest, toClient protocol.PublisherClient) (protocol.PublishResponse, error) {
-	logrus.Debugf("Publish:\r\n  request: %#v\r\n  transport: %#v", request, toClient)
+func (h *publisherHandler) Publish(ctx context.Context, request protocol.PublishRequest, toClient protocol.PublisherClient) (protocol.PublishResponse, error) {
+	h.log.Debug("Publish", "request", fmt.Sprintf("%#v", request))
+
+	// This source can't filter, so we filter the data points as we send them.
+	f, err := filter.New(request)
+	if err != nil {
+		return protocol.PublishResponse{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	// Checkpoints hold the index of the next item to publish.
+	start := 0
+	if request.Checkpoint != nil {
+		start, _ = strconv.Atoi(request.Checkpoint.Position)
+	}
 
 	if h.filePath != "" {
 
@@ -166,28 +267,56 @@ func (h *publisherHandler) Publish(request protocol.PublishRequest, toClient pro
 		}
 
 		go func() {
-			for i, dp := range dataPoints {
-
-				logrus.WithField("datapoint", dp).Debugf(color(45, fmt.Sprintf("Publishing (%v of %v)", i+1, len(dataPoints))))
-
-				toClient.SendDataPoints(protocol.SendDataPointsRequest{DataPoints: []pipeline.DataPoint{dp}})
+			// The status is filled in from ctx if we leave it empty,
+			// so a cancelled publication reports itself as such.
+			var done protocol.DoneRequest
+			defer func() { toClient.Done(done) }()
+
+			for i := start; i < len(dataPoints) && !f.Done(); i++ {
+				dp, ok := f.Apply(dataPoints[i])
+
+				if ok {
+					h.log.Debug(color(45, fmt.Sprintf("Publishing (%v of %v)", i+1, len(dataPoints))), "datapoint", dp)
+
+					if _, err := toClient.SendDataPoints(protocol.SendDataPointsRequest{DataPoints: []pipeline.DataPoint{dp}}); err != nil && ctx.Err() == nil {
+						done.Status = protocol.PublishFailed
+						done.Error = err.Error()
+						return
+					}
+				}
+				toClient.SendCheckpoint(protocol.SendCheckpointRequest{
+					Checkpoint: protocol.Checkpoint{Position: strconv.Itoa(i + 1)},
+				})
+				toClient.ReportProgress(protocol.ReportProgressRequest{
+					Progress: protocol.PublishProgress{
+						Sent:           int64(i + 1 - start),
+						EstimatedTotal: int64(len(dataPoints) - start),
+						Position:       fmt.Sprintf("item %d", i+1),
+					},
+				})
 
-				logrus.Debugf("Sleeping for %.2f seconds", h.interval.Seconds())
+				h.log.Debug(fmt.Sprintf("Sleeping for %.2f seconds", h.interval.Seconds()))
 
-				time.Sleep(h.interval)
+				if !sleep(ctx, h.interval) {
+					h.log.Info("Publish cancelled")
+					return
+				}
 			}
 		}()
 
 		return protocol.PublishResponse{
 			Success: true,
-			Message: fmt.Sprintf("Expect %d items", len(dataPoints)),
+			Message: fmt.Sprintf("Expect %d items", len(dataPoints)-start),
 		}, nil
 
 	}
 
 	go func() {
-		for i := 0; i < h.count; i++ {
-			dp := pipeline.DataPoint{
+		var done protocol.DoneRequest
+		defer func() { toClient.Done(done) }()
+
+		for i := start; i < h.count && !f.Done(); i++ {
+			dp, ok := f.Apply(pipeline.DataPoint{
 				Repository: "vandelay",
 				Entity:     "item",
 				Source:     "test",
@@ -198,25 +327,136 @@ func (h *publisherHandler) Publish(request protocol.PublishRequest, toClient pro
 					"name":   "John Doe",
 					"unique": uuid.NewV4().String(),
 				},
-			}
+			})
 
-			logrus.WithField("datapoint", dp).Debugf(color(45, fmt.Sprintf("Publishing (%v of %v)", i, h.count)))
+			if ok {
+				h.log.Debug(color(45, fmt.Sprintf("Publishing (%v of %v)", i, h.count)), "datapoint", dp)
 
-			toClient.SendDataPoints(protocol.SendDataPointsRequest{DataPoints: []pipeline.DataPoint{dp}})
+				if _, err := toClient.SendDataPoints(protocol.SendDataPointsRequest{DataPoints: []pipeline.DataPoint{dp}}); err != nil && ctx.Err() == nil {
+					done.Status = protocol.PublishFailed
+					done.Error = err.Error()
+					return
+				}
+			}
+			toClient.SendCheckpoint(protocol.SendCheckpointRequest{
+				Checkpoint: protocol.Checkpoint{Position: strconv.Itoa(i + 1)},
+			})
+			toClient.ReportProgress(protocol.ReportProgressRequest{
+				Progress: protocol.PublishProgress{
+					Sent:           int64(i + 1 - start),
+					EstimatedTotal: int64(h.count - start),
+				},
+			})
 
-			logrus.Debugf("Sleeping for %.2f seconds", h.interval.Seconds())
+			h.log.Debug(fmt.Sprintf("Sleeping for %.2f seconds", h.interval.Seconds()))
 
-			time.Sleep(h.interval)
+			if !sleep(ctx, h.interval) {
+				h.log.Info("Publish cancelled")
+				return
+			}
 		}
 	}()
 
 	return protocol.PublishResponse{
 		Success: true,
-		Message: fmt.Sprintf("Expect %d items", h.count),
+		Message: fmt.Sprintf("Expect %d items", h.count-start),
 	}, nil
 
 }
 
+// itemShape is the shape of the items PublishStream sends once
+// they've gained an "updated" property; see PublishStream.
+var itemShape = pipeline.ShapeDefinition{
+	Name: "item",
+	Keys: []string{"id"},
+	Properties: []pipeline.PropertyDefinition{
+		{Name: "id", Type: "integer"},
+		{Name: "name", Type: "string"},
+		{Name: "unique", Type: "string"},
+		{Name: "updated", Type: "datetime"},
+	},
+}
+
+// PublishStream sends a change to an item every interval until it's cancelled:
+// every third change deletes the oldest item, and the others insert a new item
+// or rename an existing one. Checkpoints hold the ID of the next item to insert.
+// After streamShapeChangeAt changes the items gain an "updated" property, as a
+// table might gain a column, and the shape change is reported to the client.
+func (h *publisherHandler) PublishStream(ctx context.Context, request protocol.PublishRequest, toClient protocol.PublisherClient) error {
+	h.log.Debug("PublishStream", "request", fmt.Sprintf("%#v", request))
+
+	interval := h.interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	next := 0
+	if request.Checkpoint != nil {
+		next, _ = strconv.Atoi(request.Checkpoint.Position)
+	}
+	oldest := next
+
+	for i := 0; ; i++ {
+		if !sleep(ctx, interval) {
+			h.log.Info("PublishStream cancelled")
+			return ctx.Err()
+		}
+
+		if i == streamShapeChangeAt {
+			if _, err := toClient.ShapeChanged(protocol.ShapeChangedRequest{Shape: itemShape}); err != nil {
+				return err
+			}
+		}
+
+		dp := pipeline.DataPoint{
+			Repository: "vandelay",
+			Entity:     "item",
+			Source:     "test",
+			KeyNames:   []string{"id"},
+		}
+
+		switch {
+		case i%3 == 2 && oldest < next:
+			dp.Action = pipeline.DataPointDelete
+			dp.Data = map[string]interface{}{"id": oldest}
+			oldest++
+		case i%3 == 1 && oldest < next:
+			dp.Action = protocol.DataPointUpdate
+			dp.Data = map[string]interface{}{"id": next - 1, "name": "Jane Doe", "unique": uuid.NewV4().String()}
+		default:
+			dp.Action = protocol.DataPointInsert
+			dp.Data = map[string]interface{}{"id": next, "name": "John Doe", "unique": uuid.NewV4().String()}
+			next++
+		}
+
+		if i >= streamShapeChangeAt && dp.Action != pipeline.DataPointDelete {
+			dp.Data["updated"] = time.Now().UTC().Format(time.RFC3339)
+		}
+
+		h.log.Debug(color(45, fmt.Sprintf("Streaming %s", dp.Action)), "datapoint", dp)
+
+		if _, err := toClient.SendDataPoints(protocol.SendDataPointsRequest{DataPoints: []pipeline.DataPoint{dp}}); err != nil {
+			return err
+		}
+		toClient.SendCheckpoint(protocol.SendCheckpointRequest{
+			Checkpoint: protocol.Checkpoint{Position: strconv.Itoa(next)},
+		})
+	}
+}
+
+// streamShapeChangeAt is the number of changes PublishStream sends before the shape of its items changes.
+const streamShapeChangeAt = 5
+
+// sleep waits for d, returning false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
 func color(code int, s string) string {
 	return fmt.Sprintf("\033[%dm%s\033[0m", code, s)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,14 +10,19 @@ import (
 	"os/signal"
 
 	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/settings"
+	"github.com/naveego/navigator-go/subscribers/mapping"
 	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/navigator-go/subscribers/router"
 	"github.com/naveego/navigator-go/subscribers/server"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
 
-	logrus.SetOutput(os.Stdout)
+	log := logrus.New()
+	log.Out = os.Stdout
 
 	if len(os.Args) < 2 {
 		fmt.Println("Not enough arguments.")
@@ -27,16 +33,18 @@ func main() {
 
 	addr := os.Args[1]
 
-	logrus.SetLevel(logrus.DebugLevel)
+	log.Level = logrus.DebugLevel
 
-	logrus.WithField("listen-addr", addr).Info("Started console_subscriber")
+	logger := logging.NewLogrus(log)
 
-	srv := server.NewSubscriberServer(addr, &subscriberHandler{})
+	logger.Info("Started console_subscriber", "listen-addr", addr)
+
+	srv := server.NewSubscriberServer(addr, &subscriberHandler{log: logger}, server.WithLogger(logger))
 
 	go func() {
 		err := srv.ListenAndServe()
 		if err != nil {
-			logrus.Fatal("Error shutting down server: ", err)
+			log.Fatal("Error shutting down server: ", err)
 		}
 	}()
 
@@ -50,24 +58,66 @@ func main() {
 }
 
 type subscriberHandler struct {
+	log        logging.Logger
 	fileWriter io.WriteCloser
+	mapper     *mapping.Mapper
+	// batch holds the lines written during the open batch, if there is one.
+	batch []string
+	// inBatch is set while a batch is open.
+	inBatch bool
+}
+
+// settingsSchema describes the settings accepted by Init.
+var settingsSchema = &settings.Schema{
+	Type: "object",
+	Properties: map[string]*settings.Schema{
+		"file": {
+			Type:        "string",
+			Description: "A file to write the received data points to.",
+		},
+	},
+}
+
+func (h *subscriberHandler) SettingsSchema(request protocol.SettingsSchemaRequest) (protocol.SettingsSchemaResponse, error) {
+	return protocol.SettingsSchemaResponse{
+		Init: settingsSchema,
+	}, nil
 }
 
 func (h *subscriberHandler) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
-	logrus.Debugf("Init: %#v", request)
-
-	if request.Settings != nil {
-		if fileName, ok := request.Settings["file"]; ok && fileName != "" {
-			f, err := os.Create(fileName.(string))
-			if err != nil {
-				return protocol.InitResponse{
-					Success: false,
-					Message: "couldn't open file: " + err.Error(),
-				}, err
-			}
-			h.fileWriter = f
+	h.log.Debug("Init", "metadata", request.Metadata, "settings", settingsSchema.Redact(request.Settings))
+
+	var s struct {
+		File string `mapstructure:"file"`
+	}
+	if err := settings.Decode(request.Settings, &s); err != nil {
+		return protocol.InitResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	if s.File != "" {
+		f, err := os.Create(s.File)
+		if err != nil {
+			return protocol.InitResponse{
+				Success: false,
+				Message: "couldn't open file: " + err.Error(),
+			}, nil
 		}
+		h.fileWriter = f
+	}
 
+	h.mapper = nil
+	if len(request.Mappings) > 0 {
+		mapper, err := mapping.NewFromInit(request)
+		if err != nil {
+			return protocol.InitResponse{
+				Success: false,
+				Message: "invalid mappings: " + err.Error(),
+			}, nil
+		}
+		h.mapper = mapper
 	}
 
 	return protocol.InitResponse{
@@ -77,7 +127,7 @@ func (h *subscriberHandler) Init(request protocol.InitRequest) (protocol.InitRes
 }
 
 func (h *subscriberHandler) TestConnection(request protocol.TestConnectionRequest) (protocol.TestConnectionResponse, error) {
-	logrus.Debugf("TestConnection: %#v", request)
+	h.log.Debug("TestConnection", "metadata", request.Metadata, "settings", settingsSchema.Redact(request.Settings))
 
 	return protocol.TestConnectionResponse{
 		Success: true,
@@ -86,7 +136,7 @@ func (h *subscriberHandler) TestConnection(request protocol.TestConnectionReques
 }
 
 func (h *subscriberHandler) DiscoverShapes(request protocol.DiscoverShapesRequest) (protocol.DiscoverShapesResponse, error) {
-	logrus.Debugf("DiscoverShapes: %#v", request)
+	h.log.Debug("DiscoverShapes", "metadata", request.Metadata, "settings", settingsSchema.Redact(request.Settings))
 
 	return protocol.DiscoverShapesResponse{
 		Shapes: pipeline.ShapeDefinitions{
@@ -110,20 +160,130 @@ func (h *subscriberHandler) DiscoverShapes(request protocol.DiscoverShapesReques
 }
 
 func (h *subscriberHandler) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
-	logrus.WithField("datapoint", request.DataPoint).Info(color(42, "Received DataPoint"))
+	h.log.Info(color(42, "Received DataPoint"), "operation", request.Operation, "datapoint", request.DataPoint)
 
-	if h.fileWriter != nil {
-		jsonBytes, _ := json.Marshal(request.DataPoint)
-		fmt.Fprintln(h.fileWriter, string(jsonBytes))
+	// Without mappings we write data points as we receive them.
+	if h.mapper == nil {
+		return router.Route(context.Background(), request, h)
 	}
 
+	results, err := h.mapper.MapRequest(request)
+	if err != nil {
+		return protocol.ReceiveShapeResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	for _, r := range results {
+		if len(r.Unmapped) > 0 || len(r.Missing) > 0 || len(r.Errors) > 0 {
+			h.log.Warn("Mapped DataPoint", "shape", r.ShapeName, "unmapped", r.Unmapped, "missing", r.Missing, "errors", r.Errors)
+		}
+
+		mapped := request
+		mapped.ShapeName = r.ShapeName
+		mapped.DataPoint = r.DataPoint
+		if resp, err := router.Route(context.Background(), mapped, h); err != nil || !resp.Success {
+			return resp, err
+		}
+	}
+
+	return protocol.ReceiveShapeResponse{
+		Success: true,
+	}, nil
+}
+
+// Upsert writes the data point to the file.
+func (h *subscriberHandler) Upsert(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	h.writeLine(request.DataPoint)
+
 	return protocol.ReceiveShapeResponse{
 		Success: true,
 	}, nil
 }
 
+// Delete writes the data point to the file as a tombstone holding only its keys.
+func (h *subscriberHandler) Delete(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	keys, _ := router.KeyValues(request.DataPoint)
+	h.log.Info(color(41, "Deleting DataPoint"), "shape", request.ShapeName, "keys", keys)
+
+	tombstone := request.DataPoint
+	tombstone.Action = pipeline.DataPointDelete
+	tombstone.Data = keys
+	h.writeLine(tombstone)
+
+	return protocol.ReceiveShapeResponse{
+		Success: true,
+	}, nil
+}
+
+// TruncateShape can't remove the shape's data points from the file, which holds
+// every shape, so it writes a marker telling readers to forget the earlier ones.
+func (h *subscriberHandler) TruncateShape(request protocol.TruncateShapeRequest) (protocol.TruncateShapeResponse, error) {
+	h.log.Info(color(41, "Truncating shape"), "shape", request.ShapeName)
+
+	h.writeLine(map[string]string{"truncate": request.ShapeName})
+
+	return protocol.TruncateShapeResponse{
+		Success: true,
+	}, nil
+}
+
+// BeginBatch holds back the lines written until the batch is committed.
+func (h *subscriberHandler) BeginBatch(request protocol.BeginBatchRequest) (protocol.BeginBatchResponse, error) {
+	h.log.Info(color(44, "Beginning batch"), "batch", request.BatchID)
+
+	h.batch = nil
+	h.inBatch = true
+
+	return protocol.BeginBatchResponse{
+		Success: true,
+	}, nil
+}
+
+// CommitBatch writes the lines held back during the batch to the file.
+func (h *subscriberHandler) CommitBatch(request protocol.CommitBatchRequest) (protocol.CommitBatchResponse, error) {
+	h.log.Info(color(44, "Committing batch"), "batch", request.BatchID, "lines", len(h.batch))
+
+	h.inBatch = false
+	for _, line := range h.batch {
+		h.writeLine(json.RawMessage(line))
+	}
+	h.batch = nil
+
+	return protocol.CommitBatchResponse{
+		Success: true,
+	}, nil
+}
+
+// AbortBatch forgets the lines held back during the batch.
+func (h *subscriberHandler) AbortBatch(request protocol.AbortBatchRequest) (protocol.AbortBatchResponse, error) {
+	h.log.Warn(color(41, "Aborting batch"), "batch", request.BatchID, "reason", request.Reason, "lines", len(h.batch))
+
+	h.inBatch = false
+	h.batch = nil
+
+	return protocol.AbortBatchResponse{
+		Success: true,
+	}, nil
+}
+
+// writeLine writes v to the file as a line of JSON, if there is a file.
+// During a batch the line is held back until the batch is committed.
+func (h *subscriberHandler) writeLine(v interface{}) {
+	if h.fileWriter == nil {
+		return
+	}
+	jsonBytes, _ := json.Marshal(v)
+	if h.inBatch {
+		h.batch = append(h.batch, string(jsonBytes))
+		return
+	}
+	fmt.Fprintln(h.fileWriter, string(jsonBytes))
+}
+
 func (h *subscriberHandler) Dispose(request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
-	logrus.Debugf("Dispose: %#v", request)
+	h.log.Debug("Dispose", "request", fmt.Sprintf("%#v", request))
 
 	if h.fileWriter != nil {
 		_ = h.fileWriter.Close()
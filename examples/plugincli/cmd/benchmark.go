@@ -20,6 +20,9 @@ import (
 	"time"
 
 	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/settings"
+	"github.com/naveego/navigator-go/subscribers/client"
+	"github.com/naveego/navigator-go/subscribers/deadletter"
 	"github.com/naveego/navigator-go/subscribers/protocol"
 	"github.com/spf13/viper"
 
@@ -47,7 +50,12 @@ var benchmarkCmd = &cobra.Command{
 			Settings: viper.GetStringMap("benchmark.init"),
 		}
 
-		fmt.Println("initRequest", initRequest)
+		var schema *settings.Schema
+		if schemas, err := subscriber.SettingsSchema(protocol.SettingsSchemaRequest{}); err == nil {
+			schema = schemas.Init
+		}
+
+		fmt.Println("initRequest settings", redact(schema, initRequest.Settings))
 
 		_, err := subscriber.Init(initRequest)
 
@@ -86,13 +94,57 @@ var benchmarkCmd = &cobra.Command{
 		fmt.Printf("beginning with %s set to %d", counterKey, counter)
 		fmt.Println()
 
+		target := subscriber
+		if attempts := viper.GetInt("benchmark.max-attempts"); attempts > 1 {
+			fmt.Printf("retrying datapoints up to %d times", attempts)
+			fmt.Println()
+			target = client.NewRetryingSubscriber(subscriber,
+				client.WithMaxAttempts(attempts),
+				client.WithReconnect(func() (client.SubscriberProxy, error) {
+					conn, err := DefaultConnectionFactory(viper.GetString("addr"))
+					if err != nil {
+						return nil, err
+					}
+					return client.NewSubscriber(conn)
+				}))
+		}
+
+		var receiver interface {
+			ReceiveDataPoint(protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+		} = target
+
+		var batcher *client.Batcher
+		if batchSize := viper.GetInt("benchmark.batch-size"); batchSize > 0 {
+			fmt.Printf("sending datapoints in batches of %d", batchSize)
+			fmt.Println()
+			batcher = client.NewBatcher(target, batchSize)
+			receiver = batcher
+		}
+
+		var deadLetters *deadletter.DeadLetterer
+		if path := viper.GetString("benchmark.dead-letter"); path != "" {
+			sink, err := deadletter.NewFileSink(path)
+			if err != nil {
+				return fmt.Errorf("couldn't open dead-letter file: %s", err)
+			}
+			defer sink.Close()
+			fmt.Printf("writing rejected datapoints to %s", path)
+			fmt.Println()
+			deadLetters = deadletter.New(receiver, sink)
+			receiver = deadLetters
+		}
+
 		startTime := time.Now()
 
 		for ; counter < max; counter++ {
 			//fmt.Println(counter)
 			request.DataPoint.Data[counterKey] = counter
 
-			resp, err := subscriber.ReceiveDataPoint(request)
+			resp, err := receiver.ReceiveDataPoint(request)
+			if _, sinkFailed := err.(*deadletter.SinkError); deadLetters != nil && !sinkFailed {
+				// Rejected datapoints have been dead-lettered.
+				continue
+			}
 			if err != nil || !resp.Success {
 				return fmt.Errorf("error sending datapoint: %e\r\nRequest: %#v\r\nResponse: %#v", err, request, resp)
 			}
@@ -100,6 +152,16 @@ var benchmarkCmd = &cobra.Command{
 			//fmt.Println()
 		}
 
+		if batcher != nil {
+			err := batcher.Flush()
+			if batchErr, ok := err.(*client.BatchError); ok && deadLetters != nil {
+				err = deadLetters.PutBatch(batchErr)
+			}
+			if err != nil {
+				return fmt.Errorf("error committing last batch: %s", err)
+			}
+		}
+
 		elapsed := time.Since(startTime)
 
 		totalSeconds := elapsed.Seconds()
@@ -108,6 +170,9 @@ var benchmarkCmd = &cobra.Command{
 
 		fmt.Printf("took %.3f seconds to process %d datapoints\r\n", totalSeconds, reps)
 		fmt.Printf("took %.2f ms per datapoint\r\n", secondsPerDataPoint*1000)
+		if deadLetters != nil {
+			fmt.Printf("%d datapoints were rejected\r\n", deadLetters.Rejected())
+		}
 
 		return nil
 	},
@@ -126,7 +191,13 @@ func init() {
 
 	benchmarkCmd.Flags().Int("seed", 1, "The initial ID used when generating data points.")
 	benchmarkCmd.Flags().Int("reps", 1, "The number of data points to generate.")
+	benchmarkCmd.Flags().Int("batch-size", 0, "optional; the number of data points to commit in each batch, if the subscriber supports batches.")
+	benchmarkCmd.Flags().Int("max-attempts", 1, "optional; the number of times to send a data point the subscriber couldn't receive before giving up.")
+	benchmarkCmd.Flags().String("dead-letter", "", "optional; a file to write rejected data points to instead of stopping at the first one.")
 
 	viper.BindPFlag("benchmark.reps", benchmarkCmd.Flag("reps"))
 	viper.BindPFlag("benchmark.seed", benchmarkCmd.Flag("seed"))
+	viper.BindPFlag("benchmark.batch-size", benchmarkCmd.Flag("batch-size"))
+	viper.BindPFlag("benchmark.max-attempts", benchmarkCmd.Flag("max-attempts"))
+	viper.BindPFlag("benchmark.dead-letter", benchmarkCmd.Flag("dead-letter"))
 }
@@ -0,0 +1,113 @@
+// Copyright © 2017 Naveego
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/shapes"
+	"github.com/spf13/cobra"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff OLD NEW",
+	Short: "Compares two sets of shapes.",
+	Long: `Compares the shapes in two files and lists the changes between them,
+classifying each as full, backward or forward compatible, or breaking.
+Each file holds a JSON array of shape definitions or a DiscoverShapes response.
+
+If --mappings is given only the changes which affect the mappings are listed.
+The command fails if the changes listed are breaking.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, err := readShapes(args[0])
+		if err != nil {
+			return err
+		}
+		to, err := readShapes(args[1])
+		if err != nil {
+			return err
+		}
+
+		changes := shapes.Compare(from, to)
+
+		if path, _ := cmd.Flags().GetString("mappings"); path != "" {
+			var mappings []pipeline.ShapeMapping
+			if err := readJSONFile(path, &mappings); err != nil {
+				return err
+			}
+			changes = changes.Affecting(mappings)
+		}
+
+		if len(changes) == 0 {
+			fmt.Println("No changes.")
+			return nil
+		}
+
+		for _, change := range changes {
+			fmt.Println(colorCompatibility(change.Compatibility, change.String()))
+		}
+
+		compat := changes.Compatibility()
+		fmt.Println(colorCompatibility(compat, fmt.Sprintf("Overall: %s", compat)))
+
+		if compat == shapes.Breaking {
+			return errors.New("breaking changes found")
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().String("mappings", "", "optional; JSON file holding the shape mappings a subscriber was initialized with")
+}
+
+// readShapes reads the shapes in path, which holds either an
+// array of shape definitions or a DiscoverShapes response.
+func readShapes(path string) (pipeline.ShapeDefinitions, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var defs pipeline.ShapeDefinitions
+	if err := json.Unmarshal(b, &defs); err == nil {
+		return defs, nil
+	}
+
+	var resp struct {
+		Shapes pipeline.ShapeDefinitions `json:"shapes"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("couldn't read shapes from %s: %s", path, err)
+	}
+	return resp.Shapes, nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("couldn't read %s: %s", path, err)
+	}
+	return nil
+}
+
+func colorCompatibility(compat shapes.Compatibility, s string) string {
+	switch compat {
+	case shapes.Breaking:
+		return "\033[31m" + s + "\033[0m"
+	case shapes.Full:
+		return "\033[32m" + s + "\033[0m"
+	}
+	return "\033[33m" + s + "\033[0m"
+}
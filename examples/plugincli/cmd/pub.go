@@ -11,6 +11,7 @@ import (
 
 	"github.com/naveego/api/types/pipeline"
 
+	"github.com/naveego/navigator-go/publishers/checkpoint"
 	"github.com/naveego/navigator-go/publishers/client"
 	"github.com/naveego/navigator-go/publishers/protocol"
 	"github.com/spf13/cobra"
@@ -21,6 +22,7 @@ var publisherConn io.ReadWriteCloser
 var publisher client.PublisherProxy
 var datapointCollector *client.DataPointCollector
 var publishedDataPoints chan []pipeline.DataPoint
+var checkpoints checkpoint.Store
 
 // subCmd represents the sub command
 var pubCmd = &cobra.Command{
@@ -31,7 +33,7 @@ var pubCmd = &cobra.Command{
 
 		var err error
 
-		fmt.Printf("Configuration: %#v\n", viper.AllSettings())
+		fmt.Printf("Configuration: %#v\n", redact(nil, viper.AllSettings()))
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -66,6 +68,11 @@ var pubCmd = &cobra.Command{
 				fmt.Fprintln(os.Stdout, " 3: Publish")
 				fmt.Fprintln(os.Stdout, " 4: Dispose")
 				fmt.Fprintln(os.Stdout, " 5: DiscoverShapes")
+				fmt.Fprintln(os.Stdout, " 6: CancelPublish")
+				fmt.Fprintln(os.Stdout, " 7: GetPublishStatus")
+				fmt.Fprintln(os.Stdout, " 8: Preview")
+				fmt.Fprintln(os.Stdout, " 9: SettingsSchema")
+				fmt.Fprintln(os.Stdout, "10: Resume paused publications")
 				fmt.Print("\033[32mmethod:\033[0m ")
 				choice := 0
 
@@ -91,6 +98,9 @@ var pubCmd = &cobra.Command{
 				case 3:
 					message := protocol.PublishRequest{}
 					err = readMessage(&message)
+					if err == nil && message.Checkpoint == nil {
+						err = checkpoint.Resume(checkpoints, &message)
+					}
 					if err == nil {
 						writePublisherResponse(publisher.Publish(message))
 					}
@@ -106,6 +116,41 @@ var pubCmd = &cobra.Command{
 					if err == nil {
 						writePublisherResponse(publisher.DiscoverShapes(message))
 					}
+				case 6:
+					message := protocol.CancelPublishRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writePublisherResponse(publisher.CancelPublish(message))
+					}
+				case 7:
+					message := protocol.GetPublishStatusRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writePublisherResponse(publisher.GetPublishStatus(message))
+					}
+				case 8:
+					message := protocol.PreviewRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writePublisherResponse(publisher.Preview(message))
+					}
+				case 9:
+					message := protocol.SettingsSchemaRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writePublisherResponse(publisher.SettingsSchema(message))
+					}
+				case 10:
+					paused := datapointCollector.Paused()
+					if len(paused) == 0 {
+						fmt.Println("No publications are paused.")
+					}
+					for _, id := range paused {
+						if datapointCollector.Resume(id) {
+							fmt.Printf("Resumed %s", id)
+							fmt.Println()
+						}
+					}
 				default:
 					fmt.Println("\033[31mnot understood\033[0m")
 					_, _ = fmt.Scanln()
@@ -124,6 +169,13 @@ var pubCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(pubCmd)
 
+	pubCmd.Flags().String("checkpoint-dir", "", "optional; directory to keep checkpoints in so publications resume where the last one ended")
+	pubCmd.Flags().Duration("heartbeat-timeout", 0, "optional; how long to wait for a heartbeat from a streaming publication before giving up on it")
+	pubCmd.Flags().String("on-shape-change", string(client.ContinueOnShapeChange), "optional; whether to continue, pause or pause-breaking when a publication reports a shape change")
+
+	viper.BindPFlag("checkpoint-dir", pubCmd.Flag("checkpoint-dir"))
+	viper.BindPFlag("heartbeat-timeout", pubCmd.Flag("heartbeat-timeout"))
+	viper.BindPFlag("on-shape-change", pubCmd.Flag("on-shape-change"))
 }
 
 func writePublisherResponse(resp interface{}, err error) {
@@ -173,9 +225,49 @@ func connectPublisher() {
 func connectDataPointCollector() {
 	listenAddr := viper.GetString("listen-addr")
 
-	datapointCollector, err := client.NewDataPointCollector(listenAddr)
+	var err error
+	checkpoints = checkpoint.NewMemoryStore()
+	if dir := viper.GetString("checkpoint-dir"); dir != "" {
+		checkpoints, err = checkpoint.NewFileStore(dir)
+		check(err)
+	}
+
+	collector, err := client.NewDataPointCollector(listenAddr,
+		client.WithCheckpointStore(checkpoints),
+		client.WithProgressHandler(func(request protocol.ReportProgressRequest) {
+			fmt.Printf("Progress: %d of %d sent (%s)", request.Progress.Sent, request.Progress.EstimatedTotal, request.Progress.Position)
+			fmt.Println()
+		}),
+		client.WithHeartbeatTimeout(viper.GetDuration("heartbeat-timeout")),
+		client.WithHeartbeatHandler(func(request protocol.HeartbeatRequest) {
+			fmt.Printf("Heartbeat from %s at %s", request.SessionID, request.Time.Format(time.RFC3339))
+			if request.Checkpoint != nil {
+				fmt.Printf(" (position %s)", request.Checkpoint.Position)
+			}
+			fmt.Println()
+		}),
+		client.WithShapeChangePolicy(client.ShapeChangePolicy(viper.GetString("on-shape-change"))),
+		client.WithShapeChangeHandler(func(change client.ShapeChange) {
+			fmt.Printf("Shape %s changed in %s", change.Shape.Name, change.SessionID)
+			fmt.Println()
+			for _, c := range change.Changes {
+				fmt.Println(" ", colorCompatibility(c.Compatibility, c.String()))
+			}
+			if change.Paused {
+				fmt.Println("Delivery paused; choose 10 to resume.")
+			}
+		}),
+		client.WithDoneHandler(func(request protocol.DoneRequest) {
+			fmt.Printf("Publication %s %s: %v", request.SessionID, request.Status, request.Totals)
+			if request.Error != "" {
+				fmt.Printf(" (%s)", request.Error)
+			}
+			fmt.Println()
+		}))
 	check(err)
 
+	datapointCollector = &collector
+
 	publishedDataPoints = make(chan []pipeline.DataPoint, 100)
 	err = datapointCollector.Start(publishedDataPoints)
 	check(err)
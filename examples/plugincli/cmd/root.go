@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"regexp"
 	"syscall"
 
+	"github.com/naveego/navigator-go/settings"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -78,6 +80,32 @@ func readMessage(message interface{}) error {
 	return err
 }
 
+// secretName matches the names of settings which probably hold secrets.
+var secretName = regexp.MustCompile(`(?i)pass|secret|token|credential|key`)
+
+// redact returns a copy of values fit for printing, in which the settings
+// schema marks secret, and any others whose names look secret, are redacted.
+func redact(schema *settings.Schema, values map[string]interface{}) map[string]interface{} {
+	values = schema.Redact(values)
+	out := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		switch {
+		case secretName.MatchString(k) && v != nil:
+			out[k] = settings.Redacted
+		case isMap(v):
+			out[k] = redact(nil, v.(map[string]interface{}))
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func isMap(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
 func check(err error) {
 	if err != nil {
 		panic(err)
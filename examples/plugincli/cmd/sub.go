@@ -24,13 +24,14 @@ import (
 	"time"
 
 	"github.com/naveego/navigator-go/subscribers/client"
+	"github.com/naveego/navigator-go/subscribers/deadletter"
 	"github.com/naveego/navigator-go/subscribers/protocol"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var subscriberConn io.ReadWriteCloser
-var subscriber protocol.Subscriber
+var subscriber client.SubscriberProxy
 
 // subCmd represents the sub command
 var subCmd = &cobra.Command{
@@ -41,7 +42,7 @@ var subCmd = &cobra.Command{
 
 		var err error
 
-		fmt.Printf("Configuration: %#v\n", viper.AllSettings())
+		fmt.Printf("Configuration: %#v\n", redact(nil, viper.AllSettings()))
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -68,6 +69,12 @@ var subCmd = &cobra.Command{
 				fmt.Fprintln(os.Stdout, " 3: ReceiveShape")
 				fmt.Fprintln(os.Stdout, " 4: Dispose")
 				fmt.Fprintln(os.Stdout, " 5: DiscoverShapes")
+				fmt.Fprintln(os.Stdout, " 6: SettingsSchema")
+				fmt.Fprintln(os.Stdout, " 7: TruncateShape")
+				fmt.Fprintln(os.Stdout, " 8: BeginBatch")
+				fmt.Fprintln(os.Stdout, " 9: CommitBatch")
+				fmt.Fprintln(os.Stdout, "10: AbortBatch")
+				fmt.Fprintln(os.Stdout, "11: Replay dead letters")
 				fmt.Print("\033[32mmethod:\033[0m ")
 				choice := 0
 
@@ -108,6 +115,42 @@ var subCmd = &cobra.Command{
 					if err == nil {
 						writeSubscriberResponse(subscriber.DiscoverShapes(message))
 					}
+				case 6:
+					message := protocol.SettingsSchemaRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writeSubscriberResponse(subscriber.SettingsSchema(message))
+					}
+				case 7:
+					message := protocol.TruncateShapeRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writeSubscriberResponse(subscriber.TruncateShape(message))
+					}
+				case 8:
+					message := protocol.BeginBatchRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writeSubscriberResponse(subscriber.BeginBatch(message))
+					}
+				case 9:
+					message := protocol.CommitBatchRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writeSubscriberResponse(subscriber.CommitBatch(message))
+					}
+				case 10:
+					message := protocol.AbortBatchRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writeSubscriberResponse(subscriber.AbortBatch(message))
+					}
+				case 11:
+					message := replayRequest{}
+					err = readMessage(&message)
+					if err == nil {
+						writeSubscriberResponse(replayDeadLetters(message))
+					}
 				default:
 					fmt.Println("\033[31mnot understood\033[0m")
 					_, _ = fmt.Scanln()
@@ -167,3 +210,30 @@ func connectSubscriber() {
 
 	fmt.Println("connected")
 }
+
+// replayRequest says which dead letters to replay.
+type replayRequest struct {
+	// File is the dead-letter file to replay.
+	File string `json:"file"`
+	// DeadLetter is a file to write the letters rejected again to.
+	DeadLetter string `json:"deadLetter,omitempty"`
+}
+
+func replayDeadLetters(request replayRequest) (deadletter.ReplayResult, error) {
+	letters, err := deadletter.ReadFile(request.File)
+	if err != nil {
+		return deadletter.ReplayResult{}, err
+	}
+
+	var sink deadletter.Sink
+	if request.DeadLetter != "" {
+		fileSink, err := deadletter.NewFileSink(request.DeadLetter)
+		if err != nil {
+			return deadletter.ReplayResult{}, err
+		}
+		defer fileSink.Close()
+		sink = fileSink
+	}
+
+	return deadletter.Replay(subscriber, letters, sink)
+}
@@ -0,0 +1,66 @@
+// Package inflight limits the number of calls a proxy has in flight at once.
+package inflight
+
+import "sync"
+
+// Limiter lets up to a maximum number of callers hold it at once. Callers
+// which have to wait are let in the order they arrived, so a steady stream
+// of calls can't starve an earlier one. It's safe for concurrent use.
+type Limiter struct {
+	max int
+
+	mu      sync.Mutex
+	active  int
+	waiting []chan struct{}
+}
+
+// New returns a Limiter which lets up to max callers hold it at once.
+// A max of 0 or less means there's no limit.
+func New(max int) *Limiter {
+	return &Limiter{max: max}
+}
+
+// Acquire waits until the caller may hold the limiter.
+// Each call must be matched by a call to Release.
+func (l *Limiter) Acquire() {
+	l.mu.Lock()
+	if l.max <= 0 || (l.active < l.max && len(l.waiting) == 0) {
+		l.active++
+		l.mu.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	l.waiting = append(l.waiting, turn)
+	l.mu.Unlock()
+
+	<-turn
+}
+
+// Release lets the caller which has waited longest hold the limiter in its place.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.waiting) == 0 {
+		l.active--
+		return
+	}
+	// The place passes straight to the next caller, so active doesn't change.
+	turn := l.waiting[0]
+	l.waiting = l.waiting[1:]
+	close(turn)
+}
+
+// InFlight returns the number of callers holding the limiter.
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// Waiting returns the number of callers waiting to hold the limiter.
+func (l *Limiter) Waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiting)
+}
@@ -0,0 +1,90 @@
+package inflight
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLimiter(t *testing.T) {
+
+	Convey("should let waiting callers in the order they arrived", t, func() {
+		l := New(1)
+		l.Acquire()
+
+		var (
+			mu    sync.Mutex
+			order []int
+			wg    sync.WaitGroup
+		)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				l.Acquire()
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				l.Release()
+			}(i)
+			// Wait for the caller to queue before starting the next.
+			for l.Waiting() != i+1 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		So(l.InFlight(), ShouldEqual, 1)
+		l.Release()
+		wg.Wait()
+
+		So(order, ShouldResemble, []int{0, 1, 2, 3, 4})
+		So(l.InFlight(), ShouldEqual, 0)
+	})
+
+	Convey("should never let more than max callers in", t, func() {
+		l := New(3)
+
+		var (
+			mu      sync.Mutex
+			current int
+			most    int
+			wg      sync.WaitGroup
+		)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.Acquire()
+				defer l.Release()
+
+				mu.Lock()
+				current++
+				if current > most {
+					most = current
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				current--
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		So(most, ShouldBeLessThanOrEqualTo, 3)
+		So(l.InFlight(), ShouldEqual, 0)
+	})
+
+	Convey("should not limit callers when max is 0", t, func() {
+		l := New(0)
+		for i := 0; i < 10; i++ {
+			l.Acquire()
+		}
+		So(l.InFlight(), ShouldEqual, 10)
+		So(l.Waiting(), ShouldEqual, 0)
+	})
+}
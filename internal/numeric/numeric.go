@@ -0,0 +1,57 @@
+// Package numeric converts the numbers found in data points and settings,
+// which may be any of Go's numeric types depending on where they came from.
+package numeric
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// Float converts v to a float64 if it's one of Go's integer or floating
+// point types, or a json.Number.
+func Float(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// IsInteger reports whether v is a whole number: one of Go's integer types,
+// a finite float with no fractional part, or a json.Number written as one.
+func IsInteger(v interface{}) bool {
+	switch n := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+	case json.Number:
+		_, err := n.Int64()
+		return err == nil
+	}
+	f, ok := Float(v)
+	return ok && f == math.Trunc(f) && !math.IsInf(f, 0)
+}
@@ -0,0 +1,47 @@
+package numeric
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFloat(t *testing.T) {
+
+	Convey("should convert every numeric width", t, func() {
+		values := []interface{}{
+			int(3), int8(3), int16(3), int32(3), int64(3),
+			uint(3), uint8(3), uint16(3), uint32(3), uint64(3),
+			float32(3), float64(3), json.Number("3"),
+		}
+		for _, v := range values {
+			f, ok := Float(v)
+			So(ok, ShouldBeTrue)
+			So(f, ShouldEqual, 3)
+		}
+	})
+
+	Convey("should refuse values which aren't numbers", t, func() {
+		for _, v := range []interface{}{"3", true, nil, json.Number("three")} {
+			_, ok := Float(v)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestIsInteger(t *testing.T) {
+
+	Convey("should accept whole numbers of any width", t, func() {
+		for _, v := range []interface{}{int8(-1), uint32(7), uint64(math.MaxUint64), float32(2), 4.0, json.Number("5")} {
+			So(IsInteger(v), ShouldBeTrue)
+		}
+	})
+
+	Convey("should refuse fractions, infinities and values which aren't numbers", t, func() {
+		for _, v := range []interface{}{float32(2.5), 4.5, math.Inf(1), json.Number("5.0"), "5"} {
+			So(IsInteger(v), ShouldBeFalse)
+		}
+	})
+}
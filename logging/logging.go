@@ -0,0 +1,47 @@
+// Package logging defines the small logging interface used by the servers,
+// wrappers and clients in navigator-go, so that a host embedding several
+// plugins can route or silence the library's output.
+package logging
+
+// Field names attached to log lines by the library.
+const (
+	FieldRemoteAddr   = "remote_addr"
+	FieldMethod       = "method"
+	FieldSessionID    = "session_id"
+	FieldConnectionID = "connection_id"
+)
+
+// Logger is a leveled, structured logger. The keyvals arguments are
+// alternating keys and values, e.g. logger.Info("connected", "remote_addr", addr).
+//
+// The interface is deliberately small so it can be backed by logrus
+// (see NewLogrus), slog (see NewSlog), zap's SugaredLogger (whose *w methods
+// take the same arguments) or anything else.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+
+	// With returns a Logger which adds keyvals to every line it writes.
+	With(keyvals ...interface{}) Logger
+}
+
+// Nop returns a Logger which discards everything.
+func Nop() Logger {
+	return nopLogger{}
+}
+
+// Default returns the logger used when none is configured, which writes to
+// the logrus standard logger.
+func Default() Logger {
+	return defaultLogger
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+func (n nopLogger) With(...interface{}) Logger { return n }
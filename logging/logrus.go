@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+var defaultLogger = NewLogrus(logrus.StandardLogger())
+
+// NewLogrus adapts a logrus logger or entry to the Logger interface.
+func NewLogrus(logger logrus.FieldLogger) Logger {
+	return &logrusLogger{entry: logger.WithFields(logrus.Fields{})}
+}
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func (l *logrusLogger) Debug(msg string, keyvals ...interface{}) {
+	l.entry.WithFields(toFields(keyvals)).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, keyvals ...interface{}) {
+	l.entry.WithFields(toFields(keyvals)).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, keyvals ...interface{}) {
+	l.entry.WithFields(toFields(keyvals)).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, keyvals ...interface{}) {
+	l.entry.WithFields(toFields(keyvals)).Error(msg)
+}
+
+func (l *logrusLogger) With(keyvals ...interface{}) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(toFields(keyvals))}
+}
+
+func toFields(keyvals []interface{}) logrus.Fields {
+	fields := make(logrus.Fields, len(keyvals)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		if i+1 < len(keyvals) {
+			fields[key] = keyvals[i+1]
+		} else {
+			fields[key] = "(MISSING)"
+		}
+	}
+	return fields
+}
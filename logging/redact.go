@@ -0,0 +1,59 @@
+package logging
+
+import "fmt"
+
+// Redacting returns a Logger which passes the message and values of every
+// line through redact before writing them to logger. Values which aren't
+// strings are formatted with fmt first, and only replaced if redact changes them.
+func Redacting(logger Logger, redact func(string) string) Logger {
+	return redactingLogger{logger: logger, redact: redact}
+}
+
+type redactingLogger struct {
+	logger Logger
+	redact func(string) string
+}
+
+func (r redactingLogger) Debug(msg string, keyvals ...interface{}) {
+	r.logger.Debug(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactingLogger) Info(msg string, keyvals ...interface{}) {
+	r.logger.Info(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactingLogger) Warn(msg string, keyvals ...interface{}) {
+	r.logger.Warn(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactingLogger) Error(msg string, keyvals ...interface{}) {
+	r.logger.Error(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactingLogger) With(keyvals ...interface{}) Logger {
+	return redactingLogger{logger: r.logger.With(r.redactKeyvals(keyvals)...), redact: r.redact}
+}
+
+func (r redactingLogger) redactKeyvals(keyvals []interface{}) []interface{} {
+	out := make([]interface{}, len(keyvals))
+	for i, v := range keyvals {
+		if i%2 == 0 {
+			out[i] = v
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			out[i] = r.redact(v)
+		case nil, bool, int, int64, float64:
+			out[i] = v
+		default:
+			s := fmt.Sprint(v)
+			if redacted := r.redact(s); redacted != s {
+				out[i] = redacted
+			} else {
+				out[i] = v
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type recordingLogger struct {
+	lines *[]string
+	with  []interface{}
+}
+
+func (l recordingLogger) record(msg string, keyvals ...interface{}) {
+	*l.lines = append(*l.lines, fmt.Sprint(append(append([]interface{}{msg}, l.with...), keyvals...)...))
+}
+
+func (l recordingLogger) Debug(msg string, keyvals ...interface{}) { l.record(msg, keyvals...) }
+func (l recordingLogger) Info(msg string, keyvals ...interface{})  { l.record(msg, keyvals...) }
+func (l recordingLogger) Warn(msg string, keyvals ...interface{})  { l.record(msg, keyvals...) }
+func (l recordingLogger) Error(msg string, keyvals ...interface{}) { l.record(msg, keyvals...) }
+func (l recordingLogger) With(keyvals ...interface{}) Logger {
+	return recordingLogger{lines: l.lines, with: append(append([]interface{}{}, l.with...), keyvals...)}
+}
+
+func TestRedacting(t *testing.T) {
+
+	Convey("A redacting logger should redact messages and values", t, func() {
+		var lines []string
+		redact := func(s string) string { return strings.Replace(s, "hunter22", "[redacted]", -1) }
+		logger := Redacting(recordingLogger{lines: &lines}, redact)
+
+		logger.With("dsn", "sa:hunter22@db").Info("connecting with hunter22",
+			"error", errors.New("login failed for hunter22"),
+			"count", 3,
+			"settings", map[string]interface{}{"password": "hunter22"})
+
+		So(lines, ShouldHaveLength, 1)
+		So(lines[0], ShouldNotContainSubstring, "hunter22")
+		So(lines[0], ShouldContainSubstring, "sa:[redacted]@db")
+		So(lines[0], ShouldContainSubstring, "3")
+	})
+}
@@ -0,0 +1,38 @@
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlog adapts a *slog.Logger to the Logger interface.
+func NewSlog(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l *slogLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelDebug, msg, keyvals...)
+}
+
+func (l *slogLogger) Info(msg string, keyvals ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelInfo, msg, keyvals...)
+}
+
+func (l *slogLogger) Warn(msg string, keyvals ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelWarn, msg, keyvals...)
+}
+
+func (l *slogLogger) Error(msg string, keyvals ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelError, msg, keyvals...)
+}
+
+func (l *slogLogger) With(keyvals ...interface{}) Logger {
+	return &slogLogger{logger: l.logger.With(keyvals...)}
+}
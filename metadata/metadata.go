@@ -0,0 +1,136 @@
+// Package metadata defines the envelope carried by every request and
+// response in the publisher and subscriber protocols, and the context
+// helpers handlers use to read it.
+package metadata
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Metadata is the common envelope on every RPC. All fields are optional.
+type Metadata struct {
+	// RequestID identifies a single request. Responses echo it back.
+	RequestID string `json:"requestId,omitempty"`
+	// CorrelationID ties together all the requests made on behalf of one
+	// Navigator job run.
+	CorrelationID string `json:"correlationId,omitempty"`
+	TenantID      string `json:"tenantId,omitempty"`
+	PipelineID    string `json:"pipelineId,omitempty"`
+	// Deadline is the time by which the caller expects a response.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Traceparent and Tracestate carry W3C trace context.
+	Traceparent string            `json:"traceparent,omitempty"`
+	Tracestate  string            `json:"tracestate,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// Reply returns the metadata for a response to a request carrying request.
+// Fields already set in response are kept; the identifying fields and trace
+// context of the request fill in the rest.
+func Reply(request, response Metadata) Metadata {
+	if response.RequestID == "" {
+		response.RequestID = request.RequestID
+	}
+	if response.CorrelationID == "" {
+		response.CorrelationID = request.CorrelationID
+	}
+	if response.TenantID == "" {
+		response.TenantID = request.TenantID
+	}
+	if response.PipelineID == "" {
+		response.PipelineID = request.PipelineID
+	}
+	if response.Traceparent == "" {
+		response.Traceparent = request.Traceparent
+		response.Tracestate = request.Tracestate
+	}
+	return response
+}
+
+// Propagate returns the metadata for a request made on behalf of one carrying
+// parent, such as the SendDataPoints calls made during a Publish. The
+// correlation, tenant, pipeline and trace fields are inherited; the request ID
+// and deadline are not.
+func Propagate(parent, child Metadata) Metadata {
+	if child.CorrelationID == "" {
+		child.CorrelationID = parent.CorrelationID
+		if child.CorrelationID == "" {
+			child.CorrelationID = parent.RequestID
+		}
+	}
+	if child.TenantID == "" {
+		child.TenantID = parent.TenantID
+	}
+	if child.PipelineID == "" {
+		child.PipelineID = parent.PipelineID
+	}
+	if child.Traceparent == "" {
+		child.Traceparent = parent.Traceparent
+		child.Tracestate = parent.Tracestate
+	}
+	return child
+}
+
+// NewRequestID returns a random request identifier.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// IsZero reports whether no fields are set.
+func (m Metadata) IsZero() bool {
+	return m.RequestID == "" &&
+		m.CorrelationID == "" &&
+		m.TenantID == "" &&
+		m.PipelineID == "" &&
+		m.Deadline == nil &&
+		m.Traceparent == "" &&
+		m.Tracestate == "" &&
+		len(m.Headers) == 0
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of parent which carries m.
+func NewContext(parent context.Context, m Metadata) context.Context {
+	return context.WithValue(parent, contextKey{}, m)
+}
+
+// FromContext returns the metadata carried by ctx, if any.
+func FromContext(ctx context.Context) (Metadata, bool) {
+	m, ok := ctx.Value(contextKey{}).(Metadata)
+	return m, ok
+}
+
+// WithDeadline returns a copy of parent which carries m and
+// which is cancelled at m.Deadline, if it is set.
+func WithDeadline(parent context.Context, m Metadata) (context.Context, context.CancelFunc) {
+	ctx := NewContext(parent, m)
+	if m.Deadline != nil {
+		return context.WithDeadline(ctx, *m.Deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// LogFields returns the identifying fields of m as alternating keys and values,
+// suitable for logging.Logger.With.
+func (m Metadata) LogFields() []interface{} {
+	var fields []interface{}
+	if m.RequestID != "" {
+		fields = append(fields, "request_id", m.RequestID)
+	}
+	if m.CorrelationID != "" {
+		fields = append(fields, "correlation_id", m.CorrelationID)
+	}
+	if m.TenantID != "" {
+		fields = append(fields, "tenant_id", m.TenantID)
+	}
+	if m.PipelineID != "" {
+		fields = append(fields, "pipeline_id", m.PipelineID)
+	}
+	return fields
+}
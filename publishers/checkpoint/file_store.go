@@ -0,0 +1,93 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/naveego/navigator-go/publishers/protocol"
+)
+
+// FileStore is a Store which keeps each checkpoint in a JSON file in a directory.
+// Files are replaced atomically, so a crash never leaves a partial checkpoint.
+// It's safe for concurrent use within a process.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore returns a FileStore which keeps its files in dir,
+// creating it if necessary.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) path(key string) string {
+	return filepath.Join(f.dir, url.PathEscape(key)+".json")
+}
+
+func (f *FileStore) Load(key string) (protocol.Checkpoint, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var checkpoint protocol.Checkpoint
+
+	data, err := ioutil.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return checkpoint, false, nil
+	}
+	if err != nil {
+		return checkpoint, false, err
+	}
+
+	if err = json.Unmarshal(data, &checkpoint); err != nil {
+		return checkpoint, false, err
+	}
+	return checkpoint, true, nil
+}
+
+func (f *FileStore) Save(key string, checkpoint protocol.Checkpoint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(f.dir, ".checkpoint-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path(key))
+}
+
+func (f *FileStore) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
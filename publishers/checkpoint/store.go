@@ -0,0 +1,89 @@
+// Package checkpoint provides the stores a host uses to remember where
+// publications ended, so the next Publish of a shape can resume from there.
+package checkpoint
+
+import (
+	"sync"
+
+	"github.com/naveego/navigator-go/publishers/protocol"
+)
+
+// Store persists the last committed checkpoint for each key.
+// Keys are usually shape names; hosts running several publishers
+// should include something that identifies the publisher as well.
+type Store interface {
+	// Load returns the checkpoint saved under key. The bool is false
+	// if nothing has been saved.
+	Load(key string) (protocol.Checkpoint, bool, error)
+	// Save replaces the checkpoint saved under key.
+	Save(key string, checkpoint protocol.Checkpoint) error
+	// Delete forgets the checkpoint saved under key, so the next
+	// publication starts from the beginning.
+	Delete(key string) error
+}
+
+// KeyFunc returns the key the checkpoints of a shape are saved under.
+type KeyFunc func(shapeName string) string
+
+// ShapeKey is the default KeyFunc, which saves checkpoints under the shape name.
+func ShapeKey(shapeName string) string {
+	return shapeName
+}
+
+// Resume sets request.Checkpoint to the checkpoint saved under
+// request.ShapeName, if there is one.
+func Resume(store Store, request *protocol.PublishRequest) error {
+	return ResumeKey(store, ShapeKey, request)
+}
+
+// ResumeKey sets request.Checkpoint to the checkpoint saved under the key
+// key returns for request.ShapeName, if there is one. It should be given
+// the KeyFunc the checkpoints were saved with.
+func ResumeKey(store Store, key KeyFunc, request *protocol.PublishRequest) error {
+	if key == nil {
+		key = ShapeKey
+	}
+	checkpoint, ok, err := store.Load(key(request.ShapeName))
+	if err != nil {
+		return err
+	}
+	if ok {
+		request.Checkpoint = &checkpoint
+	}
+	return nil
+}
+
+// MemoryStore is a Store which keeps checkpoints in memory.
+// It's safe for concurrent use.
+type MemoryStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]protocol.Checkpoint
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		checkpoints: make(map[string]protocol.Checkpoint),
+	}
+}
+
+func (m *MemoryStore) Load(key string) (protocol.Checkpoint, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	checkpoint, ok := m.checkpoints[key]
+	return checkpoint, ok, nil
+}
+
+func (m *MemoryStore) Save(key string, checkpoint protocol.Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints[key] = checkpoint
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.checkpoints, key)
+	return nil
+}
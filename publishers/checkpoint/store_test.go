@@ -0,0 +1,61 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/naveego/navigator-go/publishers/protocol"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStores(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]Store{
+		"MemoryStore": NewMemoryStore(),
+		"FileStore":   fileStore,
+	}
+
+	for name, store := range stores {
+		Convey(name+" should round-trip checkpoints", t, func() {
+			So(store.Delete("items/2017"), ShouldBeNil)
+
+			_, ok, err := store.Load("items/2017")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			expected := protocol.Checkpoint{ShapeName: "items/2017", Position: "42"}
+			So(store.Save("items/2017", expected), ShouldBeNil)
+
+			actual, ok, err := store.Load("items/2017")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(actual, ShouldResemble, expected)
+
+			Convey("and Resume should apply them to a PublishRequest", func() {
+				request := protocol.PublishRequest{ShapeName: "items/2017"}
+				So(Resume(store, &request), ShouldBeNil)
+				So(request.Checkpoint, ShouldNotBeNil)
+				So(*request.Checkpoint, ShouldResemble, expected)
+			})
+
+			Convey("and Delete should forget them", func() {
+				So(store.Delete("items/2017"), ShouldBeNil)
+				_, ok, err := store.Load("items/2017")
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+			})
+		})
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"net/rpc"
 	"net/rpc/jsonrpc"
 
+	"github.com/naveego/navigator-go/internal/inflight"
+	"github.com/naveego/navigator-go/logging"
 	"github.com/naveego/navigator-go/publishers/protocol"
 )
 
 type publisherProxy struct {
 	client      *rpc.Client
 	replyToAddr string
+	inFlight    *inflight.Limiter
+	logger      logging.Logger
 }
 
 type PublisherProxy interface {
@@ -19,16 +23,29 @@ type PublisherProxy interface {
 	Init(protocol.InitRequest) (protocol.InitResponse, error)
 	Dispose(protocol.DisposeRequest) (protocol.DisposeResponse, error)
 	Publish(protocol.PublishRequest) (protocol.PublishResponse, error)
+	CancelPublish(protocol.CancelPublishRequest) (protocol.CancelPublishResponse, error)
+	GetPublishStatus(protocol.GetPublishStatusRequest) (protocol.GetPublishStatusResponse, error)
+	Preview(protocol.PreviewRequest) (protocol.PreviewResponse, error)
+	SettingsSchema(protocol.SettingsSchemaRequest) (protocol.SettingsSchemaResponse, error)
 	Close() error
 }
 
 // NewPublisher returns a protocol.Publisher proxy which
 // communicates with a real publisher over the provided connection.
-// The publisher must own the connection and must not be shared between goroutines.
-func NewPublisher(conn io.ReadWriteCloser) (PublisherProxy, error) {
+// The proxy must own the connection.
+//
+// The proxy is safe for concurrent use. Calls made from several goroutines
+// are sent over the connection at once, up to the limit set by WithMaxInFlight,
+// and each gets the response to its own request. Calls beyond the limit wait
+// their turn in the order they were made.
+func NewPublisher(conn io.ReadWriteCloser, opts ...Option) (PublisherProxy, error) {
+
+	o := applyOptions(opts)
 
 	publisherProxy := &publisherProxy{
-		client: jsonrpc.NewClient(conn),
+		client:   jsonrpc.NewClient(conn),
+		inFlight: inflight.New(o.maxInFlight),
+		logger:   o.logger.With(logging.FieldRemoteAddr, remoteAddr(conn)),
 	}
 
 	return publisherProxy, nil
@@ -37,26 +54,62 @@ func (p *publisherProxy) Close() (err error) {
 	return p.client.Close()
 }
 
+func (p *publisherProxy) call(method string, request interface{}, response interface{}) error {
+	p.inFlight.Acquire()
+	defer p.inFlight.Release()
+
+	p.logger.Debug("Calling "+method, logging.FieldMethod, method)
+	err := p.client.Call("Publisher."+method, request, response)
+	if err != nil {
+		p.logger.Warn("Call failed", logging.FieldMethod, method, "error", err)
+	}
+	return err
+}
+
 func (p *publisherProxy) DiscoverShapes(request protocol.DiscoverShapesRequest) (resp protocol.DiscoverShapesResponse, err error) {
-	err = p.client.Call("Publisher.DiscoverShapes", request, &resp)
+	err = p.call("DiscoverShapes", request, &resp)
 	return
 }
 
 func (p *publisherProxy) TestConnection(request protocol.TestConnectionRequest) (resp protocol.TestConnectionResponse, err error) {
-	err = p.client.Call("Publisher.TestConnection", request, &resp)
+	err = p.call("TestConnection", request, &resp)
 	return
 }
 
 func (p *publisherProxy) Init(request protocol.InitRequest) (resp protocol.InitResponse, err error) {
-	err = p.client.Call("Publisher.Init", request, &resp)
+	err = p.call("Init", request, &resp)
 	return
 }
 func (p *publisherProxy) Dispose(request protocol.DisposeRequest) (resp protocol.DisposeResponse, err error) {
-	err = p.client.Call("Publisher.Dispose", request, &resp)
+	err = p.call("Dispose", request, &resp)
 	return
 }
 
 func (p *publisherProxy) Publish(request protocol.PublishRequest) (resp protocol.PublishResponse, err error) {
-	err = p.client.Call("Publisher.Publish", request, &resp)
+	err = p.call("Publish", request, &resp)
+	return
+}
+
+func (p *publisherProxy) CancelPublish(request protocol.CancelPublishRequest) (resp protocol.CancelPublishResponse, err error) {
+	err = p.call("CancelPublish", request, &resp)
+	return
+}
+
+func (p *publisherProxy) GetPublishStatus(request protocol.GetPublishStatusRequest) (resp protocol.GetPublishStatusResponse, err error) {
+	err = p.call("GetPublishStatus", request, &resp)
+	return
+}
+
+func (p *publisherProxy) Preview(request protocol.PreviewRequest) (resp protocol.PreviewResponse, err error) {
+	err = p.call("Preview", request, &resp)
+	if err != nil && err.Error() == protocol.ErrPreviewSettings.Error() {
+		// Hand back the sentinel, so the host can tell this refusal from a failure.
+		err = protocol.ErrPreviewSettings
+	}
+	return
+}
+
+func (p *publisherProxy) SettingsSchema(request protocol.SettingsSchemaRequest) (resp protocol.SettingsSchemaResponse, err error) {
+	err = p.call("SettingsSchema", request, &resp)
 	return
 }
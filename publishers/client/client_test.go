@@ -1,8 +1,12 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,8 +14,11 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/maraino/go-mock"
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/publishers/checkpoint"
 	"github.com/naveego/navigator-go/publishers/protocol"
 	"github.com/naveego/navigator-go/publishers/server"
+	"github.com/naveego/navigator-go/shapes"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -86,23 +93,29 @@ func (m *mockHandler) TestConnection(request protocol.TestConnectionRequest) (pr
 
 var (
 	mockHandlerInstance = &mockHandler{}
-	publisherAddr       = "tcp://127.0.0.1:51001"
-	collectorAddr       = "tcp://127.0.0.1:51002"
+	publisherAddr       string
+	collectorAddr       string
 	output              chan []pipeline.DataPoint
 )
 
 func init() {
 
-	go func() {
-		srv := server.NewPublisherServer(publisherAddr, mockHandlerInstance)
+	listener, err := server.OpenListener("tcp://127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	publisherAddr = "tcp://" + listener.Addr().String()
+
+	srv := server.NewPublisherServer(publisherAddr, mockHandlerInstance)
 
-		err := srv.ListenAndServe()
+	go func() {
+		err := srv.Serve(listener)
 		if err != nil {
 			logrus.Fatal("Error shutting down server: ", err)
 		}
 	}()
 
-	collector, err := NewDataPointCollector(collectorAddr)
+	collector, err := NewDataPointCollector("tcp://127.0.0.1:0")
 
 	if err != nil {
 		panic(err.Error())
@@ -113,7 +126,63 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	collectorAddr = collector.Addr()
+
+}
+
+// testPublisher is a PublisherServer listening on a free port, and
+// the proxies and collectors used to publish from it.
+type testPublisher struct {
+	addr string
+	srv  *server.PublisherServer
+
+	conns      []net.Conn
+	collectors []DataPointCollector
+}
 
+// servePublisher serves handler with a PublisherServer configured with opts
+// on a free port. The caller should defer close.
+func servePublisher(handler interface{}, opts ...server.Option) *testPublisher {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+
+	f := &testPublisher{addr: listener.Addr().String()}
+	f.srv = server.NewPublisherServer("tcp://"+f.addr, handler, opts...)
+	go f.srv.Serve(listener)
+	return f
+}
+
+// connect returns a proxy configured with opts, connected to the server.
+func (f *testPublisher) connect(opts ...Option) PublisherProxy {
+	conn, err := net.Dial("tcp", f.addr)
+	So(err, ShouldBeNil)
+	f.conns = append(f.conns, conn)
+
+	proxy, err := NewPublisher(conn, opts...)
+	So(err, ShouldBeNil)
+	return proxy
+}
+
+// collect starts a DataPointCollector configured with opts on a free port,
+// sending the data points it receives to output.
+func (f *testPublisher) collect(output chan<- []pipeline.DataPoint, opts ...Option) DataPointCollector {
+	collector, err := NewDataPointCollector("tcp://127.0.0.1:0", opts...)
+	So(err, ShouldBeNil)
+	So(collector.Start(output), ShouldBeNil)
+	f.collectors = append(f.collectors, collector)
+	return collector
+}
+
+// close closes the connections opened by connect, stops the
+// collectors started by collect, and closes the server.
+func (f *testPublisher) close() {
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	for _, collector := range f.collectors {
+		collector.Stop()
+	}
+	f.srv.Close()
 }
 
 func Test_publisherProxy_TestConnection(t *testing.T) {
@@ -185,3 +254,857 @@ func Test_publisherProxy_ReceiveDataPoint(t *testing.T) {
 		}
 	})
 }
+
+type pumpingHandler struct {
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+
+	mu       sync.Mutex
+	disposed int
+	requests []protocol.PublishRequest
+}
+
+func (p *pumpingHandler) Init(ctx context.Context, request protocol.InitRequest) (protocol.InitResponse, error) {
+	return protocol.InitResponse{Success: true}, nil
+}
+
+func (p *pumpingHandler) Dispose(ctx context.Context, request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disposed++
+	return protocol.DisposeResponse{Success: true}, nil
+}
+
+func (p *pumpingHandler) disposeCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.disposed
+}
+
+// published returns the requests the handler has been sent.
+func (p *pumpingHandler) published() []protocol.PublishRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]protocol.PublishRequest(nil), p.requests...)
+}
+
+func (p *pumpingHandler) Publish(ctx context.Context, request protocol.PublishRequest, toClient protocol.PublisherClient) (protocol.PublishResponse, error) {
+	p.mu.Lock()
+	p.requests = append(p.requests, request)
+	p.mu.Unlock()
+
+	go func() {
+		defer toClient.Done(protocol.DoneRequest{})
+		for i := 1; ctx.Err() == nil; i++ {
+			toClient.SendDataPoints(protocol.SendDataPointsRequest{
+				DataPoints: []pipeline.DataPoint{{Entity: "item"}},
+			})
+			toClient.SendCheckpoint(protocol.SendCheckpointRequest{
+				Checkpoint: protocol.Checkpoint{Position: strconv.Itoa(i)},
+			})
+			toClient.ReportProgress(protocol.ReportProgressRequest{
+				Progress: protocol.PublishProgress{EstimatedTotal: 1000},
+			})
+			time.Sleep(time.Millisecond)
+		}
+		p.cancelOnce.Do(func() { close(p.cancelled) })
+	}()
+
+	return protocol.PublishResponse{Success: true}, nil
+}
+
+// pumping is a publication of the "test" shape by a pumpingHandler,
+// sent to a DataPointCollector.
+type pumping struct {
+	handler       *pumpingHandler
+	sut           PublisherProxy
+	collectorAddr string
+	sessionID     string
+	done          chan protocol.DoneRequest
+	stop          func()
+}
+
+// startPumping serves a pumpingHandler and runs a DataPointCollector
+// configured with opts, then starts a publication through a proxy.
+// The done handler is set to record the summary in done.
+func startPumping(opts ...Option) *pumping {
+	p := &pumping{
+		handler: &pumpingHandler{cancelled: make(chan struct{})},
+		done:    make(chan protocol.DoneRequest, 1),
+	}
+
+	f := servePublisher(p.handler)
+	p.stop = f.close
+
+	opts = append(opts, WithDoneHandler(func(request protocol.DoneRequest) {
+		p.done <- request
+	}))
+	points := make(chan []pipeline.DataPoint)
+	collector := f.collect(points, opts...)
+	p.collectorAddr = collector.Addr()
+	go func() {
+		for range points {
+		}
+	}()
+
+	p.sut = f.connect()
+	p.sessionID = p.publish(protocol.PublishRequest{ShapeName: "test"})
+	return p
+}
+
+// publish starts a publication, returning its session ID.
+func (p *pumping) publish(request protocol.PublishRequest) string {
+	request.PublishToAddress = p.collectorAddr
+	resp, err := p.sut.Publish(request)
+	So(err, ShouldBeNil)
+	So(resp.Success, ShouldBeTrue)
+	So(resp.SessionID, ShouldNotBeEmpty)
+	return resp.SessionID
+}
+
+// waitSent waits until the publication has sent at least n data points.
+// The handler sends a checkpoint after each one, so by the time it has sent
+// two it has sent a checkpoint too.
+func (p *pumping) waitSent(n int64) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, err := p.sut.GetPublishStatus(protocol.GetPublishStatusRequest{SessionID: p.sessionID})
+		So(err, ShouldBeNil)
+		if status.Progress.Sent >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			So("publication did not send enough data points", ShouldBeEmpty)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// cancel cancels the publication and waits for its summary.
+func (p *pumping) cancel() protocol.DoneRequest {
+	cancelResp, err := p.sut.CancelPublish(protocol.CancelPublishRequest{SessionID: p.sessionID})
+	So(err, ShouldBeNil)
+	So(cancelResp.Success, ShouldBeTrue)
+
+	select {
+	case summary := <-p.done:
+		return summary
+	case <-time.After(time.Second):
+		So("collector did not receive a summary", ShouldBeEmpty)
+	}
+	return protocol.DoneRequest{}
+}
+
+func Test_publisherProxy_CancelPublish(t *testing.T) {
+
+	Convey("should cancel a publication in progress", t, func() {
+		p := startPumping()
+		defer p.stop()
+
+		summary := p.cancel()
+		So(summary.SessionID, ShouldEqual, p.sessionID)
+		So(summary.Status, ShouldEqual, protocol.PublishCancelled)
+
+		select {
+		case <-p.handler.cancelled:
+		case <-time.After(time.Second):
+			So("publisher was not cancelled", ShouldBeEmpty)
+		}
+
+		Convey("and should not find it again", func() {
+			cancelResp, err := p.sut.CancelPublish(protocol.CancelPublishRequest{SessionID: p.sessionID})
+			So(err, ShouldBeNil)
+			So(cancelResp.Success, ShouldBeFalse)
+		})
+	})
+}
+
+func Test_publisherProxy_GetPublishStatus(t *testing.T) {
+
+	Convey("should report a publication's status while it runs and after it ends", t, func() {
+		p := startPumping()
+		defer p.stop()
+
+		status, err := p.sut.GetPublishStatus(protocol.GetPublishStatusRequest{SessionID: p.sessionID})
+		So(err, ShouldBeNil)
+		So(status.Success, ShouldBeTrue)
+		So(status.SessionID, ShouldEqual, p.sessionID)
+		So(status.Running, ShouldBeTrue)
+
+		p.waitSent(1)
+		p.cancel()
+
+		status, err = p.sut.GetPublishStatus(protocol.GetPublishStatusRequest{SessionID: p.sessionID})
+		So(err, ShouldBeNil)
+		So(status.Success, ShouldBeTrue)
+		So(status.Running, ShouldBeFalse)
+		So(status.Status, ShouldEqual, protocol.PublishCancelled)
+		So(status.Progress.Sent, ShouldBeGreaterThan, 0)
+
+		Convey("and refuse sessions it doesn't know", func() {
+			status, err := p.sut.GetPublishStatus(protocol.GetPublishStatusRequest{SessionID: "nope"})
+			So(err, ShouldBeNil)
+			So(status.Success, ShouldBeFalse)
+			So(status.Message, ShouldContainSubstring, "nope")
+		})
+	})
+}
+
+func Test_publisherProxy_ReportProgress(t *testing.T) {
+
+	Convey("should pass the publisher's progress to the progress handler", t, func() {
+		progress := make(chan protocol.ReportProgressRequest, 1)
+		p := startPumping(WithProgressHandler(func(request protocol.ReportProgressRequest) {
+			select {
+			case progress <- request:
+			default:
+			}
+		}))
+		defer p.stop()
+
+		select {
+		case r := <-progress:
+			So(r.SessionID, ShouldEqual, p.sessionID)
+			So(r.Progress.EstimatedTotal, ShouldEqual, 1000)
+			So(r.Progress.Sent, ShouldBeGreaterThan, 0)
+		case <-time.After(time.Second):
+			So("no progress was reported", ShouldBeEmpty)
+		}
+
+		p.cancel()
+	})
+}
+
+func Test_publisherProxy_Done(t *testing.T) {
+
+	Convey("should fill in the totals and last checkpoint of the summary sent to the done handler", t, func() {
+		p := startPumping()
+		defer p.stop()
+		p.waitSent(2)
+
+		summary := p.cancel()
+		So(summary.SessionID, ShouldEqual, p.sessionID)
+		So(summary.Totals, ShouldHaveLength, 1)
+		So(summary.Totals["item"], ShouldBeGreaterThan, 0)
+		So(summary.Checkpoint, ShouldNotBeNil)
+		So(summary.Checkpoint.ShapeName, ShouldEqual, "test")
+
+		status, err := p.sut.GetPublishStatus(protocol.GetPublishStatusRequest{SessionID: p.sessionID})
+		So(err, ShouldBeNil)
+		So(status.Progress.Sent, ShouldEqual, summary.Totals["item"])
+	})
+}
+
+func Test_publisherProxy_Checkpoints(t *testing.T) {
+
+	Convey("should commit the publication's checkpoints so the next publication resumes from the last", t, func() {
+		checkpoints := checkpoint.NewMemoryStore()
+		p := startPumping(WithCheckpointStore(checkpoints))
+		defer p.stop()
+		p.waitSent(2)
+
+		summary := p.cancel()
+		So(summary.Checkpoint, ShouldNotBeNil)
+
+		committed, ok, err := checkpoints.Load("test")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(committed, ShouldResemble, *summary.Checkpoint)
+
+		request := protocol.PublishRequest{ShapeName: "test"}
+		So(checkpoint.Resume(checkpoints, &request), ShouldBeNil)
+		p.sessionID = p.publish(request)
+		p.cancel()
+
+		published := p.handler.published()
+		So(published, ShouldHaveLength, 2)
+		So(published[0].Checkpoint, ShouldBeNil)
+		So(published[1].Checkpoint, ShouldNotBeNil)
+		So(*published[1].Checkpoint, ShouldResemble, committed)
+	})
+}
+
+// refusingHandler refuses every publication, returning err if it's set.
+type refusingHandler struct {
+	err error
+}
+
+func (p *refusingHandler) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
+	return protocol.InitResponse{Success: true}, nil
+}
+
+func (p *refusingHandler) Dispose(request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
+	return protocol.DisposeResponse{Success: true}, nil
+}
+
+func (p *refusingHandler) Publish(request protocol.PublishRequest, toClient protocol.PublisherClient) (protocol.PublishResponse, error) {
+	if p.err != nil {
+		return protocol.PublishResponse{}, p.err
+	}
+	return protocol.PublishResponse{Success: false, Message: "not today"}, nil
+}
+
+func Test_publisherProxy_PublishOutlivesConnection(t *testing.T) {
+
+	Convey("should keep publishing after the connection that started the publication closes", t, func() {
+		handler := &pumpingHandler{cancelled: make(chan struct{})}
+		f := servePublisher(handler)
+		defer f.close()
+
+		points := make(chan []pipeline.DataPoint)
+		collector := f.collect(points)
+		go func() {
+			for range points {
+			}
+		}()
+
+		sut := f.connect()
+		resp, err := sut.Publish(protocol.PublishRequest{
+			PublishToAddress: collector.Addr(),
+			ShapeName:        "test",
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+		So(f.conns[0].Close(), ShouldBeNil)
+
+		// Give the server time to notice the connection has gone.
+		time.Sleep(50 * time.Millisecond)
+		select {
+		case <-handler.cancelled:
+			So("publication was cancelled with its connection", ShouldBeEmpty)
+		default:
+		}
+
+		sut = f.connect()
+		status, err := sut.GetPublishStatus(protocol.GetPublishStatusRequest{SessionID: resp.SessionID})
+		So(err, ShouldBeNil)
+		So(status.Running, ShouldBeTrue)
+
+		cancelResp, err := sut.CancelPublish(protocol.CancelPublishRequest{SessionID: resp.SessionID})
+		So(err, ShouldBeNil)
+		So(cancelResp.Success, ShouldBeTrue)
+
+		select {
+		case <-handler.cancelled:
+		case <-time.After(time.Second):
+			So("publisher was not cancelled", ShouldBeEmpty)
+		}
+	})
+}
+
+func Test_publisherProxy_RefusedPublish(t *testing.T) {
+
+	Convey("should not send Done for a publication the publisher refused", t, func() {
+		f := servePublisher(&refusingHandler{}, server.WithCancelTimeout(10*time.Millisecond))
+		defer f.close()
+
+		done := make(chan protocol.DoneRequest, 1)
+		collector := f.collect(make(chan []pipeline.DataPoint),
+			WithDoneHandler(func(request protocol.DoneRequest) {
+				done <- request
+			}))
+
+		sut := f.connect()
+		resp, err := sut.Publish(protocol.PublishRequest{
+			PublishToAddress: collector.Addr(),
+			ShapeName:        "test",
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.Message, ShouldEqual, "not today")
+
+		select {
+		case summary := <-done:
+			So(summary.Status, ShouldBeEmpty)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		status, err := sut.GetPublishStatus(protocol.GetPublishStatusRequest{SessionID: resp.SessionID})
+		So(err, ShouldBeNil)
+		So(status.Success, ShouldBeFalse)
+	})
+}
+
+func Test_publisherProxy_PublishError(t *testing.T) {
+
+	Convey("should report the error from a publisher which fails to start", t, func() {
+		f := servePublisher(&refusingHandler{err: errors.New("no connection to source")})
+		defer f.close()
+
+		collector := f.collect(make(chan []pipeline.DataPoint))
+
+		sut := f.connect()
+		resp, err := sut.Publish(protocol.PublishRequest{
+			PublishToAddress: collector.Addr(),
+			ShapeName:        "test",
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.Message, ShouldEqual, "no connection to source")
+	})
+}
+
+func Test_publisherProxy_PublishDuplicateSession(t *testing.T) {
+
+	Convey("should refuse a publication whose session is already publishing", t, func() {
+		p := startPumping()
+		defer p.stop()
+
+		resp, err := p.sut.Publish(protocol.PublishRequest{
+			PublishToAddress: p.collectorAddr,
+			SessionID:        p.sessionID,
+			ShapeName:        "test",
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.Message, ShouldContainSubstring, "already publishing")
+
+		summary := p.cancel()
+		So(summary.Status, ShouldEqual, protocol.PublishCancelled)
+	})
+}
+
+type streamingHandler struct{}
+
+func (p *streamingHandler) PublishStream(ctx context.Context, request protocol.PublishRequest, toClient protocol.PublisherClient) error {
+	actions := []pipeline.DataPointAction{protocol.DataPointInsert, protocol.DataPointUpdate, pipeline.DataPointDelete}
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+		toClient.SendDataPoints(protocol.SendDataPointsRequest{
+			DataPoints: []pipeline.DataPoint{{Entity: "item", Action: actions[i%len(actions)]}},
+		})
+		toClient.SendCheckpoint(protocol.SendCheckpointRequest{
+			Checkpoint: protocol.Checkpoint{Position: strconv.Itoa(i)},
+		})
+	}
+}
+
+func Test_publisherProxy_PublishStream(t *testing.T) {
+
+	Convey("should stream changes with heartbeats until cancelled", t, func() {
+		f := servePublisher(&streamingHandler{})
+		defer f.close()
+
+		heartbeats := make(chan protocol.HeartbeatRequest, 1)
+		done := make(chan protocol.DoneRequest, 1)
+		points := make(chan []pipeline.DataPoint)
+		collector := f.collect(points,
+			WithHeartbeatHandler(func(request protocol.HeartbeatRequest) {
+				select {
+				case heartbeats <- request:
+				default:
+				}
+			}),
+			WithDoneHandler(func(request protocol.DoneRequest) {
+				done <- request
+			}))
+
+		actions := make(chan pipeline.DataPointAction, 3)
+		go func() {
+			for dps := range points {
+				select {
+				case actions <- dps[0].Action:
+				default:
+				}
+			}
+		}()
+
+		sut := f.connect()
+		resp, err := sut.Publish(protocol.PublishRequest{
+			PublishToAddress:    collector.Addr(),
+			ShapeName:           "test",
+			Mode:                protocol.PublishModeStream,
+			HeartbeatIntervalMS: 10,
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+
+		So(<-actions, ShouldEqual, protocol.DataPointInsert)
+		So(<-actions, ShouldEqual, protocol.DataPointUpdate)
+		So(<-actions, ShouldEqual, pipeline.DataPointDelete)
+
+		select {
+		case hb := <-heartbeats:
+			So(hb.SessionID, ShouldEqual, resp.SessionID)
+			So(hb.Time.IsZero(), ShouldBeFalse)
+			So(hb.Checkpoint, ShouldNotBeNil)
+			So(hb.Checkpoint.ShapeName, ShouldEqual, "test")
+		case <-time.After(time.Second):
+			So("no heartbeat was sent", ShouldBeEmpty)
+		}
+
+		So(collector.Sessions(), ShouldResemble, []string{resp.SessionID})
+
+		cancelResp, err := sut.CancelPublish(protocol.CancelPublishRequest{SessionID: resp.SessionID})
+		So(err, ShouldBeNil)
+		So(cancelResp.Success, ShouldBeTrue)
+
+		select {
+		case summary := <-done:
+			So(summary.SessionID, ShouldEqual, resp.SessionID)
+			So(summary.Status, ShouldEqual, protocol.PublishCancelled)
+		case <-time.After(time.Second):
+			So("collector did not receive a summary", ShouldBeEmpty)
+		}
+		So(collector.Sessions(), ShouldBeEmpty)
+	})
+
+	Convey("should refuse to stream from a batch publisher", t, func() {
+		f := servePublisher(&pumpingHandler{cancelled: make(chan struct{})})
+		defer f.close()
+
+		sut := f.connect()
+		resp, err := sut.Publish(protocol.PublishRequest{Mode: protocol.PublishModeStream})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+	})
+}
+
+func Test_publisherProxy_Preview(t *testing.T) {
+
+	Convey("should preview a publisher which doesn't implement Previewer by publishing", t, func() {
+		handler := &pumpingHandler{cancelled: make(chan struct{})}
+		f := servePublisher(handler)
+		defer f.close()
+
+		sut := f.connect()
+
+		Convey("with the settings it was initialized with, leaving it initialized", func() {
+			initResp, err := sut.Init(protocol.InitRequest{Settings: map[string]interface{}{"db": "test"}})
+			So(err, ShouldBeNil)
+			So(initResp.Success, ShouldBeTrue)
+
+			resp, err := sut.Preview(protocol.PreviewRequest{
+				ShapeName: "test",
+				Settings:  map[string]interface{}{"db": "test"},
+				Limit:     5,
+			})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeTrue)
+			So(len(resp.DataPoints), ShouldEqual, 5)
+			So(resp.DataPoints[0].Entity, ShouldEqual, "item")
+
+			select {
+			case <-handler.cancelled:
+			case <-time.After(time.Second):
+				So("publisher was not stopped", ShouldBeEmpty)
+			}
+			So(handler.disposeCount(), ShouldEqual, 0)
+		})
+
+		Convey("refusing settings other than the ones it was initialized with", func() {
+			_, err := sut.Init(protocol.InitRequest{Settings: map[string]interface{}{"db": "test"}})
+			So(err, ShouldBeNil)
+
+			resp, err := sut.Preview(protocol.PreviewRequest{
+				ShapeName: "test",
+				Settings:  map[string]interface{}{"db": "other"},
+			})
+			So(err, ShouldEqual, protocol.ErrPreviewSettings)
+			So(resp.Success, ShouldBeFalse)
+			So(handler.disposeCount(), ShouldEqual, 0)
+
+			resp, err = sut.Preview(protocol.PreviewRequest{ShapeName: "test", Limit: 1})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeTrue)
+		})
+
+		Convey("refusing before it's initialized", func() {
+			resp, err := sut.Preview(protocol.PreviewRequest{ShapeName: "test"})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeFalse)
+			So(resp.Message, ShouldContainSubstring, "must be initialized")
+		})
+
+		Convey("refusing after it's disposed", func() {
+			_, err := sut.Init(protocol.InitRequest{Settings: map[string]interface{}{"db": "test"}})
+			So(err, ShouldBeNil)
+			_, err = sut.Dispose(protocol.DisposeRequest{})
+			So(err, ShouldBeNil)
+
+			resp, err := sut.Preview(protocol.PreviewRequest{ShapeName: "test"})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeFalse)
+			So(handler.disposeCount(), ShouldEqual, 1)
+		})
+	})
+}
+
+// evolvingHandler publishes a data point, adds an "email" property
+// to the item shape, and publishes a data point of the new shape.
+type evolvingHandler struct{}
+
+func (p *evolvingHandler) Init(ctx context.Context, request protocol.InitRequest) (protocol.InitResponse, error) {
+	return protocol.InitResponse{Success: true}, nil
+}
+
+func (p *evolvingHandler) Dispose(ctx context.Context, request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
+	return protocol.DisposeResponse{Success: true}, nil
+}
+
+func (p *evolvingHandler) Publish(ctx context.Context, request protocol.PublishRequest, toClient protocol.PublisherClient) (protocol.PublishResponse, error) {
+	go func() {
+		defer toClient.Done(protocol.DoneRequest{})
+
+		toClient.SendDataPoints(protocol.SendDataPointsRequest{
+			DataPoints: []pipeline.DataPoint{{Entity: "item", Data: map[string]interface{}{"id": 1}}},
+		})
+		toClient.ShapeChanged(protocol.ShapeChangedRequest{
+			Shape: pipeline.ShapeDefinition{
+				Name: "item",
+				Keys: []string{"id"},
+				Properties: []pipeline.PropertyDefinition{
+					{Name: "id", Type: "integer"},
+					{Name: "email", Type: "string"},
+				},
+			},
+		})
+		toClient.SendDataPoints(protocol.SendDataPointsRequest{
+			DataPoints: []pipeline.DataPoint{{Entity: "item", Data: map[string]interface{}{"id": 2, "email": "a@example.com"}}},
+		})
+	}()
+	return protocol.PublishResponse{Success: true}, nil
+}
+
+func Test_publisherProxy_ShapeChanged(t *testing.T) {
+
+	Convey("should pause delivery when a shape changes until it's resumed", t, func() {
+		f := servePublisher(&evolvingHandler{})
+		defer f.close()
+
+		validator := shapes.NewValidator(pipeline.ShapeDefinitions{{
+			Name:       "item",
+			Keys:       []string{"id"},
+			Properties: []pipeline.PropertyDefinition{{Name: "id", Type: "integer"}},
+		}}, shapes.Reject)
+
+		changes := make(chan ShapeChange, 1)
+		done := make(chan protocol.DoneRequest, 1)
+		points := make(chan []pipeline.DataPoint, 2)
+		collector := f.collect(points,
+			WithShapeValidator(validator),
+			WithShapeChangePolicy(PauseOnShapeChange),
+			WithShapeChangeHandler(func(change ShapeChange) {
+				changes <- change
+			}),
+			WithDoneHandler(func(request protocol.DoneRequest) {
+				done <- request
+			}))
+
+		sut := f.connect()
+		resp, err := sut.Publish(protocol.PublishRequest{
+			PublishToAddress: collector.Addr(),
+			ShapeName:        "item",
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+
+		select {
+		case dps := <-points:
+			So(dps[0].Data["id"], ShouldEqual, 1)
+		case <-time.After(time.Second):
+			So("no data points were delivered", ShouldBeEmpty)
+		}
+
+		select {
+		case change := <-changes:
+			So(change.SessionID, ShouldEqual, resp.SessionID)
+			So(change.Paused, ShouldBeTrue)
+			So(change.Previous, ShouldNotBeNil)
+			So(change.Changes, ShouldResemble, shapes.Changes{
+				{Kind: shapes.PropertyAdded, Shape: "item", Property: "email", To: "string", Compatibility: shapes.Forward},
+			})
+		case <-time.After(time.Second):
+			So("the shape change was not reported", ShouldBeEmpty)
+		}
+
+		select {
+		case <-points:
+			So("data points were delivered while paused", ShouldBeEmpty)
+		case <-time.After(50 * time.Millisecond):
+		}
+		So(collector.Paused(), ShouldResemble, []string{resp.SessionID})
+
+		So(collector.Resume(resp.SessionID), ShouldBeTrue)
+		So(collector.Resume(resp.SessionID), ShouldBeFalse)
+
+		select {
+		case dps := <-points:
+			So(dps[0].Data["email"], ShouldEqual, "a@example.com")
+		case <-time.After(time.Second):
+			So("data points were not delivered after resuming", ShouldBeEmpty)
+		}
+
+		select {
+		case summary := <-done:
+			So(summary.Status, ShouldEqual, protocol.PublishCompleted)
+		case <-time.After(time.Second):
+			So("collector did not receive a summary", ShouldBeEmpty)
+		}
+		So(collector.Paused(), ShouldBeEmpty)
+	})
+}
+
+func Test_publisherClientServer_SendDataPoints(t *testing.T) {
+
+	Convey("should acknowledge data points it has already delivered without delivering them again", t, func() {
+		output := make(chan []pipeline.DataPoint, 10)
+		sut := &publisherClientServer{
+			output:   output,
+			logger:   logging.Nop(),
+			opts:     defaultOptions(),
+			sessions: newCollectorSessions(),
+			stop:     make(chan struct{}),
+		}
+
+		send := func(seq int64) bool {
+			var resp protocol.SendDataPointsResponse
+			err := sut.SendDataPoints(protocol.SendDataPointsRequest{
+				SessionID:  "session-1",
+				Sequence:   seq,
+				DataPoints: []pipeline.DataPoint{{Entity: "item"}},
+			}, &resp)
+			So(err, ShouldBeNil)
+			return resp.Duplicate
+		}
+
+		So(send(1), ShouldBeFalse)
+		So(send(1), ShouldBeTrue)
+		So(send(2), ShouldBeFalse)
+		So(send(0), ShouldBeFalse)
+		So(output, ShouldHaveLength, 3)
+	})
+}
+
+func Test_publisherClientServer_Checkpoints(t *testing.T) {
+
+	Convey("should save checkpoints under the key given by the key function as they're received", t, func() {
+		checkpoints := checkpoint.NewMemoryStore()
+		key := func(shapeName string) string { return "publisher-1/" + shapeName }
+		sut := &publisherClientServer{
+			logger: logging.Nop(),
+			opts: applyOptions([]Option{
+				WithCheckpointStore(checkpoints),
+				WithCheckpointKey(key),
+			}),
+			sessions: newCollectorSessions(),
+			stop:     make(chan struct{}),
+		}
+
+		err := sut.SendCheckpoint(protocol.SendCheckpointRequest{
+			SessionID:  "session-1",
+			Checkpoint: protocol.Checkpoint{ShapeName: "item", Position: "1"},
+		}, &protocol.SendCheckpointResponse{})
+		So(err, ShouldBeNil)
+
+		request := protocol.PublishRequest{ShapeName: "item"}
+		So(checkpoint.ResumeKey(checkpoints, key, &request), ShouldBeNil)
+		So(request.Checkpoint, ShouldNotBeNil)
+		So(request.Checkpoint.Position, ShouldEqual, "1")
+
+		Convey("and the checkpoint sent with Done, however the publication ended", func() {
+			err := sut.Done(protocol.DoneRequest{
+				SessionID:  "session-1",
+				Status:     protocol.PublishCancelled,
+				Checkpoint: &protocol.Checkpoint{ShapeName: "item", Position: "2"},
+			}, &protocol.DoneResponse{})
+			So(err, ShouldBeNil)
+
+			request := protocol.PublishRequest{ShapeName: "item"}
+			So(checkpoint.ResumeKey(checkpoints, key, &request), ShouldBeNil)
+			So(request.Checkpoint.Position, ShouldEqual, "2")
+
+			_, ok, err := checkpoints.Load("item")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func Test_collectorSessions_forget(t *testing.T) {
+
+	Convey("should forget idle sessions and the sessions it gave up on", t, func() {
+		sut := newCollectorSessions()
+		sut.touch("idle", false)
+		sut.touch("paused", false)
+		So(sut.pause("paused"), ShouldBeTrue)
+		sut.touch("streaming", true)
+		So(sut.expire(time.Now().Add(time.Second)), ShouldResemble, []string{"streaming"})
+
+		So(sut.forget(time.Now().Add(time.Second)), ShouldResemble, []string{"idle"})
+		So(sut.ids(), ShouldResemble, []string{"paused"})
+		So(sut.expired, ShouldBeEmpty)
+
+		Convey("and treat a session which sends again as a new one", func() {
+			So(sut.done("streaming"), ShouldBeTrue)
+			sut.touch("idle", false)
+			So(sut.ids(), ShouldResemble, []string{"idle", "paused"})
+		})
+	})
+}
+
+// echoPublisher answers each TestConnection with the "name" setting, and
+// records the most calls it was in at once.
+type echoPublisher struct {
+	mu      sync.Mutex
+	current int
+	most    int
+}
+
+func (p *echoPublisher) TestConnection(request protocol.TestConnectionRequest) (protocol.TestConnectionResponse, error) {
+	p.mu.Lock()
+	p.current++
+	if p.current > p.most {
+		p.most = p.current
+	}
+	p.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	p.mu.Lock()
+	p.current--
+	p.mu.Unlock()
+
+	name, _ := request.Settings["name"].(string)
+	return protocol.TestConnectionResponse{Success: true, Message: name}, nil
+}
+
+func Test_publisherProxy_Concurrent(t *testing.T) {
+
+	Convey("should be safe to share between goroutines", t, func() {
+		handler := &echoPublisher{}
+		f := servePublisher(handler)
+		defer f.close()
+
+		sut := f.connect(WithMaxInFlight(3))
+
+		var wg sync.WaitGroup
+		mismatches := make(chan string, 50)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := "call-" + strconv.Itoa(i)
+				resp, err := sut.TestConnection(protocol.TestConnectionRequest{
+					Settings: map[string]interface{}{"name": name},
+				})
+				if err != nil || resp.Message != name {
+					mismatches <- name
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(mismatches)
+
+		So(len(mismatches), ShouldEqual, 0)
+		handler.mu.Lock()
+		defer handler.mu.Unlock()
+		So(handler.most, ShouldBeGreaterThan, 1)
+		So(handler.most, ShouldBeLessThanOrEqualTo, 3)
+	})
+}
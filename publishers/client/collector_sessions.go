@@ -0,0 +1,249 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// collectorSession is a publication a DataPointCollector has heard from
+// which hasn't called Done yet.
+type collectorSession struct {
+	lastSeen time.Time
+	// streaming is set once the publication sends a heartbeat.
+	streaming bool
+	// resumed is non-nil while delivery of the publication's data points
+	// is paused, and is closed when it's resumed.
+	resumed chan struct{}
+	// sequence is the Sequence of the last SendDataPoints call delivered.
+	sequence int64
+	// delivery is held while a SendDataPoints call is checked and delivered.
+	delivery sync.Mutex
+}
+
+// collectorSessions tracks the publications sending to a DataPointCollector.
+type collectorSessions struct {
+	mu sync.Mutex
+	m  map[string]*collectorSession
+	// expired holds when sessions were given up on, so that
+	// a Done which arrives late isn't reported twice.
+	expired map[string]time.Time
+}
+
+func newCollectorSessions() *collectorSessions {
+	return &collectorSessions{
+		m:       make(map[string]*collectorSession),
+		expired: make(map[string]time.Time),
+	}
+}
+
+// touch records that the session was heard from.
+func (cs *collectorSessions) touch(id string, heartbeat bool) {
+	if id == "" {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.expired[id]; ok {
+		return
+	}
+	s, ok := cs.m[id]
+	if !ok {
+		s = &collectorSession{}
+		cs.m[id] = s
+	}
+	s.lastSeen = time.Now()
+	s.streaming = s.streaming || heartbeat
+}
+
+// done forgets the session, returning false if it had already been expired.
+func (cs *collectorSessions) done(id string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.expired[id]; ok {
+		delete(cs.expired, id)
+		return false
+	}
+	cs.resumeLocked(id)
+	delete(cs.m, id)
+	return true
+}
+
+// expire forgets the streaming sessions which haven't been heard from since
+// before cutoff and returns their IDs.
+func (cs *collectorSessions) expire(cutoff time.Time) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var ids []string
+	for id, s := range cs.m {
+		if s.streaming && s.lastSeen.Before(cutoff) {
+			cs.resumeLocked(id)
+			delete(cs.m, id)
+			cs.expired[id] = time.Now()
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// forget forgets the sessions which haven't been heard from since before
+// cutoff, unless their delivery is paused, and the sessions given up on
+// before it. It returns the IDs of the sessions which hadn't been given up on.
+func (cs *collectorSessions) forget(cutoff time.Time) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var ids []string
+	for id, s := range cs.m {
+		if s.resumed == nil && s.lastSeen.Before(cutoff) {
+			delete(cs.m, id)
+			ids = append(ids, id)
+		}
+	}
+	for id, expired := range cs.expired {
+		if expired.Before(cutoff) {
+			delete(cs.expired, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ids returns the IDs of the sessions which haven't called Done, in order.
+func (cs *collectorSessions) ids() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ids := make([]string, 0, len(cs.m))
+	for id := range cs.m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// pause pauses delivery of the session's data points, returning false
+// if the session has no ID or has been expired.
+func (cs *collectorSessions) pause(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.expired[id]; ok {
+		return false
+	}
+	s, ok := cs.m[id]
+	if !ok {
+		s = &collectorSession{lastSeen: time.Now()}
+		cs.m[id] = s
+	}
+	if s.resumed == nil {
+		s.resumed = make(chan struct{})
+	}
+	return true
+}
+
+// resume resumes delivery of the session's data points,
+// returning false if it wasn't paused.
+func (cs *collectorSessions) resume(id string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if s, ok := cs.m[id]; ok {
+		// The session hasn't been able to send while it was paused.
+		s.lastSeen = time.Now()
+	}
+	return cs.resumeLocked(id)
+}
+
+func (cs *collectorSessions) resumeLocked(id string) bool {
+	s, ok := cs.m[id]
+	if !ok || s.resumed == nil {
+		return false
+	}
+	close(s.resumed)
+	s.resumed = nil
+	return true
+}
+
+// waitResumed waits until delivery of the session's data points isn't paused,
+// returning false if stop is closed first.
+func (cs *collectorSessions) waitResumed(id string, stop <-chan struct{}) bool {
+	cs.mu.Lock()
+	var resumed chan struct{}
+	if s, ok := cs.m[id]; ok {
+		resumed = s.resumed
+	}
+	cs.mu.Unlock()
+
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// paused returns the IDs of the sessions whose delivery is paused, in order.
+func (cs *collectorSessions) paused() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var ids []string
+	for id, s := range cs.m {
+		if s.resumed != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// lockDelivery stops other SendDataPoints calls of the session being checked
+// and delivered until the returned function is called, so that a call retried
+// while the first attempt is still being delivered is recognised.
+func (cs *collectorSessions) lockDelivery(id string) (unlock func()) {
+	cs.mu.Lock()
+	s, ok := cs.m[id]
+	cs.mu.Unlock()
+
+	if !ok {
+		return func() {}
+	}
+	s.delivery.Lock()
+	return s.delivery.Unlock
+}
+
+// delivered reports whether the SendDataPoints call numbered sequence has
+// already been delivered for the session. Unnumbered calls never have been.
+func (cs *collectorSessions) delivered(id string, sequence int64) bool {
+	if id == "" || sequence == 0 {
+		return false
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	s, ok := cs.m[id]
+	return ok && sequence <= s.sequence
+}
+
+// deliver records that the SendDataPoints call numbered sequence has been delivered.
+func (cs *collectorSessions) deliver(id string, sequence int64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if s, ok := cs.m[id]; ok && sequence > s.sequence {
+		s.sequence = sequence
+	}
+}
@@ -1,24 +1,42 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/logging"
 	"github.com/naveego/navigator-go/publishers/protocol"
 	"github.com/naveego/navigator-go/publishers/server"
+	"github.com/naveego/navigator-go/shapes"
 )
 
 type DataPointCollector struct {
-	addr         string
-	clientServer publisherClientServer
+	addr string
+	opts options
+
+	mu       *sync.Mutex
+	listener net.Listener
+	stop     chan struct{}
+
+	sessions *collectorSessions
+	shapes   *collectorShapes
 }
 
-func NewDataPointCollector(addr string) (DataPointCollector, error) {
+func NewDataPointCollector(addr string, opts ...Option) (DataPointCollector, error) {
 
 	collector := DataPointCollector{
-		addr: addr,
+		addr:     addr,
+		opts:     applyOptions(opts),
+		mu:       &sync.Mutex{},
+		sessions: newCollectorSessions(),
+		shapes:   newCollectorShapes(),
 	}
 
 	return collector, nil
@@ -27,6 +45,11 @@ func NewDataPointCollector(addr string) (DataPointCollector, error) {
 // Start starts a goroutine which will accept datapoints over the collector's address.
 // The collector will listen on the address provided to NewDataPointCollector.
 // The JSON-RPC method prefix is "PublisherClient.".
+//
+// The collector keeps accepting publications until Stop is called.
+// When a publisher calls Done its summary is passed to the handler
+// set by WithDoneHandler. Streaming publications never call Done unless
+// they're cancelled; see WithHeartbeatTimeout.
 func (d *DataPointCollector) Start(output chan<- []pipeline.DataPoint) error {
 
 	listener, err := server.OpenListener(d.addr)
@@ -34,6 +57,22 @@ func (d *DataPointCollector) Start(output chan<- []pipeline.DataPoint) error {
 		return err
 	}
 
+	stop := make(chan struct{})
+
+	d.mu.Lock()
+	d.listener = listener
+	d.stop = stop
+	d.mu.Unlock()
+
+	d.opts.logger.Info("Collecting data points", "addr", d.addr)
+
+	if d.opts.heartbeatTimeout > 0 {
+		go d.expireSessions(stop)
+	}
+	if d.opts.idleTimeout > 0 {
+		go d.forgetSessions(stop)
+	}
+
 	go func() {
 		for {
 			conn, err := listener.Accept()
@@ -41,13 +80,20 @@ func (d *DataPointCollector) Start(output chan<- []pipeline.DataPoint) error {
 				return
 			}
 
-			d.clientServer = publisherClientServer{
+			logger := d.opts.logger.With(logging.FieldRemoteAddr, conn.RemoteAddr().String())
+			logger.Debug("Publisher connected")
+
+			clientServer := &publisherClientServer{
 				output:   output,
-				listener: listener,
+				logger:   logger,
+				opts:     d.opts,
+				sessions: d.sessions,
+				shapes:   d.shapes,
+				stop:     stop,
 			}
 
 			server := rpc.NewServer()
-			server.RegisterName("PublisherClient", &d.clientServer)
+			server.RegisterName("PublisherClient", clientServer)
 
 			codec := jsonrpc.NewServerCodec(conn)
 
@@ -58,29 +104,274 @@ func (d *DataPointCollector) Start(output chan<- []pipeline.DataPoint) error {
 	return nil
 }
 
+// Stop stops the collector accepting connections.
 func (d *DataPointCollector) Stop() {
-	var response protocol.DoneResponse
-	_ = d.clientServer.Done(protocol.DoneRequest{}, &response)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listener != nil {
+		d.listener.Close()
+	}
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+}
+
+// Addr returns the address publishers should send data points to. Once the
+// collector is started it's the address it's listening on, so a port of 0
+// given to NewDataPointCollector is replaced by the one chosen for it.
+func (d *DataPointCollector) Addr() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listener == nil {
+		return d.addr
+	}
+	addr := d.listener.Addr().String()
+	if p := strings.Index(d.addr, "://"); p != -1 {
+		addr = d.addr[:p+3] + addr
+	}
+	return addr
+}
+
+// Sessions returns the IDs of the publications which have sent something
+// to the collector and haven't called Done.
+func (d *DataPointCollector) Sessions() []string {
+	return d.sessions.ids()
+}
+
+// Paused returns the IDs of the publications whose data points aren't being
+// delivered because of a shape change; see WithShapeChangePolicy.
+func (d *DataPointCollector) Paused() []string {
+	return d.sessions.paused()
+}
+
+// Resume resumes delivery of the data points of a publication paused because
+// of a shape change, returning false if it wasn't paused.
+func (d *DataPointCollector) Resume(sessionID string) bool {
+	if !d.sessions.resume(sessionID) {
+		return false
+	}
+	d.opts.logger.Info("Resumed delivery", logging.FieldSessionID, sessionID)
+	return true
+}
+
+// expireSessions gives up on streaming publications which haven't
+// been heard from within the heartbeat timeout, until stop is closed.
+func (d *DataPointCollector) expireSessions(stop <-chan struct{}) {
+	timeout := d.opts.heartbeatTimeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, id := range d.sessions.expire(now.Add(-timeout)) {
+				d.opts.logger.Warn("Publication stopped sending heartbeats", logging.FieldSessionID, id, "timeout", timeout)
+				if d.opts.onDone != nil {
+					d.opts.onDone(protocol.DoneRequest{
+						SessionID: id,
+						Status:    protocol.PublishFailed,
+						Error:     fmt.Sprintf("no heartbeat for %s", timeout),
+					})
+				}
+			}
+		}
+	}
+}
+
+// forgetSessions forgets publications which haven't been heard from
+// for longer than the idle timeout, until stop is closed.
+func (d *DataPointCollector) forgetSessions(stop <-chan struct{}) {
+	timeout := d.opts.idleTimeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, id := range d.sessions.forget(now.Add(-timeout)) {
+				d.opts.logger.Warn("Forgetting idle publication", logging.FieldSessionID, id, "timeout", timeout)
+			}
+		}
+	}
 }
 
 type publisherClientServer struct {
-	listener net.Listener
 	output   chan<- []pipeline.DataPoint
+	logger   logging.Logger
+	opts     options
+	sessions *collectorSessions
+	shapes   *collectorShapes
+	// stop is closed when the collector is stopped.
+	stop <-chan struct{}
 }
 
 // SendDataPoints accepts JSON-RPC calls from the publisher and passes them to the data collector's handler.
+// If delivery of the publication's data points is paused it blocks until it's resumed.
+// Calls whose Sequence shows they've already been delivered are acknowledged without delivering them again.
 func (d *publisherClientServer) SendDataPoints(sendRequest protocol.SendDataPointsRequest, response *protocol.SendDataPointsResponse) error {
 
 	*response = protocol.SendDataPointsResponse{}
 
-	d.output <- sendRequest.DataPoints
+	d.sessions.touch(sendRequest.SessionID, false)
+
+	unlock := d.sessions.lockDelivery(sendRequest.SessionID)
+	defer unlock()
+
+	if d.sessions.delivered(sendRequest.SessionID, sendRequest.Sequence) {
+		d.logger.Debug("Ignoring data points already delivered", logging.FieldSessionID, sendRequest.SessionID, "sequence", sendRequest.Sequence)
+		response.Duplicate = true
+		return nil
+	}
+
+	dataPoints := sendRequest.DataPoints
+	if d.opts.validator != nil {
+		var err error
+		if dataPoints, err = d.validate(sendRequest); err != nil {
+			return err
+		}
+	}
+
+	if !d.sessions.waitResumed(sendRequest.SessionID, d.stop) {
+		return errors.New("collector stopped")
+	}
+
+	d.output <- dataPoints
+	d.sessions.deliver(sendRequest.SessionID, sendRequest.Sequence)
 
 	return nil
 }
 
-// Done stops the collector.
+// validate checks the data points of request with the validator,
+// returning the data points to output or the reason they were refused.
+func (d *publisherClientServer) validate(request protocol.SendDataPointsRequest) ([]pipeline.DataPoint, error) {
+	v := d.opts.validator
+	dataPoints := make([]pipeline.DataPoint, len(request.DataPoints))
+
+	for i, dp := range request.DataPoints {
+		checked, violations, err := v.Check("", dp)
+		if err != nil {
+			d.logger.Warn("Refused data points which don't conform to their shape", logging.FieldSessionID, request.SessionID, "shape", dp.Entity, "policy", v.Policy(), "error", err)
+			return nil, fmt.Errorf("data point %d: %s", i, err)
+		}
+		if len(violations) > 0 {
+			d.logger.Warn("Data point doesn't conform to its shape", logging.FieldSessionID, request.SessionID, "shape", dp.Entity, "policy", v.Policy(), "error", violations)
+		}
+		dataPoints[i] = checked
+	}
+
+	return dataPoints, nil
+}
+
+// SendCheckpoint accepts JSON-RPC calls from the publisher and commits the checkpoint to the store, if there is one.
+// The data points sent before it have already been written to the output channel.
+func (d *publisherClientServer) SendCheckpoint(request protocol.SendCheckpointRequest, response *protocol.SendCheckpointResponse) error {
+
+	*response = protocol.SendCheckpointResponse{}
+
+	d.sessions.touch(request.SessionID, false)
+
+	if d.opts.checkpoints != nil {
+		return d.opts.checkpoints.Save(d.opts.checkpointKey(request.Checkpoint.ShapeName), request.Checkpoint)
+	}
+
+	return nil
+}
+
+// ReportProgress accepts JSON-RPC calls from the publisher and passes them to the progress handler, if there is one.
+func (d *publisherClientServer) ReportProgress(request protocol.ReportProgressRequest, response *protocol.ReportProgressResponse) error {
+
+	*response = protocol.ReportProgressResponse{}
+
+	d.sessions.touch(request.SessionID, false)
+
+	if d.opts.onProgress != nil {
+		d.opts.onProgress(request)
+	}
+
+	return nil
+}
+
+// Done accepts the publisher's summary of a publication and passes it to the done handler, if there is one.
 func (d *publisherClientServer) Done(doneRequest protocol.DoneRequest, response *protocol.DoneResponse) error {
-	d.listener.Close()
+	d.logger.Debug("Publisher done", logging.FieldMethod, "Done", logging.FieldSessionID, doneRequest.SessionID, "status", doneRequest.Status)
+
 	*response = protocol.DoneResponse{}
+
+	if !d.sessions.done(doneRequest.SessionID) {
+		d.logger.Warn("Publication called Done after it timed out", logging.FieldSessionID, doneRequest.SessionID)
+		return nil
+	}
+
+	if d.opts.checkpoints != nil && doneRequest.Checkpoint != nil {
+		err := d.opts.checkpoints.Save(d.opts.checkpointKey(doneRequest.Checkpoint.ShapeName), *doneRequest.Checkpoint)
+		if err != nil {
+			d.logger.Error("Could not save checkpoint", logging.FieldSessionID, doneRequest.SessionID, "error", err)
+		}
+	}
+
+	if d.opts.onDone != nil {
+		d.opts.onDone(doneRequest)
+	}
+
+	return nil
+}
+
+// Heartbeat accepts heartbeats from streaming publications and passes them to the heartbeat handler, if there is one.
+func (d *publisherClientServer) Heartbeat(request protocol.HeartbeatRequest, response *protocol.HeartbeatResponse) error {
+
+	*response = protocol.HeartbeatResponse{}
+
+	d.sessions.touch(request.SessionID, true)
+
+	if d.opts.onHeartbeat != nil {
+		d.opts.onHeartbeat(request)
+	}
+
+	return nil
+}
+
+// ShapeChanged accepts reports of shape changes from the publisher, passes them to the shape change handler,
+// if there is one, and pauses delivery of the publication's data points if the policy says to.
+// Later data points are checked against the new shape if there's a shape validator.
+func (d *publisherClientServer) ShapeChanged(request protocol.ShapeChangedRequest, response *protocol.ShapeChangedResponse) error {
+
+	*response = protocol.ShapeChangedResponse{}
+
+	d.sessions.touch(request.SessionID, false)
+
+	change := ShapeChange{
+		SessionID: request.SessionID,
+		Shape:     request.Shape,
+	}
+
+	prev, ok := d.shapes.swap(request.Shape)
+	if !ok && d.opts.validator != nil {
+		prev, ok = d.opts.validator.Shape(request.Shape.Name)
+	}
+	if ok {
+		change.Previous = &prev
+		change.Changes = shapes.Compare(pipeline.ShapeDefinitions{prev}, pipeline.ShapeDefinitions{request.Shape})
+	}
+
+	if d.opts.validator != nil {
+		d.opts.validator.SetShape(request.Shape)
+	}
+
+	if d.opts.shapeChangePolicy.pauses(change) {
+		change.Paused = d.sessions.pause(request.SessionID)
+	}
+	response.Paused = change.Paused
+
+	d.logger.Info("Shape changed", logging.FieldSessionID, request.SessionID, "shape", request.Shape.Name, "changes", len(change.Changes), "paused", change.Paused)
+
+	if d.opts.onShapeChange != nil {
+		d.opts.onShapeChange(change)
+	}
+
 	return nil
 }
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/publishers/checkpoint"
+	"github.com/naveego/navigator-go/publishers/protocol"
+	"github.com/naveego/navigator-go/shapes"
+)
+
+// Option configures a publisher proxy or a DataPointCollector.
+type Option func(*options)
+
+type options struct {
+	logger        logging.Logger
+	maxInFlight   int
+	onProgress    func(protocol.ReportProgressRequest)
+	onDone        func(protocol.DoneRequest)
+	checkpoints   checkpoint.Store
+	checkpointKey checkpoint.KeyFunc
+
+	onHeartbeat      func(protocol.HeartbeatRequest)
+	heartbeatTimeout time.Duration
+	idleTimeout      time.Duration
+
+	validator *shapes.Validator
+
+	onShapeChange     func(ShapeChange)
+	shapeChangePolicy ShapeChangePolicy
+}
+
+func defaultOptions() options {
+	return options{
+		logger:            logging.Default(),
+		checkpointKey:     checkpoint.ShapeKey,
+		idleTimeout:       time.Hour,
+		shapeChangePolicy: ContinueOnShapeChange,
+	}
+}
+
+func applyOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger used by the proxy or collector.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = logging.Nop()
+		}
+		o.logger = logger
+	}
+}
+
+// WithMaxInFlight sets the number of calls a proxy sends over its connection at
+// once. Calls beyond it wait their turn in the order they were made. The default,
+// 0, means there's no limit.
+func WithMaxInFlight(calls int) Option {
+	return func(o *options) {
+		o.maxInFlight = calls
+	}
+}
+
+// WithProgressHandler sets a function the DataPointCollector calls
+// each time a publisher reports its progress.
+func WithProgressHandler(handler func(protocol.ReportProgressRequest)) Option {
+	return func(o *options) {
+		o.onProgress = handler
+	}
+}
+
+// WithDoneHandler sets a function the DataPointCollector calls with the
+// publisher's summary when a publication ends. Publishers send data points
+// synchronously, so by the time it's called every data point the publication
+// sent has been written to the output channel.
+func WithDoneHandler(handler func(protocol.DoneRequest)) Option {
+	return func(o *options) {
+		o.onDone = handler
+	}
+}
+
+// WithCheckpointStore sets the store the DataPointCollector commits checkpoints to.
+// A checkpoint is saved as soon as the publisher sends it, whether or not the
+// publication goes on to complete, since a streaming publication never does;
+// a checkpoint sent with Done is saved too. Use checkpoint.Resume to apply
+// them to the next PublishRequest.
+func WithCheckpointStore(store checkpoint.Store) Option {
+	return func(o *options) {
+		o.checkpoints = store
+	}
+}
+
+// WithCheckpointKey sets the function which picks the key a checkpoint is
+// saved under from its shape name. The default, checkpoint.ShapeKey, uses the
+// shape name itself; hosts which share a store between several publishers
+// should add something that identifies the publisher, and pass the same
+// function to checkpoint.ResumeKey.
+func WithCheckpointKey(key checkpoint.KeyFunc) Option {
+	return func(o *options) {
+		if key == nil {
+			key = checkpoint.ShapeKey
+		}
+		o.checkpointKey = key
+	}
+}
+
+// WithHeartbeatHandler sets a function the DataPointCollector calls each time
+// a streaming publication sends a heartbeat.
+func WithHeartbeatHandler(handler func(protocol.HeartbeatRequest)) Option {
+	return func(o *options) {
+		o.onHeartbeat = handler
+	}
+}
+
+// WithHeartbeatTimeout sets how long the DataPointCollector waits to hear from
+// a streaming publication before it gives up on it. When it does, the done
+// handler is called with a failed summary. A streaming publication is one which
+// has sent a heartbeat; other publications are never timed out, though they're
+// forgotten once they've been idle for a while; see WithIdleTimeout. The default
+// of zero disables the timeout.
+func WithHeartbeatTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.heartbeatTimeout = timeout
+	}
+}
+
+// WithIdleTimeout sets how long the DataPointCollector remembers a publication
+// it hasn't heard from, so that publications which never call Done, such as
+// those whose publisher crashed, don't build up. A forgotten publication which
+// sends again is treated as a new one, and its Done is still passed to the done
+// handler. Publications whose delivery is paused aren't forgotten. The same
+// timeout applies to remembering publications given up on for missing
+// heartbeats. The default is an hour; zero remembers them until they're done.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = timeout
+	}
+}
+
+// WithShapeValidator sets a validator the DataPointCollector checks each
+// data point it's sent against, using the data point's Entity as its shape.
+// If the validator refuses any data point in a call to SendDataPoints, none
+// of them are written to the output channel and the call returns an error
+// listing the violations. Violations in data points it accepts are logged
+// as warnings.
+func WithShapeValidator(v *shapes.Validator) Option {
+	return func(o *options) {
+		o.validator = v
+	}
+}
+
+// WithShapeChangeHandler sets a function the DataPointCollector calls each
+// time a publisher reports that the definition of a shape has changed.
+func WithShapeChangeHandler(handler func(ShapeChange)) Option {
+	return func(o *options) {
+		o.onShapeChange = handler
+	}
+}
+
+// WithShapeChangePolicy sets whether the DataPointCollector keeps delivering
+// a publication's data points after the publisher reports a shape change.
+// The default is ContinueOnShapeChange.
+func WithShapeChangePolicy(policy ShapeChangePolicy) Option {
+	return func(o *options) {
+		o.shapeChangePolicy = policy
+	}
+}
+
+// remoteAddr returns the remote address of conn if it has one.
+func remoteAddr(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(net.Conn); ok && c.RemoteAddr() != nil {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
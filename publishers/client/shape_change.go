@@ -0,0 +1,75 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/shapes"
+)
+
+// ShapeChangePolicy decides whether a DataPointCollector keeps delivering
+// a publication's data points after the publisher reports a shape change.
+type ShapeChangePolicy string
+
+const (
+	// ContinueOnShapeChange keeps delivering data points.
+	ContinueOnShapeChange ShapeChangePolicy = "continue"
+	// PauseOnShapeChange pauses delivery until DataPointCollector.Resume is called.
+	PauseOnShapeChange ShapeChangePolicy = "pause"
+	// PauseOnBreakingShapeChange pauses delivery if the change is breaking for
+	// consumers of the previous definition of the shape, or if the collector
+	// doesn't know the previous definition, and otherwise keeps delivering.
+	PauseOnBreakingShapeChange ShapeChangePolicy = "pause-breaking"
+)
+
+// pauses reports whether the policy pauses delivery after change.
+func (p ShapeChangePolicy) pauses(change ShapeChange) bool {
+	switch p {
+	case PauseOnShapeChange:
+		return true
+	case PauseOnBreakingShapeChange:
+		if change.Previous == nil {
+			return true
+		}
+		switch change.Changes.Compatibility() {
+		case shapes.Full, shapes.Forward:
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// ShapeChange describes a change to the definition of a shape reported by a publisher.
+type ShapeChange struct {
+	SessionID string
+	// Shape is the new definition of the shape.
+	Shape pipeline.ShapeDefinition
+	// Previous is the definition the collector knew of before, if any.
+	Previous *pipeline.ShapeDefinition
+	// Changes lists the differences between Previous and Shape.
+	Changes shapes.Changes
+	// Paused is true if delivery of the publication's data points has been
+	// paused, until DataPointCollector.Resume is called.
+	Paused bool
+}
+
+// collectorShapes records the latest definition of each shape
+// publishers have reported to a DataPointCollector.
+type collectorShapes struct {
+	mu sync.Mutex
+	m  map[string]pipeline.ShapeDefinition
+}
+
+func newCollectorShapes() *collectorShapes {
+	return &collectorShapes{m: make(map[string]pipeline.ShapeDefinition)}
+}
+
+// swap records def and returns the definition it replaces, if any.
+func (cs *collectorShapes) swap(def pipeline.ShapeDefinition) (pipeline.ShapeDefinition, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	prev, ok := cs.m[def.Name]
+	cs.m[def.Name] = def
+	return prev, ok
+}
@@ -0,0 +1,168 @@
+package filter
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/naveego/navigator-go/internal/numeric"
+)
+
+// Expr is a parsed predicate.
+type Expr interface {
+	// Match reports whether data, the Data of a data point, satisfies the predicate.
+	// A property missing from data is null.
+	Match(data map[string]interface{}) bool
+	String() string
+}
+
+type and struct{ left, right Expr }
+
+func (e and) Match(data map[string]interface{}) bool {
+	return e.left.Match(data) && e.right.Match(data)
+}
+
+func (e and) String() string {
+	return "(" + e.left.String() + " AND " + e.right.String() + ")"
+}
+
+type or struct{ left, right Expr }
+
+func (e or) Match(data map[string]interface{}) bool {
+	return e.left.Match(data) || e.right.Match(data)
+}
+
+func (e or) String() string {
+	return "(" + e.left.String() + " OR " + e.right.String() + ")"
+}
+
+type comparison struct {
+	property string
+	op       string
+	value    interface{}
+}
+
+// Match compares values of the same kind. Values of different kinds are
+// never equal and can't be ordered, so only != matches them.
+func (e comparison) Match(data map[string]interface{}) bool {
+	c, ok := compare(data[e.property], e.value)
+	if !ok {
+		return e.op == "!="
+	}
+	switch e.value.(type) {
+	case nil, bool:
+		if e.op != "=" && e.op != "!=" {
+			return false
+		}
+	}
+	switch e.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func (e comparison) String() string {
+	return quoteProperty(e.property) + " " + e.op + " " + formatLiteral(e.value)
+}
+
+type in struct {
+	property string
+	values   []interface{}
+}
+
+func (e in) Match(data map[string]interface{}) bool {
+	v := data[e.property]
+	for _, value := range e.values {
+		if c, ok := compare(v, value); ok && c == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (e in) String() string {
+	values := make([]string, len(e.values))
+	for i, v := range e.values {
+		values[i] = formatLiteral(v)
+	}
+	return quoteProperty(e.property) + " IN (" + strings.Join(values, ", ") + ")"
+}
+
+// compare compares a property value with a literal, returning false if they
+// aren't of comparable kinds. Booleans and nulls are only equal or not, so
+// the order compare returns for them is meaningless.
+func compare(v interface{}, literal interface{}) (int, bool) {
+	switch l := literal.(type) {
+	case nil:
+		if v == nil {
+			return 0, true
+		}
+		return 1, true
+	case float64:
+		f, ok := numeric.Float(v)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case f < l:
+			return -1, true
+		case f > l:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(s, l), true
+	case bool:
+		b, ok := v.(bool)
+		if !ok {
+			return 0, false
+		}
+		if b == l {
+			return 0, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func quoteProperty(name string) string {
+	for i, r := range name {
+		if !(r == '_' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || (i > 0 && '0' <= r && r <= '9')) {
+			return "`" + strings.Replace(name, "`", "``", -1) + "`"
+		}
+	}
+	if isReserved(token{kind: tokenIdent, text: name}) || name == "" {
+		return "`" + name + "`"
+	}
+	return name
+}
+
+func formatLiteral(v interface{}) string {
+	switch l := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "'" + strings.Replace(l, "'", "''", -1) + "'"
+	case bool:
+		if l {
+			return "true"
+		}
+		return "false"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,101 @@
+// Package filter applies the filter, projection, limit and sample rate of a
+// PublishRequest to data points, for publishers whose source can't apply
+// them itself.
+package filter
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/publishers/protocol"
+)
+
+// Filter decides which data points of a publication are sent, and what they contain.
+// A Filter counts the data points it lets through, so it's not safe for concurrent
+// use; create one for each publication.
+type Filter struct {
+	expr       Expr
+	properties []string
+	limit      int64
+	sampleRate float64
+
+	matched int64
+	sent    int64
+}
+
+// New returns a Filter for the publication requested by request,
+// or an error if its filter can't be parsed or its limits are invalid.
+func New(request protocol.PublishRequest) (*Filter, error) {
+	f := &Filter{
+		properties: request.Properties,
+		limit:      request.Limit,
+		sampleRate: request.SampleRate,
+	}
+
+	if request.Filter != "" {
+		expr, err := Parse(request.Filter)
+		if err != nil {
+			return nil, err
+		}
+		f.expr = expr
+	}
+
+	if f.limit < 0 {
+		return nil, fmt.Errorf("filter: invalid limit %d", f.limit)
+	}
+	if f.sampleRate < 0 || f.sampleRate > 1 || math.IsNaN(f.sampleRate) {
+		return nil, fmt.Errorf("filter: invalid sample rate %v", f.sampleRate)
+	}
+	if f.sampleRate == 0 {
+		f.sampleRate = 1
+	}
+
+	return f, nil
+}
+
+// Apply returns dp projected onto the requested properties, and whether
+// it should be sent. A data point is sent if it matches the filter, is
+// picked by the sample and doesn't exceed the limit.
+//
+// Sampling is systematic rather than random: with a sample rate of 0.25,
+// every fourth matching data point is sent. The properties named in dp.KeyNames
+// are always kept, so the projected data points can still be upserted.
+func (f *Filter) Apply(dp pipeline.DataPoint) (pipeline.DataPoint, bool) {
+	if f.Done() {
+		return dp, false
+	}
+	if f.expr != nil && !f.expr.Match(dp.Data) {
+		return dp, false
+	}
+
+	f.matched++
+	if math.Floor(float64(f.matched)*f.sampleRate) == math.Floor(float64(f.matched-1)*f.sampleRate) {
+		return dp, false
+	}
+
+	f.sent++
+	return f.project(dp), true
+}
+
+// Done reports whether the limit has been reached, so the publisher can stop reading its source.
+func (f *Filter) Done() bool {
+	return f.limit > 0 && f.sent >= f.limit
+}
+
+func (f *Filter) project(dp pipeline.DataPoint) pipeline.DataPoint {
+	if len(f.properties) == 0 {
+		return dp
+	}
+
+	data := make(map[string]interface{}, len(f.properties)+len(dp.KeyNames))
+	for _, names := range [][]string{dp.KeyNames, f.properties} {
+		for _, name := range names {
+			if v, ok := dp.Data[name]; ok {
+				data[name] = v
+			}
+		}
+	}
+	dp.Data = data
+	return dp
+}
@@ -0,0 +1,165 @@
+package filter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/publishers/protocol"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParse(t *testing.T) {
+
+	Convey("Given some data", t, func() {
+		data := map[string]interface{}{
+			"name":      "O'Brien",
+			"age":       42,
+			"score":     json.Number("7.5"),
+			"active":    true,
+			"country":   "CA",
+			"full name": "Pat O'Brien",
+			"straße":    "Hauptstraße",
+			"missing":   nil,
+		}
+
+		match := func(expr string) bool {
+			e, err := Parse(expr)
+			So(err, ShouldBeNil)
+			return e.Match(data)
+		}
+
+		Convey("comparisons should match", func() {
+			So(match("age = 42"), ShouldBeTrue)
+			So(match("age >= 42 AND age < 43"), ShouldBeTrue)
+			So(match("age <> 42"), ShouldBeFalse)
+			So(match("score > 7"), ShouldBeTrue)
+			So(match("name = 'O''Brien'"), ShouldBeTrue)
+			So(match(`name != "Smith"`), ShouldBeTrue)
+			So(match("active = TRUE"), ShouldBeTrue)
+			So(match("`full name` = 'Pat O''Brien'"), ShouldBeTrue)
+			So(match("straße = 'Hauptstraße'"), ShouldBeTrue)
+		})
+
+		Convey("values of different kinds should not be equal or ordered", func() {
+			So(match("age = '42'"), ShouldBeFalse)
+			So(match("age != '42'"), ShouldBeTrue)
+			So(match("name > 1"), ShouldBeFalse)
+			So(match("active > false"), ShouldBeFalse)
+		})
+
+		Convey("missing properties should be null", func() {
+			So(match("missing = null"), ShouldBeTrue)
+			So(match("nope = NULL"), ShouldBeTrue)
+			So(match("name = null"), ShouldBeFalse)
+			So(match("name != null"), ShouldBeTrue)
+		})
+
+		Convey("IN should match any of its values", func() {
+			So(match("country IN ('US', 'CA')"), ShouldBeTrue)
+			So(match("country in ('US', 'MX')"), ShouldBeFalse)
+			So(match("age IN (41, 42)"), ShouldBeTrue)
+		})
+
+		Convey("AND should bind tighter than OR", func() {
+			So(match("age = 1 AND age = 2 OR active = true"), ShouldBeTrue)
+			So(match("age = 1 AND (age = 2 OR active = true)"), ShouldBeFalse)
+		})
+
+		Convey("String should round trip", func() {
+			e, err := Parse("a = 1 AND (`b c` IN ('x', 'y''z') OR d != null)")
+			So(err, ShouldBeNil)
+			again, err := Parse(e.String())
+			So(err, ShouldBeNil)
+			So(again.String(), ShouldEqual, e.String())
+		})
+	})
+
+	Convey("Invalid filters should not parse", t, func() {
+		for _, expr := range []string{
+			"",
+			"age",
+			"age = ",
+			"age == 1",
+			"age ! 1",
+			"(age = 1",
+			"age = 1 OR",
+			"age IN ()",
+			"age IN (1 2)",
+			"name = 'unterminated",
+			"and = 1",
+			"age = 1 age = 2",
+			"age = #",
+			"age × 2 = 4",
+		} {
+			_, err := Parse(expr)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestFilter(t *testing.T) {
+
+	points := make([]pipeline.DataPoint, 10)
+	for i := range points {
+		points[i] = pipeline.DataPoint{
+			KeyNames: []string{"id"},
+			Data: map[string]interface{}{
+				"id":    i,
+				"even":  i%2 == 0,
+				"name":  "item",
+				"extra": "ignored",
+			},
+		}
+	}
+
+	apply := func(f *Filter) []pipeline.DataPoint {
+		var sent []pipeline.DataPoint
+		for _, dp := range points {
+			if dp, ok := f.Apply(dp); ok {
+				sent = append(sent, dp)
+			}
+		}
+		return sent
+	}
+
+	Convey("An empty request should send everything unchanged", t, func() {
+		f, err := New(protocol.PublishRequest{})
+		So(err, ShouldBeNil)
+		So(apply(f), ShouldResemble, points)
+		So(f.Done(), ShouldBeFalse)
+	})
+
+	Convey("Filter, sample rate and limit should be applied in that order", t, func() {
+		f, err := New(protocol.PublishRequest{
+			Filter:     "even = true",
+			SampleRate: 0.5,
+			Limit:      2,
+		})
+		So(err, ShouldBeNil)
+
+		sent := apply(f)
+		So(len(sent), ShouldEqual, 2)
+		So(sent[0].Data["id"], ShouldEqual, 2)
+		So(sent[1].Data["id"], ShouldEqual, 6)
+		So(f.Done(), ShouldBeTrue)
+	})
+
+	Convey("Projection should keep the keys", t, func() {
+		f, err := New(protocol.PublishRequest{Properties: []string{"name"}})
+		So(err, ShouldBeNil)
+
+		sent := apply(f)
+		So(sent[3].Data, ShouldResemble, map[string]interface{}{"id": 3, "name": "item"})
+		So(points[3].Data, ShouldContainKey, "extra")
+	})
+
+	Convey("Invalid requests should be rejected", t, func() {
+		_, err := New(protocol.PublishRequest{Filter: "even ="})
+		So(err, ShouldNotBeNil)
+		_, err = New(protocol.PublishRequest{SampleRate: 1.5})
+		So(err, ShouldNotBeNil)
+		_, err = New(protocol.PublishRequest{Limit: -1})
+		So(err, ShouldNotBeNil)
+	})
+}
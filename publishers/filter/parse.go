@@ -0,0 +1,296 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parse parses a predicate. The language is a small subset of SQL:
+//
+//	status = 'active' AND (age >= 21 OR country IN ('US', 'CA'))
+//
+// Comparisons are =, !=, <>, <, <=, > and >=, between a property and a
+// literal. Literals are numbers, strings in single or double quotes, true,
+// false and null. Properties whose names aren't plain identifiers can be
+// written in backquotes. Keywords are case insensitive, and AND binds
+// tighter than OR.
+func Parse(expr string) (Expr, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	// tokenQuotedIdent is a property name in backquotes.
+	tokenQuotedIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// keyword reports whether t is the keyword kw.
+func (t token) keyword(kw string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, kw)
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		case c == '=':
+			tokens = append(tokens, token{tokenOp, "=", i})
+			i++
+		case c == '!' || c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(s) && (s[i+1] == '=' || (c == '<' && s[i+1] == '>')) {
+				op += string(s[i+1])
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("filter: unexpected '!' at %d", i)
+			}
+			tokens = append(tokens, token{tokenOp, op, i})
+			i += len(op)
+		case c == '\'' || c == '"' || c == '`':
+			// Quotes are escaped by doubling them, as in SQL.
+			var b strings.Builder
+			j := i + 1
+			for ; ; j++ {
+				if j >= len(s) {
+					return nil, fmt.Errorf("filter: unterminated %c at %d", c, i)
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						b.WriteByte(c)
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+			}
+			kind := tokenString
+			if c == '`' {
+				kind = tokenQuotedIdent
+			}
+			tokens = append(tokens, token{kind, b.String(), i})
+			i = j + 1
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || s[j] == 'e' || s[j] == 'E' || (s[j] >= '0' && s[j] <= '9') ||
+				((s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, s[i:j], i})
+			i = j
+		case c == '_' || isLetterAt(s, i):
+			j := i
+			for j < len(s) {
+				r, size := utf8.DecodeRuneInString(s[j:])
+				if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += size
+			}
+			tokens = append(tokens, token{tokenIdent, s[i:j], i})
+			i = j
+		default:
+			r, _ := utf8.DecodeRuneInString(s[i:])
+			return nil, fmt.Errorf("filter: unexpected %q at %d", r, i)
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(s)}), nil
+}
+
+// isLetterAt reports whether the rune starting at byte i of s is a letter.
+func isLetterAt(s string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return unicode.IsLetter(r)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("filter: %s at %d", fmt.Sprintf(format, args...), t.pos)
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword("AND") {
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+
+	if t.kind == tokenLParen {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, p.errorf(t, "expected ')', found %s", t)
+		}
+		return e, nil
+	}
+
+	if t.kind != tokenQuotedIdent && (t.kind != tokenIdent || isReserved(t)) {
+		return nil, p.errorf(t, "expected a property, found %s", t)
+	}
+	property := t.text
+
+	t = p.next()
+	switch {
+	case t.kind == tokenOp:
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "<>" {
+			op = "!="
+		}
+		return comparison{property: property, op: op, value: value}, nil
+
+	case t.keyword("IN"):
+		if t := p.next(); t.kind != tokenLParen {
+			return nil, p.errorf(t, "expected '(' after IN, found %s", t)
+		}
+		var values []interface{}
+		for {
+			value, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+
+			t := p.next()
+			if t.kind == tokenRParen {
+				break
+			}
+			if t.kind != tokenComma {
+				return nil, p.errorf(t, "expected ',' or ')', found %s", t)
+			}
+		}
+		return in{property: property, values: values}, nil
+	}
+
+	return nil, p.errorf(t, "expected a comparison or IN after %q, found %s", property, t)
+}
+
+func (p *parser) parseLiteral() (interface{}, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenString:
+		return t.text, nil
+	case t.kind == tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s", t)
+		}
+		return f, nil
+	case t.keyword("TRUE"):
+		return true, nil
+	case t.keyword("FALSE"):
+		return false, nil
+	case t.keyword("NULL"):
+		return nil, nil
+	}
+	return nil, p.errorf(t, "expected a value, found %s", t)
+}
+
+// isReserved reports whether t is a keyword which can't be used as a bare property name.
+func isReserved(t token) bool {
+	for _, kw := range []string{"AND", "OR", "IN", "TRUE", "FALSE", "NULL"} {
+		if t.keyword(kw) {
+			return true
+		}
+	}
+	return false
+}
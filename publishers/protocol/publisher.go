@@ -1,42 +1,241 @@
 package protocol
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/metadata"
+	"github.com/naveego/navigator-go/settings"
 )
 
 type DiscoverShapesRequest struct {
+	Metadata metadata.Metadata      `json:"metadata"`
 	Settings map[string]interface{} `json:"settings"`
 }
 
 type DiscoverShapesResponse struct {
-	Shapes pipeline.ShapeDefinitions `json:"shapes"`
+	Metadata metadata.Metadata         `json:"metadata"`
+	Shapes   pipeline.ShapeDefinitions `json:"shapes"`
+	// ValidationErrors lists the problems with the request's settings.
+	// If it's not empty the handler wasn't called.
+	ValidationErrors settings.ValidationErrors `json:"validationErrors,omitempty"`
 }
 
 type ShapeDiscoverer interface {
 	DiscoverShapes(request DiscoverShapesRequest) (DiscoverShapesResponse, error)
 }
 
+// ContextShapeDiscoverer is a ShapeDiscoverer which receives a context.
+// The wrapper prefers it over ShapeDiscoverer when a handler implements it.
+type ContextShapeDiscoverer interface {
+	DiscoverShapes(ctx context.Context, request DiscoverShapesRequest) (DiscoverShapesResponse, error)
+}
+
 type TestConnectionRequest struct {
+	Metadata metadata.Metadata      `json:"metadata"`
 	Settings map[string]interface{} `json:"settings"`
 }
 
 type TestConnectionResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Metadata metadata.Metadata `json:"metadata"`
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
+	// ValidationErrors lists the problems with the request's settings.
+	// If it's not empty the handler wasn't called.
+	ValidationErrors settings.ValidationErrors `json:"validationErrors,omitempty"`
 }
 
 type ConnectionTester interface {
 	TestConnection(request TestConnectionRequest) (TestConnectionResponse, error)
 }
 
+// ContextConnectionTester is a ConnectionTester which receives a context.
+// The wrapper prefers it over ConnectionTester when a handler implements it.
+type ContextConnectionTester interface {
+	TestConnection(ctx context.Context, request TestConnectionRequest) (TestConnectionResponse, error)
+}
+
 type PublishRequest struct {
-	ShapeName        string `json:"shapeName"`
-	PublishToAddress string `json:"publishToAddress" mapstructure:"publishToAddress"`
+	Metadata         metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	ShapeName        string            `json:"shapeName"`
+	PublishToAddress string            `json:"publishToAddress" mapstructure:"publishToAddress"`
+	// SessionID identifies the publication. If it's empty the wrapper assigns one,
+	// which is returned in the response.
+	SessionID string `json:"sessionId" mapstructure:"sessionId"`
+	// Checkpoint is where the last committed publication of the shape ended.
+	// Publishers which support it should resume from there; if it's nil they
+	// should publish everything.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty" mapstructure:"checkpoint"`
+	// Properties, if it's not empty, lists the properties the host wants.
+	// Publishers should leave the others out of the data points they send.
+	Properties []string `json:"properties,omitempty" mapstructure:"properties"`
+	// Filter, if it's not empty, is a predicate data points must satisfy to
+	// be sent, such as "status = 'active' AND age >= 21". See package filter
+	// for the syntax and for an evaluator publishers can use when their
+	// source can't apply it.
+	Filter string `json:"filter,omitempty" mapstructure:"filter"`
+	// Limit, if it's not zero, is the most data points the publication should send.
+	Limit int64 `json:"limit,omitempty" mapstructure:"limit"`
+	// SampleRate, if it's not zero, is the fraction of the data points
+	// matching the filter the publication should send, between 0 and 1.
+	SampleRate float64 `json:"sampleRate,omitempty" mapstructure:"sampleRate"`
+	// Mode is PublishModeBatch if it's empty.
+	Mode PublishMode `json:"mode,omitempty" mapstructure:"mode"`
+	// HeartbeatIntervalMS is how often the wrapper sends heartbeats during
+	// a PublishModeStream publication, in milliseconds. If it's zero the
+	// wrapper uses DefaultHeartbeatIntervalMS.
+	HeartbeatIntervalMS int64 `json:"heartbeatIntervalMs,omitempty" mapstructure:"heartbeatIntervalMs"`
 }
 
+// PublishMode selects how a publication behaves.
+type PublishMode string
+
+const (
+	// PublishModeBatch publications send what's in the source and call Done.
+	PublishModeBatch PublishMode = "batch"
+	// PublishModeStream publications stay open, sending changes to the source
+	// as they happen, until they're cancelled. They're handled by StreamPublisher.
+	PublishModeStream PublishMode = "stream"
+)
+
+// DefaultHeartbeatIntervalMS is the heartbeat interval used when a
+// PublishModeStream request doesn't set one.
+const DefaultHeartbeatIntervalMS = 30000
+
+// Actions set on data points sent in a PublishModeStream publication, along
+// with pipeline.DataPointDelete. pipeline.DataPointUpsert may be used when
+// the source can't tell inserts and updates apart.
+const (
+	DataPointInsert pipeline.DataPointAction = "insert"
+	DataPointUpdate pipeline.DataPointAction = "update"
+)
+
 type PublishResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Metadata  metadata.Metadata `json:"metadata"`
+	Success   bool              `json:"success"`
+	Message   string            `json:"message"`
+	SessionID string            `json:"sessionId"`
+}
+
+type CancelPublishRequest struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	SessionID string            `json:"sessionId"`
+}
+
+type CancelPublishResponse struct {
+	Metadata metadata.Metadata `json:"metadata"`
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
+}
+
+// StreamPublisher is implemented by publishers which support PublishModeStream.
+//
+// The wrapper calls PublishStream in its own goroutine and answers the
+// PublishRequest as soon as the stream has started. PublishStream should
+// send changes to toClient as they happen, marking each data point with
+// DataPointInsert, DataPointUpdate or pipeline.DataPointDelete and sending a
+// checkpoint after each change it wants to be able to resume from, and
+// return only when ctx is cancelled or it can't go on. The wrapper sends
+// heartbeats and calls Done when it returns.
+type StreamPublisher interface {
+	PublishStream(ctx context.Context, request PublishRequest, toClient PublisherClient) error
+}
+
+type PreviewRequest struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	ShapeName string            `json:"shapeName"`
+	// Settings are the settings to preview the shape with, as they would be
+	// passed to Init. If they're nil the publisher's current settings are used.
+	//
+	// A publisher which doesn't implement Previewer is previewed by publishing
+	// from the instance the host initialized, so it can only be previewed with
+	// the settings it was initialized with; other settings are refused with
+	// ErrPreviewSettings. To preview a candidate configuration of such a
+	// publisher, start another instance of it and Init that with the settings.
+	Settings map[string]interface{} `json:"settings"`
+	// Limit is the most data points to return. If it's zero DefaultPreviewLimit
+	// is used, and it's never more than MaxPreviewLimit.
+	Limit int `json:"limit"`
+}
+
+// ErrPreviewSettings is returned by Preview when the publisher can only be
+// previewed with the settings it was initialized with, and the request's
+// settings are different.
+var ErrPreviewSettings = errors.New("handler doesn't implement Previewer, so it can only be previewed with the settings it was initialized with")
+
+type PreviewResponse struct {
+	Metadata   metadata.Metadata    `json:"metadata"`
+	Success    bool                 `json:"success"`
+	Message    string               `json:"message"`
+	DataPoints []pipeline.DataPoint `json:"dataPoints"`
+	// ValidationErrors lists the problems with the request's settings.
+	// If it's not empty the handler wasn't called.
+	ValidationErrors settings.ValidationErrors `json:"validationErrors,omitempty"`
+}
+
+const (
+	// DefaultPreviewLimit is the number of data points a PreviewRequest
+	// without a limit returns.
+	DefaultPreviewLimit = 10
+	// MaxPreviewLimit is the most data points a PreviewRequest can return.
+	MaxPreviewLimit = 1000
+)
+
+// Previewer is implemented by publishers which can return sample data points
+// without starting a publication. When a publisher doesn't implement it, the
+// wrapper previews a shape by publishing it into memory and stopping once it
+// has enough data points. The publisher isn't initialized for that, so it must
+// already have been, and a PreviewRequest with settings other than the ones it
+// was initialized with is refused.
+type Previewer interface {
+	Preview(request PreviewRequest) (PreviewResponse, error)
+}
+
+// ContextPreviewer is a Previewer which receives a context.
+// The wrapper prefers it over Previewer when a handler implements it.
+type ContextPreviewer interface {
+	Preview(ctx context.Context, request PreviewRequest) (PreviewResponse, error)
+}
+
+type GetPublishStatusRequest struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	SessionID string            `json:"sessionId"`
+}
+
+type GetPublishStatusResponse struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	Success   bool              `json:"success"`
+	Message   string            `json:"message"`
+	SessionID string            `json:"sessionId"`
+	// Running is true until the publisher calls Done.
+	Running bool `json:"running"`
+	// Status is how the publication ended. It's empty while Running is true.
+	Status   PublishStatus   `json:"status,omitempty"`
+	Progress PublishProgress `json:"progress"`
+}
+
+// PublishProgress describes how far through a publication a publisher is.
+type PublishProgress struct {
+	// Sent is the number of data points sent so far. If the publisher leaves
+	// it at zero the wrapper fills in the number it has forwarded.
+	Sent int64 `json:"sent"`
+	// EstimatedTotal is the number of data points the publisher expects to
+	// send in total, or zero if it doesn't know.
+	EstimatedTotal int64 `json:"estimatedTotal"`
+	// Position is a publisher-defined description of where it is in the
+	// source, such as a row number, file offset or timestamp.
+	Position string   `json:"position,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// PublishCanceler is implemented by publishers which want to be told when a
+// publication is cancelled. Publishers don't need to implement it: the wrapper
+// cancels the context passed to ContextDataPublisher.Publish and stops
+// forwarding data points either way.
+type PublishCanceler interface {
+	CancelPublish(request CancelPublishRequest) (CancelPublishResponse, error)
 }
 
 type DataPublisher interface {
@@ -45,23 +244,66 @@ type DataPublisher interface {
 	Publish(request PublishRequest, toClient PublisherClient) (PublishResponse, error)
 }
 
+// ContextDataPublisher is a DataPublisher which receives a context.
+// The wrapper prefers it over DataPublisher when a handler implements it.
+//
+// The context passed to Init and Dispose is cancelled when the call returns.
+// The context passed to Publish outlives the call and the connection it arrived
+// on: it is cancelled when the publication is cancelled or the server shuts
+// down, and the publisher should stop sending data points when that happens.
+type ContextDataPublisher interface {
+	Init(ctx context.Context, request InitRequest) (InitResponse, error)
+	Dispose(ctx context.Context, request DisposeRequest) (DisposeResponse, error)
+	Publish(ctx context.Context, request PublishRequest, toClient PublisherClient) (PublishResponse, error)
+}
+
 type PublishDataNotification struct {
 	DataPoints []pipeline.DataPoint `json:"data_points" mapstructure:"data_points"`
 }
 
 type InitRequest struct {
+	Metadata metadata.Metadata      `json:"metadata"`
 	Settings map[string]interface{} `json:"settings"`
 }
 
 type InitResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Metadata metadata.Metadata `json:"metadata"`
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
+	// ValidationErrors lists the problems with the request's settings.
+	// If it's not empty the handler wasn't called.
+	ValidationErrors settings.ValidationErrors `json:"validationErrors,omitempty"`
+}
+
+type SettingsSchemaRequest struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
+
+// SettingsSchemaResponse holds the schema of the settings of each operation
+// which takes them. A nil schema means the operation's settings aren't described
+// or validated. Previews are validated against the Init schema.
+type SettingsSchemaResponse struct {
+	Metadata       metadata.Metadata `json:"metadata"`
+	Init           *settings.Schema  `json:"init,omitempty"`
+	TestConnection *settings.Schema  `json:"testConnection,omitempty"`
+	DiscoverShapes *settings.Schema  `json:"discoverShapes,omitempty"`
+}
+
+// SettingsSchemaProvider is implemented by handlers which describe their settings.
+// The wrapper validates the settings of each request against the schema before
+// calling the handler, and responds with the validation errors instead of calling
+// it if there are any.
+type SettingsSchemaProvider interface {
+	SettingsSchema(request SettingsSchemaRequest) (SettingsSchemaResponse, error)
 }
 
-type DisposeRequest struct{}
+type DisposeRequest struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
 type DisposeResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Metadata metadata.Metadata `json:"metadata"`
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
 }
 
 // PublisherClient is the interface the publisher sends data points to.
@@ -70,14 +312,125 @@ type PublisherClient interface {
 	SendDataPoints(sendRequest SendDataPointsRequest) (SendDataPointsResponse, error)
 	// Done tells the client that the publisher is done sending data points for now.
 	Done(DoneRequest) (DoneResponse, error)
+	// ReportProgress tells the client how far through the publication the publisher is.
+	ReportProgress(ReportProgressRequest) (ReportProgressResponse, error)
+	// SendCheckpoint tells the client that every data point up to the checkpoint
+	// has been sent, so a later publication can resume from there.
+	SendCheckpoint(SendCheckpointRequest) (SendCheckpointResponse, error)
+	// Heartbeat tells the client that a long-lived publication is still alive.
+	// The wrapper sends heartbeats for PublishModeStream publications itself.
+	Heartbeat(HeartbeatRequest) (HeartbeatResponse, error)
+	// ShapeChanged tells the client that the definition of a shape changed
+	// during the publication, such as when a column is added to a table.
+	// Publishers should call it before sending data points of the new shape.
+	ShapeChanged(ShapeChangedRequest) (ShapeChangedResponse, error)
 }
 
 type SendDataPointsRequest struct {
+	Metadata   metadata.Metadata `json:"metadata"`
+	SessionID  string            `json:"sessionId"`
 	DataPoints []pipeline.DataPoint
+	// Sequence numbers the calls of a session, increasing by one for each
+	// call which succeeds. The wrapper fills it in if the publisher leaves
+	// it zero, so a call retried after a failure keeps its number and the
+	// client can recognise it if the first attempt had in fact arrived.
+	// The wrapper sends the calls of a session one at a time, in order.
+	Sequence int64 `json:"sequence,omitempty"`
 }
 
 type SendDataPointsResponse struct {
+	Metadata metadata.Metadata `json:"metadata"`
+	// Duplicate is true if the client had already received the call's
+	// data points, and so acknowledged them without delivering them again.
+	Duplicate bool `json:"duplicate,omitempty"`
 }
-type DoneRequest struct{}
 
-type DoneResponse struct{}
+type SendCheckpointRequest struct {
+	Metadata   metadata.Metadata `json:"metadata"`
+	SessionID  string            `json:"sessionId"`
+	Checkpoint Checkpoint        `json:"checkpoint"`
+}
+
+type SendCheckpointResponse struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
+
+type HeartbeatRequest struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	SessionID string            `json:"sessionId"`
+	Time      time.Time         `json:"time"`
+	// Checkpoint is the last checkpoint sent, if any.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+type HeartbeatResponse struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
+
+type ShapeChangedRequest struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	SessionID string            `json:"sessionId"`
+	// Shape is the new definition of the shape.
+	Shape pipeline.ShapeDefinition `json:"shape"`
+}
+
+type ShapeChangedResponse struct {
+	Metadata metadata.Metadata `json:"metadata"`
+	// Paused is true if the client has paused delivery of the publication's
+	// data points. SendDataPoints blocks until the client resumes it.
+	Paused bool `json:"paused"`
+}
+
+type ReportProgressRequest struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	SessionID string            `json:"sessionId"`
+	Progress  PublishProgress   `json:"progress"`
+}
+
+type ReportProgressResponse struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
+
+// PublishStatus describes how a publication ended.
+type PublishStatus string
+
+const (
+	// PublishCompleted means the publisher sent everything it meant to.
+	PublishCompleted PublishStatus = "completed"
+	// PublishCancelled means the publication was stopped by CancelPublish
+	// or because the host went away.
+	PublishCancelled PublishStatus = "cancelled"
+	// PublishFailed means the publisher gave up because of an error,
+	// which is described in DoneRequest.Error.
+	PublishFailed PublishStatus = "failed"
+)
+
+// Checkpoint marks a position in a shape's source from which
+// a later publication can resume.
+type Checkpoint struct {
+	ShapeName string `json:"shapeName"`
+	// Position is opaque to the host; only the publisher interprets it.
+	Position string `json:"position"`
+}
+
+// DoneRequest summarizes a publication.
+type DoneRequest struct {
+	Metadata  metadata.Metadata `json:"metadata"`
+	SessionID string            `json:"sessionId"`
+	// Status is filled in by the wrapper if the publisher leaves it empty.
+	Status PublishStatus `json:"status"`
+	// Error describes why the publication failed.
+	Error string `json:"error,omitempty"`
+	// Totals is the number of data points sent for each shape, keyed by
+	// the data points' Entity. The wrapper fills it in from the data points
+	// it has forwarded if the publisher leaves it empty.
+	Totals map[string]int64 `json:"totals,omitempty"`
+	// Checkpoint is where a later publication should resume from, if the
+	// publisher supports resuming. The wrapper fills it in with the last
+	// checkpoint sent if the publisher leaves it empty.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+type DoneResponse struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"time"
+
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/settings"
+)
+
+// Option configures a PublisherServer.
+type Option func(*options)
+
+type options struct {
+	logger          logging.Logger
+	cancelTimeout   time.Duration
+	previewTimeout  time.Duration
+	secretResolvers map[string]settings.SecretResolver
+}
+
+func defaultOptions() options {
+	return options{
+		logger:          logging.Default(),
+		cancelTimeout:   10 * time.Second,
+		previewTimeout:  30 * time.Second,
+		secretResolvers: settings.DefaultSecretResolvers(),
+	}
+}
+
+// WithLogger sets the logger used by the server and the wrappers it creates.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = logging.Nop()
+		}
+		o.logger = logger
+	}
+}
+
+// WithCancelTimeout sets how long a publisher has to call Done after its
+// publication is cancelled before the server sends Done on its behalf.
+func WithCancelTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.cancelTimeout = timeout
+	}
+}
+
+// WithPreviewTimeout sets how long a preview of a publisher which doesn't
+// implement Previewer waits for data points before returning what it has.
+// A deadline in the request's metadata is also respected.
+func WithPreviewTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.previewTimeout = timeout
+	}
+}
+
+// WithSecretResolvers sets the resolvers for the secret references in settings,
+// keyed by scheme, replacing settings.DefaultSecretResolvers. References are
+// resolved in the settings the handler's settings schema marks secret, before
+// the settings are validated and passed to the handler. Passing nil leaves
+// settings as they're sent.
+func WithSecretResolvers(resolvers map[string]settings.SecretResolver) Option {
+	return func(o *options) {
+		o.secretResolvers = resolvers
+	}
+}
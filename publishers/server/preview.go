@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/publishers/protocol"
+)
+
+// previewCollector is the PublisherClient given to a publisher when it's
+// previewed by publishing. It keeps the first limit data points in memory
+// and cancels the publication once it has them.
+type previewCollector struct {
+	limit  int
+	cancel context.CancelFunc
+
+	// done is closed when the publisher calls Done.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	mu         sync.Mutex
+	dataPoints []pipeline.DataPoint
+	doneReq    protocol.DoneRequest
+	// closed is set once the result has been taken.
+	closed bool
+}
+
+func (c *previewCollector) SendDataPoints(request protocol.SendDataPointsRequest) (resp protocol.SendDataPointsResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || len(c.dataPoints) >= c.limit {
+		return resp, ErrPublishCancelled
+	}
+
+	n := c.limit - len(c.dataPoints)
+	if n > len(request.DataPoints) {
+		n = len(request.DataPoints)
+	}
+	c.dataPoints = append(c.dataPoints, request.DataPoints[:n]...)
+	if len(c.dataPoints) >= c.limit {
+		c.cancel()
+	}
+	return
+}
+
+func (c *previewCollector) Done(request protocol.DoneRequest) (resp protocol.DoneResponse, err error) {
+	c.doneOnce.Do(func() {
+		c.mu.Lock()
+		c.doneReq = request
+		c.mu.Unlock()
+		close(c.done)
+	})
+	return
+}
+
+func (c *previewCollector) ReportProgress(request protocol.ReportProgressRequest) (resp protocol.ReportProgressResponse, err error) {
+	return
+}
+
+func (c *previewCollector) SendCheckpoint(request protocol.SendCheckpointRequest) (resp protocol.SendCheckpointResponse, err error) {
+	return
+}
+
+func (c *previewCollector) Heartbeat(request protocol.HeartbeatRequest) (resp protocol.HeartbeatResponse, err error) {
+	return
+}
+
+func (c *previewCollector) ShapeChanged(request protocol.ShapeChangedRequest) (resp protocol.ShapeChangedResponse, err error) {
+	return
+}
+
+// result returns the data points collected and the request the publisher
+// passed to Done, if it has called it. Data points sent after it's called
+// are refused.
+func (c *previewCollector) result() ([]pipeline.DataPoint, protocol.DoneRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return c.dataPoints, c.doneReq
+}
+
+// initState records the settings the handler was last initialized with.
+// It's shared by the connections to a server, like the handler.
+type initState struct {
+	mu       sync.Mutex
+	inited   bool
+	settings map[string]interface{}
+}
+
+func (s *initState) set(settings map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inited = true
+	s.settings = settings
+}
+
+func (s *initState) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inited = false
+	s.settings = nil
+}
+
+// current returns the settings the handler was initialized with,
+// and false if it isn't initialized.
+func (s *initState) current() (map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settings, s.inited
+}
+
+// previewByPublishing previews a shape for a publisher which doesn't implement
+// Previewer. The publisher is shared with the host's other calls, so it isn't
+// initialized or disposed for the preview: it must already have been
+// initialized, with the request's settings if it has any, or
+// protocol.ErrPreviewSettings is returned.
+func (w *wrapper) previewByPublishing(ctx context.Context, request protocol.PreviewRequest, logger logging.Logger) (protocol.PreviewResponse, error) {
+	switch w.publisher.(type) {
+	case protocol.ContextDataPublisher, protocol.DataPublisher, protocol.StreamPublisher:
+	default:
+		return protocol.PreviewResponse{
+			Success: false,
+			Message: "Handler doesn't implement Previewer or DataPublisher.",
+		}, nil
+	}
+
+	current, ok := w.inits.current()
+	if !ok {
+		return protocol.PreviewResponse{
+			Success: false,
+			Message: "Handler doesn't implement Previewer, and must be initialized before it's previewed.",
+		}, nil
+	}
+	if request.Settings != nil && !reflect.DeepEqual(request.Settings, current) {
+		return protocol.PreviewResponse{
+			Success: false,
+			Message: protocol.ErrPreviewSettings.Error(),
+		}, protocol.ErrPreviewSettings
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.opts.previewTimeout)
+	defer cancel()
+
+	collector := &previewCollector{
+		limit:  request.Limit,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	publishRequest := protocol.PublishRequest{
+		Metadata:  request.Metadata,
+		ShapeName: request.ShapeName,
+		SessionID: newSessionID(),
+		Limit:     int64(request.Limit),
+	}
+
+	var resp protocol.PublishResponse
+	var err error
+	switch s := w.publisher.(type) {
+	case protocol.ContextDataPublisher:
+		resp, err = s.Publish(ctx, publishRequest, collector)
+	case protocol.DataPublisher:
+		resp, err = s.Publish(publishRequest, collector)
+	case protocol.StreamPublisher:
+		publishRequest.Mode = protocol.PublishModeStream
+		go func() {
+			err := s.PublishStream(ctx, publishRequest, collector)
+			var done protocol.DoneRequest
+			if err != nil && ctx.Err() == nil {
+				done = protocol.DoneRequest{Status: protocol.PublishFailed, Error: err.Error()}
+			}
+			collector.Done(done)
+		}()
+		resp.Success = true
+	}
+	if err != nil || !resp.Success {
+		return protocol.PreviewResponse{
+			Success: false,
+			Message: resp.Message,
+		}, err
+	}
+
+	// The publisher isn't waited for once it's cancelled: the collector
+	// refuses anything it sends after that, and nothing depends on it stopping.
+	select {
+	case <-collector.done:
+	case <-ctx.Done():
+		if s, ok := w.publisher.(protocol.PublishCanceler); ok {
+			if _, err := s.CancelPublish(protocol.CancelPublishRequest{SessionID: publishRequest.SessionID}); err != nil {
+				logger.Warn("Publisher returned an error from CancelPublish", "error", err)
+			}
+		}
+	}
+
+	dataPoints, done := collector.result()
+	if done.Status == protocol.PublishFailed && len(dataPoints) == 0 {
+		return protocol.PreviewResponse{
+			Success: false,
+			Message: done.Error,
+		}, nil
+	}
+
+	return protocol.PreviewResponse{
+		Success:    true,
+		Message:    fmt.Sprintf("Previewed %d data points", len(dataPoints)),
+		DataPoints: dataPoints,
+	}, nil
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/publishers/protocol"
+)
+
+// ErrPublishCancelled is returned by PublisherClient.SendDataPoints once the
+// publication has been cancelled.
+var ErrPublishCancelled = errors.New("publish cancelled")
+
+// session is a publication started by a call to Publish.
+type session struct {
+	id        string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	transport *jsonrpcDataTransport
+	logger    logging.Logger
+
+	// done is closed once Done has been sent to the host.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// shapeName is the shape requested by the PublishRequest.
+	shapeName string
+
+	mu         sync.Mutex
+	sent       int64
+	totals     map[string]int64
+	progress   protocol.PublishProgress
+	status     protocol.PublishStatus
+	checkpoint *protocol.Checkpoint
+	// sequence is the highest Sequence reserved for a SendDataPoints call.
+	sequence int64
+
+	// sendMu is held while a SendDataPoints call is sent, so calls reach
+	// the host in the order they're numbered.
+	sendMu sync.Mutex
+}
+
+// reserveSequence reserves the next Sequence for a call to SendDataPoints.
+func (s *session) reserveSequence() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sequence++
+	return s.sequence
+}
+
+// releaseSequence gives back a Sequence reserved for a call which failed,
+// so the call keeps its number if it's retried. Only the last Sequence
+// reserved can be given back.
+func (s *session) releaseSequence(sequence int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sequence == s.sequence {
+		s.sequence--
+	}
+}
+
+// useSequence records that the publisher numbered a call sequence itself,
+// so the calls it leaves to the wrapper are numbered after it.
+func (s *session) useSequence(sequence int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sequence > s.sequence {
+		s.sequence = sequence
+	}
+}
+
+// setCheckpoint records the last checkpoint sent to the host.
+func (s *session) setCheckpoint(checkpoint protocol.Checkpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoint = &checkpoint
+}
+
+// lastCheckpoint returns the last checkpoint sent to the host, if any.
+func (s *session) lastCheckpoint() *protocol.Checkpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoint
+}
+
+// addSent records that dataPoints have been forwarded to the host.
+func (s *session) addSent(dataPoints []pipeline.DataPoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.totals == nil {
+		s.totals = make(map[string]int64)
+	}
+	for _, dp := range dataPoints {
+		shape := dp.Entity
+		if shape == "" {
+			shape = s.shapeName
+		}
+		s.totals[shape]++
+	}
+	s.sent += int64(len(dataPoints))
+}
+
+// currentTotals returns a copy of the number of data points forwarded for each shape.
+func (s *session) currentTotals() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := make(map[string]int64, len(s.totals))
+	for k, v := range s.totals {
+		totals[k] = v
+	}
+	return totals
+}
+
+// setProgress records the progress last reported by the publisher.
+func (s *session) setProgress(progress protocol.PublishProgress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress = progress
+}
+
+// currentProgress returns the last reported progress, with Sent filled in
+// from the wrapper's own count if the publisher didn't report it.
+func (s *session) currentProgress() protocol.PublishProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.progress
+	if p.Sent == 0 {
+		p.Sent = s.sent
+	}
+	return p
+}
+
+// finish records how the session ended.
+func (s *session) finish(status protocol.PublishStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// publishStatus returns the status of the session as reported by GetPublishStatus.
+func (s *session) publishStatus() protocol.GetPublishStatusResponse {
+	progress := s.currentProgress()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return protocol.GetPublishStatusResponse{
+		Success:   true,
+		SessionID: s.id,
+		Running:   s.status == "",
+		Status:    s.status,
+		Progress:  progress,
+	}
+}
+
+// maxFinishedSessions is the number of finished sessions whose
+// status is remembered for GetPublishStatus.
+const maxFinishedSessions = 100
+
+// sessions tracks the publications in progress across all the connections
+// to a server, so that a publication can be cancelled or queried from any of them.
+type sessions struct {
+	mu sync.Mutex
+	m  map[string]*session
+
+	// finished holds recently finished sessions, oldest first.
+	finished []*session
+}
+
+func newSessions() *sessions {
+	return &sessions{m: make(map[string]*session)}
+}
+
+// add registers a session, returning false if one with
+// the same ID is already running.
+func (ss *sessions) add(s *session) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.m[s.id]; ok {
+		return false
+	}
+	ss.m[s.id] = s
+	return true
+}
+
+func (ss *sessions) get(id string) (*session, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.m[id]
+	return s, ok
+}
+
+func (ss *sessions) remove(id string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.m, id)
+}
+
+// running returns the number of sessions in progress.
+func (ss *sessions) running() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.m)
+}
+
+// retire removes a session which has finished, remembering it for status queries.
+func (ss *sessions) retire(s *session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.m, s.id)
+	ss.finished = append(ss.finished, s)
+	if len(ss.finished) > maxFinishedSessions {
+		ss.finished = ss.finished[1:]
+	}
+}
+
+// lookup finds a session which is running or recently finished.
+func (ss *sessions) lookup(id string) (*session, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s, ok := ss.m[id]; ok {
+		return s, true
+	}
+	for i := len(ss.finished) - 1; i >= 0; i-- {
+		if ss.finished[i].id == id {
+			return ss.finished[i], true
+		}
+	}
+	return nil, false
+}
+
+// abandon ends a session whose publisher refused or failed to start it.
+// It closes the connection to the host, if one was made, without sending
+// Done, and releases anyone waiting for the session to finish.
+func (s *session) abandon() {
+	s.doneOnce.Do(func() {
+		if s.transport != nil {
+			s.transport.client.Close()
+		}
+		close(s.done)
+	})
+	s.cancel()
+}
+
+// watch sends Done with a cancelled status on the publisher's behalf if the
+// session's context is cancelled and the publisher doesn't call Done itself
+// within flushTimeout. It returns when Done has been sent.
+func (s *session) watch(flushTimeout time.Duration) {
+	<-s.ctx.Done()
+
+	select {
+	case <-s.done:
+		return
+	case <-time.After(flushTimeout):
+	}
+
+	s.logger.Warn("Publisher did not finish after cancellation, sending Done on its behalf")
+	_, err := s.transport.Done(protocol.DoneRequest{Status: protocol.PublishCancelled})
+	if err != nil {
+		s.logger.Warn("Could not send Done", "error", err)
+	}
+}
+
+// stream runs a PublishModeStream publication, sending Done when the
+// publisher returns. A publisher which returns without an error before
+// it's cancelled has nothing more to send, so the publication is completed.
+func (s *session) stream(publisher protocol.StreamPublisher, request protocol.PublishRequest) {
+	err := publisher.PublishStream(s.ctx, request, s.transport)
+
+	var done protocol.DoneRequest
+	if err != nil && s.ctx.Err() == nil {
+		done.Status = protocol.PublishFailed
+		done.Error = err.Error()
+	}
+
+	if _, err := s.transport.Done(done); err != nil {
+		s.logger.Warn("Could not send Done", "error", err)
+	}
+}
+
+// heartbeat sends a heartbeat to the host every interval until the session ends.
+func (s *session) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := s.transport.Heartbeat(protocol.HeartbeatRequest{})
+		if err != nil && err != ErrPublishCancelled && err != rpc.ErrShutdown {
+			s.logger.Warn("Could not send heartbeat", "error", err)
+		}
+	}
+}
@@ -1,21 +1,135 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"time"
 
-	"github.com/sirupsen/logrus"
-
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/metadata"
+	"github.com/naveego/navigator-go/publishers/filter"
 	"github.com/naveego/navigator-go/publishers/protocol"
+	"github.com/naveego/navigator-go/settings"
 )
 
 // wrapper adapts the protocol.* interfaces to the pattern required by net/rpc/jsonrpc.
 type wrapper struct {
 	publisher interface{}
+	logger    logging.Logger
+	// ctx is cancelled when the connection drops or the server is closed.
+	ctx context.Context
+	// serverCtx is cancelled only when the server is closed. Publications are
+	// derived from it, so they outlive the connection that started them.
+	serverCtx context.Context
+	sessions  *sessions
+	inits     *initState
+	opts      options
+	redactor  *settings.Redactor
+}
+
+// requestLogger returns a logger for a call to method carrying md.
+func (w *wrapper) requestLogger(method string, md metadata.Metadata) logging.Logger {
+	return w.logger.With(append([]interface{}{logging.FieldMethod, method}, md.LogFields()...)...)
+}
+
+// requestContext returns the context for a call carrying md.
+func (w *wrapper) requestContext(md metadata.Metadata) (context.Context, context.CancelFunc) {
+	return metadata.WithDeadline(w.ctx, md)
+}
+
+// prepareSettings resolves the secret references in the settings of a call to
+// method which the handler's settings schema marks secret, and validates the
+// result against the schema. The secrets it finds are redacted from the server's
+// logs and responses from then on. Without a schema the settings are passed on
+// as they are. It returns the settings to pass to the handler, or the problems
+// with them.
+func (w *wrapper) prepareSettings(method string, values map[string]interface{}, logger logging.Logger) (map[string]interface{}, settings.ValidationErrors) {
+	schema := w.settingsSchema(method, logger)
+	if schema == nil {
+		return values, nil
+	}
+
+	values, secrets, errs := settings.ResolveSecrets(schema, values, w.opts.secretResolvers)
+	w.redactor.Add(secrets...)
+	if len(errs) > 0 {
+		logger.Warn("Could not resolve secrets in settings", "error", errs)
+		return nil, errs
+	}
+
+	w.redactor.AddSettings(schema, values)
+
+	errs = schema.Validate(values)
+	if len(errs) > 0 {
+		logger.Warn("Invalid settings", "error", errs)
+		return nil, errs
+	}
+	return values, nil
+}
+
+// settingsSchema returns the handler's schema for the settings of a call
+// to method, or nil if it doesn't provide one.
+func (w *wrapper) settingsSchema(method string, logger logging.Logger) *settings.Schema {
+	p, ok := w.publisher.(protocol.SettingsSchemaProvider)
+	if !ok {
+		return nil
+	}
+
+	schemas, err := p.SettingsSchema(protocol.SettingsSchemaRequest{})
+	if err != nil {
+		logger.Warn("Could not get settings schema", "error", err)
+		return nil
+	}
+
+	switch method {
+	case "Init", "Preview":
+		return schemas.Init
+	case "TestConnection":
+		return schemas.TestConnection
+	case "DiscoverShapes":
+		return schemas.DiscoverShapes
+	}
+	return nil
+}
+
+func (w *wrapper) SettingsSchema(request protocol.SettingsSchemaRequest, response *protocol.SettingsSchemaResponse) (err error) {
+	logger := w.requestLogger("SettingsSchema", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling SettingsSchema")
+
+	if p, ok := w.publisher.(protocol.SettingsSchemaProvider); ok {
+		r, err := p.SettingsSchema(request)
+		*response = r
+		return err
+	}
+	return nil
 }
 
 func (w *wrapper) DiscoverShapes(request protocol.DiscoverShapesRequest, response *protocol.DiscoverShapesResponse) (err error) {
-	if s, ok := w.publisher.(protocol.ShapeDiscoverer); ok {
+	logger := w.requestLogger("DiscoverShapes", request.Metadata)
+	defer func() {
+		response.ValidationErrors = w.redactor.RedactErrors(response.ValidationErrors)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+	}()
+
+	logger.Debug("Calling DiscoverShapes")
+	var errs settings.ValidationErrors
+	if request.Settings, errs = w.prepareSettings("DiscoverShapes", request.Settings, logger); len(errs) > 0 {
+		*response = protocol.DiscoverShapesResponse{ValidationErrors: errs}
+		return nil
+	}
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.publisher.(type) {
+	case protocol.ContextShapeDiscoverer:
+		r, err := s.DiscoverShapes(ctx, request)
+		*response = r
+		return err
+	case protocol.ShapeDiscoverer:
 		r, err := s.DiscoverShapes(request)
 		*response = r
 		return err
@@ -24,7 +138,29 @@ func (w *wrapper) DiscoverShapes(request protocol.DiscoverShapesRequest, respons
 }
 
 func (w *wrapper) TestConnection(request protocol.TestConnectionRequest, response *protocol.TestConnectionResponse) (err error) {
-	if s, ok := w.publisher.(protocol.ConnectionTester); ok {
+	logger := w.requestLogger("TestConnection", request.Metadata)
+	defer func() {
+		response.Message = w.redactor.Redact(response.Message)
+		response.ValidationErrors = w.redactor.RedactErrors(response.ValidationErrors)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+	}()
+
+	logger.Debug("Calling TestConnection")
+	var errs settings.ValidationErrors
+	if request.Settings, errs = w.prepareSettings("TestConnection", request.Settings, logger); len(errs) > 0 {
+		*response = protocol.TestConnectionResponse{Success: false, Message: errs.Error(), ValidationErrors: errs}
+		return nil
+	}
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.publisher.(type) {
+	case protocol.ContextConnectionTester:
+		r, err := s.TestConnection(ctx, request)
+		*response = r
+		return err
+	case protocol.ConnectionTester:
 		r, err := s.TestConnection(request)
 		*response = r
 		return err
@@ -33,77 +169,441 @@ func (w *wrapper) TestConnection(request protocol.TestConnectionRequest, respons
 }
 
 func (w *wrapper) Init(request protocol.InitRequest, response *protocol.InitResponse) (err error) {
-	if s, ok := w.publisher.(protocol.DataPublisher); ok {
-		r, err := s.Init(request)
-		*response = r
-		return err
+	logger := w.requestLogger("Init", request.Metadata)
+	defer func() {
+		response.Message = w.redactor.Redact(response.Message)
+		response.ValidationErrors = w.redactor.RedactErrors(response.ValidationErrors)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+	}()
+
+	logger.Debug("Calling Init")
+	var errs settings.ValidationErrors
+	if request.Settings, errs = w.prepareSettings("Init", request.Settings, logger); len(errs) > 0 {
+		*response = protocol.InitResponse{Success: false, Message: errs.Error(), ValidationErrors: errs}
+		return nil
 	}
-	return nil
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.publisher.(type) {
+	case protocol.ContextDataPublisher:
+		*response, err = s.Init(ctx, request)
+	case protocol.DataPublisher:
+		*response, err = s.Init(request)
+	}
+
+	if err == nil && response.Success {
+		w.inits.set(request.Settings)
+	}
+	return err
 }
+
 func (w *wrapper) Dispose(request protocol.DisposeRequest, response *protocol.DisposeResponse) (err error) {
-	if s, ok := w.publisher.(protocol.DataPublisher); ok {
-		r, err := s.Dispose(request)
-		*response = r
-		return err
+	logger := w.requestLogger("Dispose", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling Dispose")
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.publisher.(type) {
+	case protocol.ContextDataPublisher:
+		*response, err = s.Dispose(ctx, request)
+	case protocol.DataPublisher:
+		*response, err = s.Dispose(request)
 	}
-	return nil
+
+	if err == nil && response.Success {
+		w.inits.clear()
+	}
+	return err
 }
 
 func (w *wrapper) Publish(request protocol.PublishRequest, response *protocol.PublishResponse) (err error) {
-	logrus.Info("Calling Publish")
+	if request.SessionID == "" {
+		request.SessionID = newSessionID()
+	}
+
+	logger := w.requestLogger("Publish", request.Metadata).With(logging.FieldSessionID, request.SessionID)
+	defer func() {
+		response.Message = w.redactor.Redact(response.Message)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+		response.SessionID = request.SessionID
+	}()
+
+	logger.Info("Calling Publish")
 	*response = protocol.PublishResponse{
 		Success: false,
 	}
 
-	if s, ok := w.publisher.(protocol.DataPublisher); ok {
-
-		// Here we create a JSON-RPC client that
-		// will take the datapoints produced by the
-		// publisher implementation and transport them
-		// back to the publication manager for dispatch
-		// to the pipeline.
+	switch request.Mode {
+	case "", protocol.PublishModeBatch:
+		switch w.publisher.(type) {
+		case protocol.ContextDataPublisher, protocol.DataPublisher:
+		default:
+			// We respond that we didn't start the publisher.
+			*response = protocol.PublishResponse{
+				Success: false,
+				Message: "Handler doesn't implement DataPublisher.",
+			}
+			return nil
+		}
+	case protocol.PublishModeStream:
+		if _, ok := w.publisher.(protocol.StreamPublisher); !ok {
+			*response = protocol.PublishResponse{
+				Success: false,
+				Message: "Handler doesn't implement StreamPublisher.",
+			}
+			return nil
+		}
+	default:
+		*response = protocol.PublishResponse{
+			Success: false,
+			Message: fmt.Sprintf("Unknown publish mode %q.", request.Mode),
+		}
+		return nil
+	}
 
-		logrus.Infof("PublishToAddress was %s", request.PublishToAddress)
-		conn, err := DefaultConnectionFactory(request.PublishToAddress)
-		if err != nil {
-			return err
+	// Catch a bad filter before the publisher starts, rather than
+	// leaving each publisher to report it in its own way.
+	if _, err := filter.New(request); err != nil {
+		*response = protocol.PublishResponse{
+			Success: false,
+			Message: err.Error(),
 		}
+		return nil
+	}
+
+	// The publication outlives this call and the connection it arrived on,
+	// so its context is only cancelled by CancelPublish, when the publisher
+	// calls Done or when the server is closed.
+	ctx, cancel := context.WithCancel(metadata.NewContext(w.serverCtx, request.Metadata))
 
-		// Now it's up to the publisher to go off and pump the datapoints.
-		client := jsonrpc.NewClient(conn)
+	sess := &session{
+		id:        request.SessionID,
+		shapeName: request.ShapeName,
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+		done:      make(chan struct{}),
+	}
 
-		transport := &jsonrpcDataTransport{
-			client: client,
+	// Reserve the session ID before dialing the host, so two
+	// requests with the same ID can't both start publishing.
+	if !w.sessions.add(sess) {
+		cancel()
+		*response = protocol.PublishResponse{
+			Success: false,
+			Message: fmt.Sprintf("Session %q is already publishing.", request.SessionID),
 		}
+		return nil
+	}
 
-		*response, err = s.Publish(request, transport)
+	// Here we create a JSON-RPC client that
+	// will take the datapoints produced by the
+	// publisher implementation and transport them
+	// back to the publication manager for dispatch
+	// to the pipeline.
 
-	} else {
+	logger.Info("Connecting to publish address", "publish_to_address", request.PublishToAddress)
+	conn, err := DefaultConnectionFactory(request.PublishToAddress)
+	if err != nil {
+		logger.Error("Could not connect to publish address", "publish_to_address", request.PublishToAddress, "error", err)
+		w.sessions.remove(sess.id)
+		sess.abandon()
+		return err
+	}
+
+	// Now it's up to the publisher to go off and pump the datapoints.
+	client := jsonrpc.NewClient(conn)
+
+	sess.transport = &jsonrpcDataTransport{
+		client:   client,
+		metadata: request.Metadata,
+		session:  sess,
+		sessions: w.sessions,
+	}
+
+	if request.Mode == protocol.PublishModeStream {
+		interval := time.Duration(request.HeartbeatIntervalMS) * time.Millisecond
+		if interval <= 0 {
+			interval = protocol.DefaultHeartbeatIntervalMS * time.Millisecond
+		}
+		go sess.watch(w.opts.cancelTimeout)
+		go sess.heartbeat(interval)
+		go sess.stream(w.publisher.(protocol.StreamPublisher), request)
 
-		// We respond that we started the publisher.
 		*response = protocol.PublishResponse{
+			Success: true,
+			Message: "Streaming",
+		}
+		return nil
+	}
+
+	switch s := w.publisher.(type) {
+	case protocol.ContextDataPublisher:
+		*response, err = s.Publish(ctx, request, sess.transport)
+	case protocol.DataPublisher:
+		*response, err = s.Publish(request, sess.transport)
+	}
+
+	if err != nil || !response.Success {
+		if response.Message == "" && err != nil {
+			response.Message = err.Error()
+		}
+		logger.Error("Publisher refused publication", "error", err, "message", response.Message)
+
+		// The publication never started, so the host isn't waiting for Done.
+		w.sessions.remove(sess.id)
+		sess.abandon()
+		return nil
+	}
+
+	// Only watch the session once the publisher has accepted it, so
+	// a refused publication doesn't get a Done sent on its behalf.
+	go sess.watch(w.opts.cancelTimeout)
+
+	return nil
+}
+
+func (w *wrapper) CancelPublish(request protocol.CancelPublishRequest, response *protocol.CancelPublishResponse) (err error) {
+	logger := w.requestLogger("CancelPublish", request.Metadata).With(logging.FieldSessionID, request.SessionID)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Info("Calling CancelPublish")
+
+	sess, ok := w.sessions.get(request.SessionID)
+	if !ok {
+		*response = protocol.CancelPublishResponse{
 			Success: false,
-			Message: "Handler doesn't implement DataPublisher.",
+			Message: fmt.Sprintf("No publication with session %q is in progress.", request.SessionID),
 		}
+		return nil
 	}
 
+	if s, ok := w.publisher.(protocol.PublishCanceler); ok {
+		_, err = s.CancelPublish(request)
+		if err != nil {
+			logger.Warn("Publisher returned an error from CancelPublish", "error", err)
+		}
+	}
+
+	sess.cancel()
+
+	// Wait for the publisher to flush and call Done, or for the
+	// session to give up on it and send Done itself.
+	<-sess.done
+
+	*response = protocol.CancelPublishResponse{
+		Success: true,
+		Message: "Cancelled",
+	}
 	return nil
 }
 
+func (w *wrapper) GetPublishStatus(request protocol.GetPublishStatusRequest, response *protocol.GetPublishStatusResponse) (err error) {
+	logger := w.requestLogger("GetPublishStatus", request.Metadata).With(logging.FieldSessionID, request.SessionID)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling GetPublishStatus")
+
+	sess, ok := w.sessions.lookup(request.SessionID)
+	if !ok {
+		*response = protocol.GetPublishStatusResponse{
+			Success:   false,
+			Message:   fmt.Sprintf("No publication with session %q is known.", request.SessionID),
+			SessionID: request.SessionID,
+		}
+		return nil
+	}
+
+	*response = sess.publishStatus()
+	return nil
+}
+
+func (w *wrapper) Preview(request protocol.PreviewRequest, response *protocol.PreviewResponse) (err error) {
+	logger := w.requestLogger("Preview", request.Metadata)
+	defer func() {
+		response.Message = w.redactor.Redact(response.Message)
+		response.ValidationErrors = w.redactor.RedactErrors(response.ValidationErrors)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+	}()
+
+	logger.Debug("Calling Preview")
+	if request.Settings != nil {
+		var errs settings.ValidationErrors
+		if request.Settings, errs = w.prepareSettings("Preview", request.Settings, logger); len(errs) > 0 {
+			*response = protocol.PreviewResponse{Success: false, Message: errs.Error(), ValidationErrors: errs}
+			return nil
+		}
+	}
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	if request.Limit <= 0 {
+		request.Limit = protocol.DefaultPreviewLimit
+	}
+	if request.Limit > protocol.MaxPreviewLimit {
+		request.Limit = protocol.MaxPreviewLimit
+	}
+
+	switch s := w.publisher.(type) {
+	case protocol.ContextPreviewer:
+		r, err := s.Preview(ctx, request)
+		*response = r
+		return err
+	case protocol.Previewer:
+		r, err := s.Preview(request)
+		*response = r
+		return err
+	}
+
+	r, err := w.previewByPublishing(ctx, request, logger)
+	*response = r
+	return err
+}
+
 type jsonrpcDataTransport struct {
 	client *rpc.Client
+	// metadata is the metadata of the PublishRequest which started the publication.
+	metadata metadata.Metadata
+	session  *session
+	sessions *sessions
 }
 
 func (dt *jsonrpcDataTransport) SendDataPoints(request protocol.SendDataPointsRequest) (resp protocol.SendDataPointsResponse, err error) {
+	if dt.session.ctx.Err() != nil {
+		return resp, ErrPublishCancelled
+	}
+
+	request.Metadata = metadata.Propagate(dt.metadata, request.Metadata)
+	request.SessionID = dt.session.id
+
+	dt.session.sendMu.Lock()
+	defer dt.session.sendMu.Unlock()
+
+	reserved := request.Sequence == 0
+	if reserved {
+		request.Sequence = dt.session.reserveSequence()
+	} else {
+		dt.session.useSequence(request.Sequence)
+	}
+
 	err = dt.client.Call("PublisherClient.SendDataPoints", request, &resp)
+	if err != nil {
+		if reserved {
+			dt.session.releaseSequence(request.Sequence)
+		}
+		return
+	}
+	if !resp.Duplicate {
+		dt.session.addSent(request.DataPoints)
+	}
+	return
+}
+
+func (dt *jsonrpcDataTransport) SendCheckpoint(request protocol.SendCheckpointRequest) (resp protocol.SendCheckpointResponse, err error) {
+	if dt.session.ctx.Err() != nil {
+		return resp, ErrPublishCancelled
+	}
+
+	if request.Checkpoint.ShapeName == "" {
+		request.Checkpoint.ShapeName = dt.session.shapeName
+	}
+
+	request.Metadata = metadata.Propagate(dt.metadata, request.Metadata)
+	request.SessionID = dt.session.id
+	err = dt.client.Call("PublisherClient.SendCheckpoint", request, &resp)
+	if err == nil {
+		dt.session.setCheckpoint(request.Checkpoint)
+	}
+	return
+}
+
+func (dt *jsonrpcDataTransport) ReportProgress(request protocol.ReportProgressRequest) (resp protocol.ReportProgressResponse, err error) {
+	if dt.session.ctx.Err() != nil {
+		return resp, ErrPublishCancelled
+	}
+
+	dt.session.setProgress(request.Progress)
+
+	request.Metadata = metadata.Propagate(dt.metadata, request.Metadata)
+	request.SessionID = dt.session.id
+	request.Progress = dt.session.currentProgress()
+	err = dt.client.Call("PublisherClient.ReportProgress", request, &resp)
 	return
 }
 
+func (dt *jsonrpcDataTransport) Heartbeat(request protocol.HeartbeatRequest) (resp protocol.HeartbeatResponse, err error) {
+	if dt.session.ctx.Err() != nil {
+		return resp, ErrPublishCancelled
+	}
+
+	if request.Time.IsZero() {
+		request.Time = time.Now().UTC()
+	}
+	if request.Checkpoint == nil {
+		request.Checkpoint = dt.session.lastCheckpoint()
+	}
+
+	request.Metadata = metadata.Propagate(dt.metadata, request.Metadata)
+	request.SessionID = dt.session.id
+	err = dt.client.Call("PublisherClient.Heartbeat", request, &resp)
+	return
+}
+
+func (dt *jsonrpcDataTransport) ShapeChanged(request protocol.ShapeChangedRequest) (resp protocol.ShapeChangedResponse, err error) {
+	if dt.session.ctx.Err() != nil {
+		return resp, ErrPublishCancelled
+	}
+
+	dt.session.logger.Info("Shape changed", "shape", request.Shape.Name)
+
+	request.Metadata = metadata.Propagate(dt.metadata, request.Metadata)
+	request.SessionID = dt.session.id
+	err = dt.client.Call("PublisherClient.ShapeChanged", request, &resp)
+	return
+}
+
+// Done tells the host the publication is over. Only the first call is sent;
+// later calls, including the one the session makes on the publisher's behalf
+// after a cancellation, return immediately.
 func (dt *jsonrpcDataTransport) Done(request protocol.DoneRequest) (resp protocol.DoneResponse, err error) {
 
-	err = dt.client.Call("PublisherClient.Done", request, &resp)
+	dt.session.doneOnce.Do(func() {
+		request.Metadata = metadata.Propagate(dt.metadata, request.Metadata)
+		request.SessionID = dt.session.id
+		if request.Status == "" {
+			request.Status = protocol.PublishCompleted
+			if dt.session.ctx.Err() != nil {
+				request.Status = protocol.PublishCancelled
+			}
+		}
+		if len(request.Totals) == 0 {
+			request.Totals = dt.session.currentTotals()
+		}
+		if request.Checkpoint == nil {
+			request.Checkpoint = dt.session.lastCheckpoint()
+		}
+
+		if request.Error != "" {
+			dt.session.logger.Warn("Publication done", "status", request.Status, "error", request.Error, "totals", request.Totals)
+		} else {
+			dt.session.logger.Info("Publication done", "status", request.Status, "totals", request.Totals)
+		}
+
+		err = dt.client.Call("PublisherClient.Done", request, &resp)
+
+		dt.client.Close()
 
-	dt.client.Close()
+		dt.session.finish(request.Status)
+		dt.sessions.retire(dt.session)
+		close(dt.session.done)
+		dt.session.cancel()
+	})
 
 	return
 }
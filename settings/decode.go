@@ -0,0 +1,280 @@
+package settings
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/naveego/navigator-go/internal/numeric"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// Decode decodes settings into out, which must be a pointer to a struct.
+//
+// Fields are matched to settings by their mapstructure tag, or by their name,
+// ignoring case, if they don't have one. Two more tags are understood:
+//
+//	Interval time.Duration `mapstructure:"interval" default:"30s"`
+//	Host     string        `mapstructure:"host" required:"true"`
+//
+// A default is used when a setting is missing or null, and is decoded as if it
+// had been sent as a string. A required setting without a default is reported
+// if it's missing or null.
+//
+// Values are converted the way a JSON decoder would not: numbers such as the
+// float64 values of decoded JSON are stored in integer fields as long as they're
+// whole and fit the field, strings such as "10" and "true" are parsed into
+// numeric and boolean fields, and time.Duration fields are parsed from strings
+// such as "1m30s". Durations must be strings: a bare number is reported rather
+// than guessed to be seconds or nanoseconds, as the "duration" format of a
+// Schema expects. Nested structs are decoded from nested objects.
+//
+// If any settings can't be decoded, Decode returns ValidationErrors
+// listing each of them, with the path to its field.
+func Decode(settings map[string]interface{}, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("settings: Decode needs a pointer to a struct, not %T", out)
+	}
+
+	d := validator{}
+	d.decodeStruct("", settings, v.Elem())
+	if len(d.errs) > 0 {
+		return d.errs
+	}
+	return nil
+}
+
+func (d *validator) decodeStruct(path string, values map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name, squash := fieldName(f)
+		if name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+
+		if squash && f.Type.Kind() == reflect.Struct {
+			d.decodeStruct(path, values, fv)
+			continue
+		}
+
+		fieldPath := join(path, name)
+		raw := lookup(values, name)
+
+		if raw == nil {
+			if def, ok := f.Tag.Lookup("default"); ok {
+				raw = def
+			} else if f.Tag.Get("required") == "true" {
+				d.errorf(fieldPath, "is required")
+				continue
+			} else {
+				// Nested structs may have defaults and required settings of their own.
+				if fv.Kind() == reflect.Struct && fv.Type() != timeType {
+					d.decodeStruct(fieldPath, map[string]interface{}{}, fv)
+				}
+				continue
+			}
+		}
+
+		d.decodeValue(fieldPath, raw, fv)
+	}
+}
+
+func (d *validator) decodeValue(path string, raw interface{}, fv reflect.Value) {
+	switch {
+	case fv.Type() == durationType:
+		s, ok := raw.(string)
+		dur, err := time.ParseDuration(s)
+		if !ok || err != nil {
+			d.errorf(path, "must be a duration such as \"1m30s\"")
+			return
+		}
+		fv.SetInt(int64(dur))
+		return
+
+	case fv.Kind() == reflect.Struct && fv.Type() != timeType:
+		values, ok := raw.(map[string]interface{})
+		if !ok {
+			d.errorf(path, "must be an object")
+			return
+		}
+		d.decodeStruct(path, values, fv)
+		return
+
+	case fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct && fv.Type().Elem() != timeType:
+		values, ok := raw.(map[string]interface{})
+		if !ok {
+			d.errorf(path, "must be an object")
+			return
+		}
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		d.decodeStruct(path, values, fv.Elem())
+		return
+	}
+
+	if !d.checkNumber(path, raw, fv.Type()) {
+		return
+	}
+	if list, ok := raw.([]interface{}); ok && (fv.Kind() == reflect.Slice || fv.Kind() == reflect.Array) {
+		ok := true
+		for i, item := range list {
+			ok = d.checkNumber(fmt.Sprintf("%s[%d]", path, i), item, fv.Type().Elem()) && ok
+		}
+		if !ok {
+			return
+		}
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           fv.Addr().Interface(),
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+		),
+	})
+	if err == nil {
+		err = decoder.Decode(raw)
+	}
+	if err != nil {
+		d.errorf(path, "must be %s", describe(fv.Type()))
+	}
+}
+
+// checkNumber reports whether raw, if it's a number, fits in a value of type t
+// without losing its fractional part, its sign or its magnitude, which the
+// weak conversion would otherwise drop silently. If it doesn't, the problem is
+// recorded against path. Strings are left for the decoder, which parses them
+// into the field's size.
+func (d *validator) checkNumber(path string, raw interface{}, t reflect.Type) bool {
+	if t == durationType || raw == nil {
+		return true
+	}
+
+	// Integers are checked exactly; everything else as a float64.
+	var (
+		i                      int64
+		u                      uint64
+		f                      float64
+		isInt, isUint, isFloat bool
+	)
+	switch rv := reflect.ValueOf(raw); rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, isInt = rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, isUint = rv.Uint(), true
+	default:
+		if f, isFloat = numeric.Float(raw); !isFloat {
+			return true
+		}
+	}
+
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if isFloat && f != math.Trunc(f) {
+			d.errorf(path, "must be a whole number")
+			return false
+		}
+		max := int64(^uint64(0) >> uint(65-t.Bits()))
+		if (isInt && v.OverflowInt(i)) ||
+			(isUint && u > uint64(max)) ||
+			(isFloat && (f < -math.Exp2(63) || f >= math.Exp2(63) || v.OverflowInt(int64(f)))) {
+			d.errorf(path, "must be between %d and %d", -max-1, max)
+			return false
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if isFloat && f != math.Trunc(f) {
+			d.errorf(path, "must be a whole number")
+			return false
+		}
+		if (isInt && i < 0) || (isFloat && f < 0) {
+			d.errorf(path, "must not be negative")
+			return false
+		}
+		if (isInt && v.OverflowUint(uint64(i))) ||
+			(isUint && v.OverflowUint(u)) ||
+			(isFloat && (f >= math.Exp2(64) || v.OverflowUint(uint64(f)))) {
+			d.errorf(path, "must be at most %d", ^uint64(0)>>uint(64-t.Bits()))
+			return false
+		}
+	case reflect.Float32:
+		if isFloat && v.OverflowFloat(f) {
+			d.errorf(path, "must be at most %g in magnitude", math.MaxFloat32)
+			return false
+		}
+	}
+	return true
+}
+
+// fieldName returns the name of the setting decoded into f,
+// and whether f is an embedded struct to be decoded in place.
+func fieldName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("mapstructure")
+	parts := strings.Split(tag, ",")
+	name := parts[0]
+	squash := false
+	for _, opt := range parts[1:] {
+		if opt == "squash" {
+			squash = true
+		}
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name, squash
+}
+
+// lookup returns the value of name in values, matching it without regard
+// to case if there's no exact match, as mapstructure does.
+func lookup(values map[string]interface{}, name string) interface{} {
+	if v, ok := values[name]; ok {
+		return v
+	}
+	for k, v := range values {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// describe returns a description of the values t holds, for error messages.
+func describe(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "a list of " + strings.TrimPrefix(strings.TrimPrefix(describe(t.Elem()), "a "), "an ") + " values"
+	case reflect.Map, reflect.Struct:
+		if t == timeType {
+			return "a time such as \"2006-01-02T15:04:05Z\""
+		}
+		return "an object"
+	case reflect.Ptr:
+		return describe(t.Elem())
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,135 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testConnection struct {
+	Host string `mapstructure:"host" required:"true"`
+	Port int    `mapstructure:"port" default:"5432"`
+}
+
+type testSettings struct {
+	Connection testConnection `mapstructure:"connection"`
+	Count      int            `mapstructure:"count" required:"true"`
+	Ratio      float64        `mapstructure:"ratio"`
+	Interval   time.Duration  `mapstructure:"interval" default:"30s"`
+	Verbose    bool           `mapstructure:"verbose"`
+	Tags       []string       `mapstructure:"tags"`
+	Name       string
+	Since      *time.Time `mapstructure:"since"`
+	Ignored    string     `mapstructure:"-"`
+}
+
+func TestDecode(t *testing.T) {
+
+	decode := func(s string) (testSettings, error) {
+		var values map[string]interface{}
+		So(json.Unmarshal([]byte(s), &values), ShouldBeNil)
+		var out testSettings
+		err := Decode(values, &out)
+		return out, err
+	}
+
+	Convey("Settings decoded from JSON should fill in the struct", t, func() {
+		out, err := decode(`{
+			"connection": {"host": "db", "port": 1433},
+			"count": 10, "ratio": 0.5, "interval": "1m30s", "verbose": true,
+			"tags": ["a", "b"], "NAME": "test", "since": "2018-01-02T03:04:05Z", "Ignored": "x"
+		}`)
+		So(err, ShouldBeNil)
+		So(out.Connection, ShouldResemble, testConnection{Host: "db", Port: 1433})
+		So(out.Count, ShouldEqual, 10)
+		So(out.Ratio, ShouldEqual, 0.5)
+		So(out.Interval, ShouldEqual, 90*time.Second)
+		So(out.Verbose, ShouldBeTrue)
+		So(out.Tags, ShouldResemble, []string{"a", "b"})
+		So(out.Name, ShouldEqual, "test")
+		So(out.Since.Equal(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)), ShouldBeTrue)
+		So(out.Ignored, ShouldBeEmpty)
+	})
+
+	Convey("Defaults should fill in missing and null settings", t, func() {
+		out, err := decode(`{"connection": {"host": "db"}, "count": 1, "interval": null}`)
+		So(err, ShouldBeNil)
+		So(out.Connection.Port, ShouldEqual, 5432)
+		So(out.Interval, ShouldEqual, 30*time.Second)
+	})
+
+	Convey("Strings should be weakly converted", t, func() {
+		out, err := decode(`{"connection": {"host": "db", "port": "1433"}, "count": "7", "verbose": "true"}`)
+		So(err, ShouldBeNil)
+		So(out.Connection.Port, ShouldEqual, 1433)
+		So(out.Count, ShouldEqual, 7)
+		So(out.Verbose, ShouldBeTrue)
+	})
+
+	Convey("Every problem should be reported with the path to its field", t, func() {
+		_, err := decode(`{"connection": {"port": "high"}, "count": 2.5, "ratio": "half", "interval": 30, "tags": "a"}`)
+		So(err, ShouldResemble, ValidationErrors{
+			{Field: "connection.host", Message: "is required"},
+			{Field: "connection.port", Message: "must be a whole number"},
+			{Field: "count", Message: "must be a whole number"},
+			{Field: "ratio", Message: "must be a number"},
+			{Field: "interval", Message: `must be a duration such as "1m30s"`},
+		})
+	})
+
+	Convey("Numbers which don't fit their field should be reported", t, func() {
+		var out struct {
+			Small  int8      `mapstructure:"small"`
+			Count  uint      `mapstructure:"count"`
+			Byte   uint8     `mapstructure:"byte"`
+			Whole  int32     `mapstructure:"whole"`
+			Ratio  float32   `mapstructure:"ratio"`
+			Levels []uint16  `mapstructure:"levels"`
+			Exact  int64     `mapstructure:"exact"`
+			Big    uint64    `mapstructure:"big"`
+			Ints   [2]int8   `mapstructure:"ints"`
+			Floats []float64 `mapstructure:"floats"`
+		}
+		var values map[string]interface{}
+		So(json.Unmarshal([]byte(`{
+			"small": 300, "count": -1, "byte": 256, "whole": 1.5, "ratio": 1e300,
+			"levels": [1, 70000, -2], "ints": [1, 2], "floats": [1.5]
+		}`), &values), ShouldBeNil)
+		values["exact"] = int64(math.MaxInt64)
+		values["big"] = uint64(math.MaxUint64)
+
+		So(Decode(values, &out), ShouldResemble, ValidationErrors{
+			{Field: "small", Message: "must be between -128 and 127"},
+			{Field: "count", Message: "must not be negative"},
+			{Field: "byte", Message: "must be at most 255"},
+			{Field: "whole", Message: "must be a whole number"},
+			{Field: "ratio", Message: fmt.Sprintf("must be at most %g in magnitude", math.MaxFloat32)},
+			{Field: "levels[1]", Message: "must be at most 65535"},
+			{Field: "levels[2]", Message: "must not be negative"},
+		})
+		So(out.Exact, ShouldEqual, int64(math.MaxInt64))
+		So(out.Big, ShouldEqual, uint64(math.MaxUint64))
+		So(out.Ints, ShouldResemble, [2]int8{1, 2})
+	})
+
+	Convey("Nested structs should be checked when they're missing", t, func() {
+		_, err := decode(`{"count": 1}`)
+		So(err, ShouldResemble, ValidationErrors{
+			{Field: "connection.host", Message: "is required"},
+		})
+		_, err = decode(`{"connection": "db", "count": 1}`)
+		So(err, ShouldResemble, ValidationErrors{
+			{Field: "connection", Message: "must be an object"},
+		})
+	})
+
+	Convey("Decode should need a pointer to a struct", t, func() {
+		var out testSettings
+		So(Decode(nil, out), ShouldNotBeNil)
+		So(Decode(nil, &out), ShouldNotBeNil)
+	})
+}
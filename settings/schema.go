@@ -0,0 +1,55 @@
+// Package settings describes and validates the settings plugins receive
+// in Init, TestConnection and DiscoverShapes requests.
+package settings
+
+// Schema is the subset of JSON Schema used to describe plugin settings.
+// It marshals to a JSON Schema document the host can use to render a form.
+//
+// A plugin's settings are described by a Schema of Type "object" whose
+// Properties are the individual settings.
+type Schema struct {
+	// Type is one of "object", "array", "string", "number", "integer" or "boolean".
+	// If it's empty any type is allowed.
+	Type        string `json:"type,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Format further constrains strings. The only format validated is
+	// "duration", a string accepted by time.ParseDuration; others are
+	// passed on to the host as hints.
+	Format  string      `json:"format,omitempty"`
+	Default interface{} `json:"default,omitempty"`
+	// Secret marks a setting, such as a password, which hosts should mask
+	// and the library redacts from its logs and error messages. Its value
+	// may be a reference to a secret such as "env:DB_PASS", which is only
+	// resolved in settings marked secret; see ResolveSecrets.
+	Secret bool          `json:"secret,omitempty"`
+	Enum   []interface{} `json:"enum,omitempty"`
+
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+	MinLength *int     `json:"minLength,omitempty"`
+	MaxLength *int     `json:"maxLength,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	// AdditionalProperties, if it's false, rejects properties not in Properties.
+	AdditionalProperties *bool `json:"additionalProperties,omitempty"`
+
+	Items *Schema `json:"items,omitempty"`
+}
+
+// Float64 returns a pointer to v, for setting Minimum and Maximum.
+func Float64(v float64) *float64 {
+	return &v
+}
+
+// Int returns a pointer to v, for setting MinLength and MaxLength.
+func Int(v int) *int {
+	return &v
+}
+
+// Bool returns a pointer to v, for setting AdditionalProperties.
+func Bool(v bool) *bool {
+	return &v
+}
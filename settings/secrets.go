@@ -0,0 +1,321 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in redacted settings and log lines.
+const Redacted = "[redacted]"
+
+// A SecretResolver returns the secret named by the part of a reference after its scheme,
+// such as "DB_PASS" in "env:DB_PASS".
+type SecretResolver func(name string) (string, error)
+
+// DefaultSecretResolvers returns the resolvers for the references understood by default:
+// "env:NAME", the value of an environment variable, and "file:PATH", the contents of a
+// file without its trailing newline. File URLs, which start with "file://", aren't references.
+func DefaultSecretResolvers() map[string]SecretResolver {
+	return map[string]SecretResolver{
+		"env":  envSecret,
+		"file": fileSecret,
+	}
+}
+
+func envSecret(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+func fileSecret(path string) (string, error) {
+	if strings.HasPrefix(path, "//") {
+		return "", errNotReference
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// errNotReference is returned by a SecretResolver for a value which
+// looks like a reference but isn't one, and should be left alone.
+var errNotReference = fmt.Errorf("not a secret reference")
+
+// ResolveSecrets returns a copy of values in which every setting the schema
+// marks secret whose value is a string of the form "scheme:name", where scheme
+// is a key of resolvers, has been replaced by the secret resolvers[scheme]
+// returns for name. The strings in a secret object or list are resolved too.
+// Other settings are left as they are, however they look, so without a schema
+// nothing is resolved. It also returns the secrets it resolved, so they can be
+// given to a Redactor, and the references it couldn't resolve.
+func ResolveSecrets(schema *Schema, values map[string]interface{}, resolvers map[string]SecretResolver) (map[string]interface{}, []string, ValidationErrors) {
+	if values == nil || schema == nil || len(resolvers) == 0 {
+		return values, nil, nil
+	}
+
+	r := secretResolver{resolvers: resolvers}
+	resolved := r.resolveSchema(schema, "", values).(map[string]interface{})
+	return resolved, r.secrets, r.errs
+}
+
+type secretResolver struct {
+	resolvers map[string]SecretResolver
+	secrets   []string
+	errs      ValidationErrors
+}
+
+// resolveSchema resolves the settings in value which s marks secret.
+func (r *secretResolver) resolveSchema(s *Schema, path string, value interface{}) interface{} {
+	if s == nil {
+		return value
+	}
+	if s.Secret {
+		return r.resolve(path, value)
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for _, k := range sortedKeys(value) {
+			out[k] = r.resolveSchema(s.Properties[k], join(path, k), value[k])
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, v := range value {
+			out[i] = r.resolveSchema(s.Items, fmt.Sprintf("%s[%d]", path, i), v)
+		}
+		return out
+	}
+	return value
+}
+
+// resolve resolves every reference in value.
+func (r *secretResolver) resolve(path string, value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for _, k := range sortedKeys(value) {
+			out[k] = r.resolve(join(path, k), value[k])
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, v := range value {
+			out[i] = r.resolve(fmt.Sprintf("%s[%d]", path, i), v)
+		}
+		return out
+	case string:
+		i := strings.Index(value, ":")
+		if i <= 0 {
+			return value
+		}
+		resolver, ok := r.resolvers[value[:i]]
+		if !ok {
+			return value
+		}
+		secret, err := resolver(value[i+1:])
+		if err == errNotReference {
+			return value
+		}
+		if err != nil {
+			r.errs = append(r.errs, ValidationError{
+				Field:   path,
+				Message: fmt.Sprintf("could not resolve %s: %s", value, err),
+			})
+			return value
+		}
+		r.secrets = append(r.secrets, secret)
+		return secret
+	}
+	return value
+}
+
+// Redact returns a copy of values in which the settings the schema marks
+// secret have been replaced by Redacted.
+func (s *Schema) Redact(values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	return redact(s, values).(map[string]interface{})
+}
+
+func redact(s *Schema, value interface{}) interface{} {
+	if s == nil {
+		return value
+	}
+	if s.Secret && value != nil {
+		return Redacted
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			out[k] = redact(s.Properties[k], v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, v := range value {
+			out[i] = redact(s.Items, v)
+		}
+		return out
+	}
+	return value
+}
+
+// secrets returns the string values of the settings the schema marks secret.
+func (s *Schema) secrets(value interface{}) []string {
+	if s == nil {
+		return nil
+	}
+	switch value := value.(type) {
+	case string:
+		if s.Secret {
+			return []string{value}
+		}
+	case map[string]interface{}:
+		var out []string
+		for k, v := range value {
+			out = append(out, s.Properties[k].secrets(v)...)
+		}
+		return out
+	case []interface{}:
+		var out []string
+		for _, v := range value {
+			out = append(out, s.Items.secrets(v)...)
+		}
+		return out
+	}
+	return nil
+}
+
+// minRedactedLength is the length below which secrets aren't redacted
+// from text, where they'd be found inside unrelated words and numbers.
+const minRedactedLength = 4
+
+// maxRedactedSecrets is the number of secrets a Redactor remembers.
+const maxRedactedSecrets = 1000
+
+// A Redactor removes known secrets from text before it's logged or returned
+// in an error. It remembers a limited number of secrets, forgetting the one
+// added least recently when it's full. It's safe for concurrent use.
+type Redactor struct {
+	max int
+
+	mu sync.RWMutex
+	// secrets holds the secrets, least recently added first.
+	secrets  []string
+	replacer *strings.Replacer
+}
+
+func NewRedactor() *Redactor {
+	return &Redactor{max: maxRedactedSecrets}
+}
+
+// Add adds secrets to those the Redactor removes. Secrets shorter
+// than four characters are ignored.
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for _, secret := range secrets {
+		if len(secret) < minRedactedLength {
+			continue
+		}
+		if i := indexOf(r.secrets, secret); i >= 0 {
+			if i == len(r.secrets)-1 {
+				continue
+			}
+			r.secrets = append(r.secrets[:i], r.secrets[i+1:]...)
+		}
+		r.secrets = append(r.secrets, secret)
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if r.max > 0 && len(r.secrets) > r.max {
+		r.secrets = append([]string(nil), r.secrets[len(r.secrets)-r.max:]...)
+	}
+
+	// Longer secrets go first, so a secret containing another is removed whole.
+	all := append([]string(nil), r.secrets...)
+	sort.Slice(all, func(i, j int) bool { return len(all[i]) > len(all[j]) })
+
+	pairs := make([]string, 0, 2*len(all))
+	for _, secret := range all {
+		pairs = append(pairs, secret, Redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// AddSettings adds the values of the settings schema marks secret.
+func (r *Redactor) AddSettings(schema *Schema, values map[string]interface{}) {
+	r.Add(schema.secrets(values)...)
+}
+
+// Redact returns s with every secret the Redactor knows replaced by Redacted.
+func (r *Redactor) Redact(s string) string {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+// RedactErrors returns a copy of errs with the secrets the Redactor knows
+// removed from their messages.
+func (r *Redactor) RedactErrors(errs ValidationErrors) ValidationErrors {
+	if errs == nil {
+		return nil
+	}
+	out := make(ValidationErrors, len(errs))
+	for i, err := range errs {
+		out[i] = ValidationError{Field: err.Field, Message: r.Redact(err.Message)}
+	}
+	return out
+}
+
+// RedactError returns err, or an error with the same message without the
+// secrets the Redactor knows if it contains any.
+func (r *Redactor) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if redacted := r.Redact(msg); redacted != msg {
+		return errors.New(redacted)
+	}
+	return err
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func indexOf(ss []string, s string) int {
+	for i := range ss {
+		if ss[i] == s {
+			return i
+		}
+	}
+	return -1
+}
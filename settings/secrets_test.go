@@ -0,0 +1,139 @@
+package settings
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResolveSecrets(t *testing.T) {
+
+	Convey("Given a secret in the environment and in a file", t, func() {
+		os.Setenv("SETTINGS_TEST_PASSWORD", "hunter22")
+		defer os.Unsetenv("SETTINGS_TEST_PASSWORD")
+
+		dir, err := ioutil.TempDir("", "settings")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "token")
+		So(ioutil.WriteFile(path, []byte("s3cr3t-token\n"), 0600), ShouldBeNil)
+
+		schema := &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"password": {Type: "string", Secret: true},
+				"auth":     {Type: "object", Secret: true},
+				"hosts":    {Type: "array", Items: &Schema{Type: "string", Secret: true}},
+				"source":   {Type: "string", Secret: true},
+				"note":     {Type: "string", Secret: true},
+				"user":     {Type: "string"},
+			},
+		}
+		values := map[string]interface{}{
+			"password": "env:SETTINGS_TEST_PASSWORD",
+			"auth":     map[string]interface{}{"token": "file:" + path},
+			"hosts":    []interface{}{"a", "env:SETTINGS_TEST_PASSWORD"},
+			"source":   "file:///data/in.json",
+			"note":     "unknown:scheme",
+			"count":    3.0,
+			"user":     "env:SETTINGS_TEST_PASSWORD",
+		}
+
+		resolved, secrets, errs := ResolveSecrets(schema, values, DefaultSecretResolvers())
+
+		Convey("references should be replaced by their secrets", func() {
+			So(errs, ShouldBeNil)
+			So(resolved, ShouldResemble, map[string]interface{}{
+				"password": "hunter22",
+				"auth":     map[string]interface{}{"token": "s3cr3t-token"},
+				"hosts":    []interface{}{"a", "hunter22"},
+				"source":   "file:///data/in.json",
+				"note":     "unknown:scheme",
+				"count":    3.0,
+				"user":     "env:SETTINGS_TEST_PASSWORD",
+			})
+			So(secrets, ShouldContain, "hunter22")
+			So(secrets, ShouldContain, "s3cr3t-token")
+		})
+
+		Convey("nothing should be resolved without a schema", func() {
+			resolved, secrets, errs := ResolveSecrets(nil, values, DefaultSecretResolvers())
+			So(errs, ShouldBeNil)
+			So(secrets, ShouldBeEmpty)
+			So(resolved["password"], ShouldEqual, "env:SETTINGS_TEST_PASSWORD")
+		})
+
+		Convey("the settings passed in should not change", func() {
+			So(values["password"], ShouldEqual, "env:SETTINGS_TEST_PASSWORD")
+		})
+
+		Convey("references which can't be resolved should be reported", func() {
+			schema := &Schema{Properties: map[string]*Schema{
+				"db": {Properties: map[string]*Schema{"password": {Secret: true}}},
+			}}
+			_, _, errs := ResolveSecrets(schema, map[string]interface{}{
+				"db": map[string]interface{}{"password": "env:SETTINGS_TEST_MISSING"},
+			}, DefaultSecretResolvers())
+			So(errs, ShouldResemble, ValidationErrors{{
+				Field:   "db.password",
+				Message: "could not resolve env:SETTINGS_TEST_MISSING: environment variable SETTINGS_TEST_MISSING is not set",
+			}})
+		})
+	})
+}
+
+func TestRedaction(t *testing.T) {
+
+	schema := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"user":     {Type: "string"},
+			"password": {Type: "string", Secret: true},
+			"keys": {
+				Type:  "array",
+				Items: &Schema{Type: "string", Secret: true},
+			},
+		},
+	}
+	values := map[string]interface{}{
+		"user":     "sa",
+		"password": "hunter22",
+		"keys":     []interface{}{"key-one", "key-two"},
+	}
+
+	Convey("Schema.Redact should replace secret settings", t, func() {
+		So(schema.Redact(values), ShouldResemble, map[string]interface{}{
+			"user":     "sa",
+			"password": Redacted,
+			"keys":     []interface{}{Redacted, Redacted},
+		})
+		So(values["password"], ShouldEqual, "hunter22")
+	})
+
+	Convey("A Redactor should remove the secrets it knows from text", t, func() {
+		r := NewRedactor()
+		So(r.Redact("login failed for sa:hunter22"), ShouldEqual, "login failed for sa:hunter22")
+
+		r.AddSettings(schema, values)
+		r.Add("abc", "hunter2")
+		So(r.Redact("login failed for sa:hunter22 with key-two"), ShouldEqual, "login failed for sa:[redacted] with [redacted]")
+		So(r.Redact("abc hunter2"), ShouldEqual, "abc [redacted]")
+
+		So(r.RedactErrors(ValidationErrors{{Field: "password", Message: "hunter22 is too short"}}), ShouldResemble,
+			ValidationErrors{{Field: "password", Message: "[redacted] is too short"}})
+		So(r.RedactError(errors.New("bad key-one")).Error(), ShouldEqual, "bad [redacted]")
+	})
+
+	Convey("A Redactor should forget the secrets added least recently when it's full", t, func() {
+		r := NewRedactor()
+		r.max = 2
+		r.Add("secret-one", "secret-two")
+		r.Add("secret-one")
+		r.Add("secret-three")
+		So(r.Redact("secret-one secret-two secret-three"), ShouldEqual, "[redacted] secret-two [redacted]")
+	})
+}
@@ -0,0 +1,217 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/naveego/navigator-go/internal/numeric"
+)
+
+// ValidationError describes a setting which doesn't satisfy its schema.
+type ValidationError struct {
+	// Field is the path to the setting, such as "connection.hosts[1]".
+	// It's empty if the settings as a whole are invalid.
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors lists every problem found with a set of settings.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid settings: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks settings against the schema, returning every problem
+// it finds, or nil if there are none. Nil settings are treated as empty,
+// and a setting whose value is null is treated as missing.
+func (s *Schema) Validate(settings map[string]interface{}) ValidationErrors {
+	if s == nil {
+		return nil
+	}
+
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+
+	v := validator{}
+	v.validate("", settings, s)
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) errorf(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) validate(field string, value interface{}, s *Schema) {
+	if !v.validateType(field, value, s.Type) {
+		return
+	}
+
+	if len(s.Enum) > 0 && !inEnum(value, s.Enum) {
+		v.errorf(field, "must be one of %s", formatEnum(s.Enum))
+	}
+
+	switch value := value.(type) {
+	case string:
+		v.validateString(field, value, s)
+	case map[string]interface{}:
+		v.validateObject(field, value, s)
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				v.validate(fmt.Sprintf("%s[%d]", field, i), item, s.Items)
+			}
+		}
+	default:
+		if f, ok := numeric.Float(value); ok {
+			if s.Minimum != nil && f < *s.Minimum {
+				v.errorf(field, "must be at least %v", *s.Minimum)
+			}
+			if s.Maximum != nil && f > *s.Maximum {
+				v.errorf(field, "must be at most %v", *s.Maximum)
+			}
+		}
+	}
+}
+
+// validateType reports whether value is of the type named by typ,
+// recording an error if it isn't.
+func (v *validator) validateType(field string, value interface{}, typ string) bool {
+	ok := true
+	switch typ {
+	case "":
+	case "object":
+		_, ok = value.(map[string]interface{})
+	case "array":
+		_, ok = value.([]interface{})
+	case "string":
+		_, ok = value.(string)
+	case "boolean":
+		_, ok = value.(bool)
+	case "number":
+		_, ok = numeric.Float(value)
+	case "integer":
+		var f float64
+		f, ok = numeric.Float(value)
+		if ok && f != math.Trunc(f) {
+			v.errorf(field, "must be a whole number")
+			return false
+		}
+	default:
+		v.errorf(field, "has unknown type %q in its schema", typ)
+		return false
+	}
+
+	if !ok {
+		article := "a"
+		if typ == "object" || typ == "array" || typ == "integer" {
+			article = "an"
+		}
+		v.errorf(field, "must be %s %s", article, typ)
+	}
+	return ok
+}
+
+func (v *validator) validateString(field string, value string, s *Schema) {
+	if s.MinLength != nil && len(value) < *s.MinLength {
+		v.errorf(field, "must be at least %d characters", *s.MinLength)
+	}
+	if s.MaxLength != nil && len(value) > *s.MaxLength {
+		v.errorf(field, "must be at most %d characters", *s.MaxLength)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			v.errorf(field, "has an invalid pattern in its schema: %s", err)
+		} else if !re.MatchString(value) {
+			v.errorf(field, "must match %s", s.Pattern)
+		}
+	}
+	if s.Format == "duration" {
+		if _, err := time.ParseDuration(value); err != nil {
+			v.errorf(field, "must be a duration such as \"1m30s\"")
+		}
+	}
+}
+
+func (v *validator) validateObject(field string, value map[string]interface{}, s *Schema) {
+	for _, name := range s.Required {
+		if value[name] == nil {
+			v.errorf(join(field, name), "is required")
+		}
+	}
+
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := value[name]
+		if child == nil {
+			continue
+		}
+		ps, ok := s.Properties[name]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				v.errorf(join(field, name), "is not a known setting")
+			}
+			continue
+		}
+		v.validate(join(field, name), child, ps)
+	}
+}
+
+func join(field, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	f, isNumber := numeric.Float(value)
+	for _, e := range enum {
+		if isNumber {
+			if ef, ok := numeric.Float(e); ok && ef == f {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(value, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEnum(enum []interface{}) string {
+	b, _ := json.Marshal(enum)
+	return string(b)
+}
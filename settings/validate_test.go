@@ -0,0 +1,95 @@
+package settings
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchema_Validate(t *testing.T) {
+
+	schema := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"host":     {Type: "string", MinLength: Int(1)},
+			"port":     {Type: "integer", Minimum: Float64(1), Maximum: Float64(65535)},
+			"mode":     {Type: "string", Enum: []interface{}{"fast", "safe"}},
+			"interval": {Type: "string", Format: "duration"},
+			"code":     {Type: "string", Pattern: "^[A-Z]{3}$"},
+			"ratio":    {Type: "number"},
+			"tls":      {Type: "boolean"},
+			"tags": {
+				Type:  "array",
+				Items: &Schema{Type: "string", MaxLength: Int(3)},
+			},
+			"auth": {
+				Type: "object",
+				Properties: map[string]*Schema{
+					"user": {Type: "string"},
+				},
+				Required: []string{"user"},
+			},
+		},
+		Required:             []string{"host", "port"},
+		AdditionalProperties: Bool(false),
+	}
+
+	validate := func(s string) ValidationErrors {
+		var values map[string]interface{}
+		So(json.Unmarshal([]byte(s), &values), ShouldBeNil)
+		return schema.Validate(values)
+	}
+
+	Convey("Valid settings should have no errors", t, func() {
+		errs := validate(`{
+			"host": "localhost", "port": 5432, "mode": "safe", "interval": "1m30s",
+			"code": "ABC", "ratio": 0.5, "tls": true, "tags": ["a", "bc"], "auth": {"user": "sa"}
+		}`)
+		So(errs, ShouldBeNil)
+	})
+
+	Convey("Every problem should be reported with the path to its field", t, func() {
+		errs := validate(`{
+			"host": "", "port": 5432.5, "mode": "slow", "interval": "soon",
+			"code": "abc", "ratio": "half", "tls": "yes", "tags": ["a", 1, "long"],
+			"auth": {}, "extra": 1
+		}`)
+		So(errs, ShouldResemble, ValidationErrors{
+			{Field: "auth.user", Message: "is required"},
+			{Field: "code", Message: "must match ^[A-Z]{3}$"},
+			{Field: "extra", Message: "is not a known setting"},
+			{Field: "host", Message: "must be at least 1 characters"},
+			{Field: "interval", Message: `must be a duration such as "1m30s"`},
+			{Field: "mode", Message: `must be one of ["fast","safe"]`},
+			{Field: "port", Message: "must be a whole number"},
+			{Field: "ratio", Message: "must be a number"},
+			{Field: "tags[1]", Message: "must be a string"},
+			{Field: "tags[2]", Message: "must be at most 3 characters"},
+			{Field: "tls", Message: "must be a boolean"},
+		})
+	})
+
+	Convey("Missing and null settings should be required", t, func() {
+		errs := validate(`{"host": null}`)
+		So(errs, ShouldResemble, ValidationErrors{
+			{Field: "host", Message: "is required"},
+			{Field: "port", Message: "is required"},
+		})
+		So(errs.Error(), ShouldEqual, "invalid settings: host: is required; port: is required")
+	})
+
+	Convey("Numbers should be range checked", t, func() {
+		So(validate(`{"host": "h", "port": 0}`), ShouldResemble, ValidationErrors{
+			{Field: "port", Message: "must be at least 1"},
+		})
+		So(schema.Validate(map[string]interface{}{"host": "h", "port": 70000}), ShouldResemble, ValidationErrors{
+			{Field: "port", Message: "must be at most 65535"},
+		})
+	})
+
+	Convey("A nil schema should accept anything", t, func() {
+		var s *Schema
+		So(s.Validate(map[string]interface{}{"anything": 1}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,167 @@
+package shapes
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/naveego/navigator-go/internal/numeric"
+)
+
+// Types lists the property types Convert and Validate understand. The types
+// "float", "int", "bool" and "date" are accepted as synonyms of "number",
+// "integer", "boolean" and "datetime".
+var Types = []string{"string", "number", "integer", "boolean", "datetime", "object", "array"}
+
+// normalizeType returns the canonical name of the property type typ,
+// or "" if it isn't one of Types.
+func normalizeType(typ string) string {
+	switch t := strings.ToLower(typ); t {
+	case "string", "number", "integer", "boolean", "datetime", "object", "array":
+		return t
+	case "float":
+		return "number"
+	case "int":
+		return "integer"
+	case "bool":
+		return "boolean"
+	case "date":
+		return "datetime"
+	}
+	return ""
+}
+
+// KnownType reports whether typ is one of Types or their synonyms.
+func KnownType(typ string) bool {
+	return normalizeType(typ) != ""
+}
+
+// Convert converts v to the property type typ. Strings are parsed into
+// numbers, booleans and times, and other values are formatted as strings.
+// Nil is converted to nil, and values of a type Convert doesn't know are
+// returned as they are.
+func Convert(typ string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch normalizeType(typ) {
+	case "string":
+		return toString(v)
+	case "number":
+		return toNumber(v)
+	case "integer":
+		return toInteger(v)
+	case "boolean":
+		return toBoolean(v)
+	case "datetime":
+		return toDateTime(v)
+	case "object":
+		if _, ok := v.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("can't convert %T to an object", v)
+		}
+	case "array":
+		if _, ok := v.([]interface{}); !ok {
+			return nil, fmt.Errorf("can't convert %T to an array", v)
+		}
+	}
+	return v, nil
+}
+
+func toString(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	return fmt.Sprint(v), nil
+}
+
+func toNumber(v interface{}) (interface{}, error) {
+	if f, ok := numeric.Float(v); ok {
+		return f, nil
+	}
+	switch v := v.(type) {
+	case json.Number:
+		return nil, fmt.Errorf("%q is not a number", v)
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	case bool:
+		if v {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	}
+	return nil, fmt.Errorf("can't convert %T to a number", v)
+}
+
+func toInteger(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	}
+	f, err := toNumber(v)
+	if err != nil {
+		return nil, err
+	}
+	n := f.(float64)
+	if n != math.Trunc(n) || math.IsInf(n, 0) {
+		return nil, fmt.Errorf("%v is not a whole number", v)
+	}
+	return int64(n), nil
+}
+
+func toBoolean(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+		return b, nil
+	}
+	if f, err := toNumber(v); err == nil {
+		return f.(float64) != 0, nil
+	}
+	return nil, fmt.Errorf("can't convert %T to a boolean", v)
+}
+
+// dateTimeLayouts are the layouts tried when converting a string to a time.
+var dateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func toDateTime(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range dateTimeLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a date or time", v)
+	}
+	return nil, fmt.Errorf("can't convert %T to a date or time", v)
+}
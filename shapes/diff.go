@@ -0,0 +1,246 @@
+package shapes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/naveego/api/types/pipeline"
+)
+
+// Compatibility classifies a change to a shape by who it's safe for.
+type Compatibility string
+
+const (
+	// Full changes are safe for every reader.
+	Full Compatibility = "full"
+	// Backward changes are safe for readers using the new shape to read data
+	// of the old shape, but not for readers of the old shape.
+	Backward Compatibility = "backward"
+	// Forward changes are safe for readers using the old shape, such as
+	// subscribers initialized with mappings for it, to read data of the new
+	// shape, but not for readers of the new shape reading old data.
+	Forward Compatibility = "forward"
+	// Breaking changes are safe for neither.
+	Breaking Compatibility = "breaking"
+)
+
+// combine returns the compatibility of a set of changes of compatibility a and b.
+func combine(a, b Compatibility) Compatibility {
+	switch {
+	case a == b || b == Full:
+		return a
+	case a == Full:
+		return b
+	}
+	return Breaking
+}
+
+// ChangeKind is the kind of a Change.
+type ChangeKind string
+
+const (
+	ShapeAdded      ChangeKind = "shape added"
+	ShapeRemoved    ChangeKind = "shape removed"
+	KeysChanged     ChangeKind = "keys changed"
+	PropertyAdded   ChangeKind = "property added"
+	PropertyRemoved ChangeKind = "property removed"
+	PropertyRetyped ChangeKind = "property retyped"
+)
+
+// Change describes a difference between two versions of a shape.
+type Change struct {
+	Kind  ChangeKind `json:"kind"`
+	Shape string     `json:"shape"`
+	// Property is the name of the property which changed,
+	// if the change is to a property.
+	Property string `json:"property,omitempty"`
+	// From and To are the old and new types of a retyped property, or the
+	// old and new keys of a shape, joined with commas.
+	From          string        `json:"from,omitempty"`
+	To            string        `json:"to,omitempty"`
+	Compatibility Compatibility `json:"compatibility"`
+}
+
+func (c Change) String() string {
+	s := c.Shape
+	if c.Property != "" {
+		s += "." + c.Property
+	}
+	s += ": " + string(c.Kind)
+	if c.From != "" || c.To != "" {
+		s += fmt.Sprintf(" from %q to %q", c.From, c.To)
+	}
+	return s + " (" + string(c.Compatibility) + ")"
+}
+
+// Changes lists the differences between two sets of shapes.
+type Changes []Change
+
+// Compatibility returns the compatibility of the changes taken together,
+// which is Full if there are none.
+func (c Changes) Compatibility() Compatibility {
+	compat := Full
+	for _, change := range c {
+		compat = combine(compat, change.Compatibility)
+	}
+	return compat
+}
+
+// Affecting returns the changes to the shapes and properties mappings map from.
+// These are the changes a subscriber initialized with mappings would notice.
+func (c Changes) Affecting(mappings []pipeline.ShapeMapping) Changes {
+	mapped := map[string]map[string]bool{}
+	for _, m := range mappings {
+		if mapped[m.From] == nil {
+			mapped[m.From] = map[string]bool{}
+		}
+		for _, p := range m.Properties {
+			mapped[m.From][p.From] = true
+		}
+	}
+
+	var affecting Changes
+	for _, change := range c {
+		properties, ok := mapped[change.Shape]
+		if ok && (change.Property == "" || properties[change.Property]) {
+			affecting = append(affecting, change)
+		}
+	}
+	return affecting
+}
+
+// Compare returns the changes between the shapes in from and those in to,
+// such as the results of two calls to DiscoverShapes, ordered by shape and
+// property. Shapes are matched by name, and properties by name within them.
+//
+// A new property is Forward compatible, since readers of the old shape ignore
+// it, and a removed property Backward compatible. A property whose type is
+// widened, as Inferrer widens types, is Backward compatible, and one whose type
+// is narrowed is Forward compatible. Other changes of type, changes of keys and
+// removed shapes are Breaking. New shapes are Full compatible.
+func Compare(from, to pipeline.ShapeDefinitions) Changes {
+	var changes Changes
+
+	old := shapesByName(from)
+	current := shapesByName(to)
+
+	for _, name := range unionNames(shapeNames(from), shapeNames(to)) {
+		o, inOld := old[name]
+		n, inNew := current[name]
+		switch {
+		case !inOld:
+			changes = append(changes, Change{Kind: ShapeAdded, Shape: name, Compatibility: Full})
+		case !inNew:
+			changes = append(changes, Change{Kind: ShapeRemoved, Shape: name, Compatibility: Breaking})
+		default:
+			changes = append(changes, compareShape(o, n)...)
+		}
+	}
+
+	return changes
+}
+
+func compareShape(from, to pipeline.ShapeDefinition) Changes {
+	var changes Changes
+
+	if !equalStrings(from.Keys, to.Keys) {
+		changes = append(changes, Change{
+			Kind:          KeysChanged,
+			Shape:         from.Name,
+			From:          strings.Join(from.Keys, ","),
+			To:            strings.Join(to.Keys, ","),
+			Compatibility: Breaking,
+		})
+	}
+
+	old := propertyTypes(from)
+	current := propertyTypes(to)
+
+	for _, name := range unionNames(propertyNames(from), propertyNames(to)) {
+		o, inOld := old[name]
+		n, inNew := current[name]
+		change := Change{Shape: from.Name, Property: name}
+		switch {
+		case !inOld:
+			change.Kind, change.To, change.Compatibility = PropertyAdded, n, Forward
+		case !inNew:
+			change.Kind, change.From, change.Compatibility = PropertyRemoved, o, Backward
+		case sameType(o, n):
+			continue
+		default:
+			change.Kind, change.From, change.To = PropertyRetyped, o, n
+			change.Compatibility = retypeCompatibility(o, n)
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// sameType reports whether a and b name the same property type.
+func sameType(a, b string) bool {
+	if KnownType(a) && KnownType(b) {
+		return normalizeType(a) == normalizeType(b)
+	}
+	return strings.EqualFold(a, b)
+}
+
+// retypeCompatibility classifies changing a property's type from one type to another.
+func retypeCompatibility(from, to string) Compatibility {
+	if !KnownType(from) || !KnownType(to) {
+		return Breaking
+	}
+	switch {
+	case widens(from, to):
+		return Backward
+	case widens(to, from):
+		return Forward
+	}
+	return Breaking
+}
+
+// widens reports whether every value of type from is also a value of type to,
+// once converted as Inferrer would.
+func widens(from, to string) bool {
+	from, to = normalizeType(from), normalizeType(to)
+	return to == "string" || (from == "integer" && to == "number")
+}
+
+func shapesByName(defs pipeline.ShapeDefinitions) map[string]pipeline.ShapeDefinition {
+	byName := make(map[string]pipeline.ShapeDefinition, len(defs))
+	for _, def := range defs {
+		byName[def.Name] = def
+	}
+	return byName
+}
+
+func shapeNames(defs pipeline.ShapeDefinitions) []string {
+	names := make([]string, len(defs))
+	for i, def := range defs {
+		names[i] = def.Name
+	}
+	return names
+}
+
+func propertyNames(def pipeline.ShapeDefinition) []string {
+	names := make([]string, len(def.Properties))
+	for i, p := range def.Properties {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// unionNames returns the names in a or b, sorted and without duplicates.
+func unionNames(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var names []string
+	for _, name := range append(append([]string(nil), a...), b...) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
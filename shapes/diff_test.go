@@ -0,0 +1,93 @@
+package shapes
+
+import (
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompare(t *testing.T) {
+
+	old := pipeline.ShapeDefinitions{
+		{
+			Name: "person",
+			Keys: []string{"id"},
+			Properties: []pipeline.PropertyDefinition{
+				{Name: "id", Type: "int"},
+				{Name: "name", Type: "string"},
+				{Name: "age", Type: "integer"},
+				{Name: "score", Type: "number"},
+				{Name: "born", Type: "datetime"},
+			},
+		},
+		{Name: "order", Keys: []string{"id"}},
+	}
+
+	Convey("Compare", t, func() {
+
+		Convey("should find no changes between equivalent shapes", func() {
+			same := pipeline.ShapeDefinitions{old[1], old[0]}
+			same[1].Properties = append([]pipeline.PropertyDefinition{{Name: "id", Type: "integer"}}, old[0].Properties[1:]...)
+
+			changes := Compare(old, same)
+			So(changes, ShouldBeEmpty)
+			So(changes.Compatibility(), ShouldEqual, Full)
+		})
+
+		Convey("should classify each change", func() {
+			changed := pipeline.ShapeDefinitions{
+				{
+					Name: "person",
+					Keys: []string{"id", "name"},
+					Properties: []pipeline.PropertyDefinition{
+						{Name: "id", Type: "integer"},
+						{Name: "name", Type: "string"},
+						{Name: "age", Type: "number"},
+						{Name: "score", Type: "integer"},
+						{Name: "born", Type: "boolean"},
+						{Name: "email", Type: "string"},
+					},
+				},
+				{Name: "invoice"},
+			}
+
+			changes := Compare(old, changed)
+			So(changes, ShouldResemble, Changes{
+				{Kind: ShapeAdded, Shape: "invoice", Compatibility: Full},
+				{Kind: ShapeRemoved, Shape: "order", Compatibility: Breaking},
+				{Kind: KeysChanged, Shape: "person", From: "id", To: "id,name", Compatibility: Breaking},
+				{Kind: PropertyRetyped, Shape: "person", Property: "age", From: "integer", To: "number", Compatibility: Backward},
+				{Kind: PropertyRetyped, Shape: "person", Property: "born", From: "datetime", To: "boolean", Compatibility: Breaking},
+				{Kind: PropertyAdded, Shape: "person", Property: "email", To: "string", Compatibility: Forward},
+				{Kind: PropertyRetyped, Shape: "person", Property: "score", From: "number", To: "integer", Compatibility: Forward},
+			})
+			So(changes[3].String(), ShouldEqual, `person.age: property retyped from "integer" to "number" (backward)`)
+		})
+
+		Convey("should combine compatibilities", func() {
+			So(Changes{{Compatibility: Full}, {Compatibility: Forward}}.Compatibility(), ShouldEqual, Forward)
+			So(Changes{{Compatibility: Backward}, {Compatibility: Backward}}.Compatibility(), ShouldEqual, Backward)
+			So(Changes{{Compatibility: Backward}, {Compatibility: Forward}}.Compatibility(), ShouldEqual, Breaking)
+		})
+
+		Convey("should find the changes which affect mappings", func() {
+			changed := pipeline.ShapeDefinitions{{
+				Name: "person",
+				Keys: []string{"id"},
+				Properties: []pipeline.PropertyDefinition{
+					{Name: "id", Type: "string"},
+					{Name: "name", Type: "integer"},
+				},
+			}}
+
+			changes := Compare(old, changed).Affecting([]pipeline.ShapeMapping{
+				{From: "person", To: "contact", Properties: []pipeline.PropertyMapping{{From: "name"}, {From: "born"}}},
+			})
+			So(changes, ShouldResemble, Changes{
+				{Kind: PropertyRemoved, Shape: "person", Property: "born", From: "datetime", Compatibility: Backward},
+				{Kind: PropertyRetyped, Shape: "person", Property: "name", From: "string", To: "integer", Compatibility: Forward},
+			})
+		})
+	})
+}
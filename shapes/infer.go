@@ -0,0 +1,396 @@
+package shapes
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/internal/numeric"
+)
+
+// Inferrer infers the shape of a set of records from a sample of them.
+// Each property's type is widened as values of other types are seen:
+// integers widen to numbers, and any other mix of types widens to strings.
+// Nested objects are inferred recursively.
+//
+// Inferrer is not safe for concurrent use.
+type Inferrer struct {
+	name  string
+	count int
+	props *properties
+
+	// keyNames holds the KeyNames shared by every data point added,
+	// or nil once two data points disagree.
+	keyNames    []string
+	keyNamesSet bool
+}
+
+// InferredProperty describes a property of an inferred shape.
+type InferredProperty struct {
+	Name string
+	// Type is one of Types.
+	Type string
+	// Nullable is true if the property was null or missing in any record.
+	Nullable bool
+	// Count is the number of records in which the property had a value.
+	Count int
+	// Properties describes the properties of nested objects,
+	// if Type is "object".
+	Properties []InferredProperty
+}
+
+// NewInferrer returns an Inferrer for the shape called name.
+func NewInferrer(name string) *Inferrer {
+	return &Inferrer{name: name, props: newProperties()}
+}
+
+// Count returns the number of records added.
+func (in *Inferrer) Count() int {
+	return in.count
+}
+
+// Add adds a record to the sample. Properties first seen in
+// the same record are ordered by name.
+func (in *Inferrer) Add(record map[string]interface{}) {
+	in.count++
+	in.props.add(record, sortedNames(record))
+}
+
+// AddDataPoint adds the data of dp to the sample. If every data point
+// added has the same KeyNames they become the keys of the shape.
+func (in *Inferrer) AddDataPoint(dp pipeline.DataPoint) {
+	switch {
+	case !in.keyNamesSet:
+		in.keyNames = dp.KeyNames
+		in.keyNamesSet = true
+	case !equalStrings(in.keyNames, dp.KeyNames):
+		in.keyNames = nil
+	}
+	in.Add(dp.Data)
+}
+
+// AddJSON adds the JSON objects read from r to the sample, stopping after
+// limit objects if limit is positive. r may hold an array of objects or a
+// sequence of them, such as newline-delimited JSON. It returns the number
+// of objects added.
+func (in *Inferrer) AddJSON(r io.Reader, limit int) (int, error) {
+	br := bufio.NewReader(r)
+	array, err := startsWithArray(br)
+	if err != nil {
+		return 0, err
+	}
+
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for limit <= 0 || n < limit {
+		if array && !dec.More() {
+			break
+		}
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			if err == io.EOF && !array {
+				break
+			}
+			return n, fmt.Errorf("record %d: %s", n+1, err)
+		}
+		in.Add(record)
+		n++
+	}
+	return n, nil
+}
+
+// AddCSV adds the records read from r, a CSV file with a header row, to the
+// sample, stopping after limit records if limit is positive. Values are parsed
+// as integers, numbers, booleans or times where they can be, and empty values
+// are treated as null. Properties are ordered as they are in the header.
+// It returns the number of records added.
+func (in *Inferrer) AddCSV(r io.Reader, limit int) (int, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading header: %s", err)
+	}
+
+	n := 0
+	for limit <= 0 || n < limit {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		record := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			if i < len(row) {
+				record[name] = parseCSVValue(row[i])
+			}
+		}
+		in.count++
+		in.props.add(record, header)
+		n++
+	}
+	return n, nil
+}
+
+// Properties describes the properties seen so far, in the order they were first seen.
+func (in *Inferrer) Properties() []InferredProperty {
+	return in.props.describe(in.count)
+}
+
+// CandidateKeys returns the properties which could identify a record: those with
+// a distinct, non-null scalar value in every record. Properties named "id" or
+// ending in "id" come first; otherwise they're in the order they were first seen.
+func (in *Inferrer) CandidateKeys() []string {
+	var ids, others []string
+	for _, name := range in.props.order {
+		p := in.props.byName[name]
+		if in.count == 0 || p.count != in.count || p.kind >= kindObject || p.duplicate {
+			continue
+		}
+		if lower := strings.ToLower(name); strings.HasSuffix(lower, "id") {
+			ids = append(ids, name)
+		} else {
+			others = append(others, name)
+		}
+	}
+	return append(ids, others...)
+}
+
+// Shape returns the inferred shape. Its keys are the KeyNames shared by the
+// data points added, if there are any, or else the first candidate key.
+func (in *Inferrer) Shape() pipeline.ShapeDefinition {
+	def := pipeline.ShapeDefinition{Name: in.name}
+
+	switch {
+	case len(in.keyNames) > 0:
+		def.Keys = append([]string(nil), in.keyNames...)
+	default:
+		if keys := in.CandidateKeys(); len(keys) > 0 {
+			def.Keys = keys[:1]
+		}
+	}
+
+	for _, p := range in.Properties() {
+		def.Properties = append(def.Properties, pipeline.PropertyDefinition{Name: p.Name, Type: p.Type})
+	}
+	return def
+}
+
+// InferShape returns the shape called name inferred from dataPoints.
+func InferShape(name string, dataPoints []pipeline.DataPoint) pipeline.ShapeDefinition {
+	in := NewInferrer(name)
+	for _, dp := range dataPoints {
+		in.AddDataPoint(dp)
+	}
+	return in.Shape()
+}
+
+// kind is the inferred type of a value, ordered so that scalar kinds come before
+// kindObject and kindArray. kindNull is the kind of a property only seen as null.
+type kind int
+
+const (
+	kindNull kind = iota
+	kindInteger
+	kindNumber
+	kindBoolean
+	kindDateTime
+	kindString
+	kindObject
+	kindArray
+)
+
+var kindTypes = [...]string{
+	kindNull:     "string",
+	kindInteger:  "integer",
+	kindNumber:   "number",
+	kindBoolean:  "boolean",
+	kindDateTime: "datetime",
+	kindString:   "string",
+	kindObject:   "object",
+	kindArray:    "array",
+}
+
+// widen returns the narrowest kind which holds values of kinds a and b.
+func widen(a, b kind) kind {
+	switch {
+	case a == b || b == kindNull:
+		return a
+	case a == kindNull:
+		return b
+	case (a == kindInteger && b == kindNumber) || (a == kindNumber && b == kindInteger):
+		return kindNumber
+	}
+	return kindString
+}
+
+func kindOf(v interface{}) kind {
+	switch v := v.(type) {
+	case nil:
+		return kindNull
+	case bool:
+		return kindBoolean
+	case time.Time:
+		return kindDateTime
+	case string:
+		if _, err := toDateTime(v); err == nil {
+			return kindDateTime
+		}
+		return kindString
+	case map[string]interface{}:
+		return kindObject
+	case []interface{}:
+		return kindArray
+	}
+	if numeric.IsInteger(v) {
+		return kindInteger
+	}
+	if _, ok := numeric.Float(v); ok {
+		return kindNumber
+	}
+	return kindString
+}
+
+// properties accumulates what's known about the properties of a set of records.
+type properties struct {
+	order  []string
+	byName map[string]*property
+}
+
+type property struct {
+	kind  kind
+	count int
+	// nested holds the properties of the property's values, if they're objects.
+	nested *properties
+	// nestedCount is the number of objects added to nested.
+	nestedCount int
+	// seen holds the values seen so far, to find duplicates.
+	seen      map[string]bool
+	duplicate bool
+}
+
+func newProperties() *properties {
+	return &properties{byName: make(map[string]*property)}
+}
+
+// add adds record, whose property names are names, in order.
+func (ps *properties) add(record map[string]interface{}, names []string) {
+	for _, name := range names {
+		v, present := record[name]
+		if !present {
+			continue
+		}
+		p, ok := ps.byName[name]
+		if !ok {
+			p = &property{kind: kindNull, seen: make(map[string]bool)}
+			ps.byName[name] = p
+			ps.order = append(ps.order, name)
+		}
+		if v == nil {
+			continue
+		}
+
+		p.count++
+		p.kind = widen(p.kind, kindOf(v))
+
+		if obj, ok := v.(map[string]interface{}); ok {
+			if p.nested == nil {
+				p.nested = newProperties()
+			}
+			p.nested.add(obj, sortedNames(obj))
+			p.nestedCount++
+		}
+
+		if !p.duplicate && p.kind < kindObject {
+			key := fmt.Sprint(v)
+			if p.seen[key] {
+				p.duplicate = true
+				p.seen = nil
+			} else {
+				p.seen[key] = true
+			}
+		}
+	}
+}
+
+func (ps *properties) describe(count int) []InferredProperty {
+	var described []InferredProperty
+	for _, name := range ps.order {
+		p := ps.byName[name]
+		ip := InferredProperty{
+			Name:     name,
+			Type:     kindTypes[p.kind],
+			Nullable: p.count < count,
+			Count:    p.count,
+		}
+		if p.kind == kindObject && p.nested != nil {
+			ip.Properties = p.nested.describe(p.nestedCount)
+		}
+		described = append(described, ip)
+	}
+	return described
+}
+
+// startsWithArray reports whether the first non-space byte of r is '['.
+func startsWithArray(r *bufio.Reader) (bool, error) {
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b == '[', r.UnreadByte()
+	}
+}
+
+// parseCSVValue returns the value s holds, or nil if it's empty.
+func parseCSVValue(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	switch {
+	case strings.EqualFold(s, "true"):
+		return true
+	case strings.EqualFold(s, "false"):
+		return false
+	}
+	return s
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
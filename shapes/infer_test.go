@@ -0,0 +1,105 @@
+package shapes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInferrer(t *testing.T) {
+
+	Convey("Given an inferrer", t, func() {
+		sut := NewInferrer("people")
+
+		Convey("should widen types as it sees new values", func() {
+			sut.Add(map[string]interface{}{"id": 1.0, "score": 1.0, "code": 1.0, "born": "1980-02-03", "active": true})
+			sut.Add(map[string]interface{}{"id": 2.0, "score": 2.5, "code": "A", "born": "1990-12-31T10:00:00Z", "active": false})
+
+			So(sut.Shape(), ShouldResemble, pipeline.ShapeDefinition{
+				Name: "people",
+				Keys: []string{"id"},
+				Properties: []pipeline.PropertyDefinition{
+					{Name: "active", Type: "boolean"},
+					{Name: "born", Type: "datetime"},
+					{Name: "code", Type: "string"},
+					{Name: "id", Type: "integer"},
+					{Name: "score", Type: "number"},
+				},
+			})
+		})
+
+		Convey("should detect nullable properties and nested objects", func() {
+			sut.Add(map[string]interface{}{"id": 1.0, "address": map[string]interface{}{"city": "Ames", "zip": 50010.0}})
+			sut.Add(map[string]interface{}{"id": 2.0, "address": map[string]interface{}{"city": "Boone"}, "note": nil})
+			sut.Add(map[string]interface{}{"id": 3.0})
+
+			So(sut.Properties(), ShouldResemble, []InferredProperty{
+				{Name: "address", Type: "object", Nullable: true, Count: 2, Properties: []InferredProperty{
+					{Name: "city", Type: "string", Count: 2},
+					{Name: "zip", Type: "integer", Nullable: true, Count: 1},
+				}},
+				{Name: "id", Type: "integer", Count: 3},
+				{Name: "note", Type: "string", Nullable: true},
+			})
+		})
+
+		Convey("should infer numbers of any width built by in-process publishers", func() {
+			sut.Add(map[string]interface{}{"id": int32(1), "count": uint16(3), "score": float32(1.5)})
+
+			So(sut.Shape().Properties, ShouldResemble, []pipeline.PropertyDefinition{
+				{Name: "count", Type: "integer"},
+				{Name: "id", Type: "integer"},
+				{Name: "score", Type: "number"},
+			})
+		})
+
+		Convey("should suggest properties with distinct values in every record as keys", func() {
+			sut.Add(map[string]interface{}{"name": "a", "code": "x", "userId": 1.0, "group": 1.0, "rank": 1.0})
+			sut.Add(map[string]interface{}{"name": "b", "code": "y", "userId": 2.0, "group": 1.0})
+			sut.Add(map[string]interface{}{"name": "c", "code": "x", "userId": 3.0, "group": 2.0, "rank": 2.0})
+
+			So(sut.CandidateKeys(), ShouldResemble, []string{"userId", "name"})
+		})
+
+		Convey("should use the key names shared by the data points it's given", func() {
+			sut.AddDataPoint(pipeline.DataPoint{KeyNames: []string{"code"}, Data: map[string]interface{}{"id": 1.0, "code": "a"}})
+			sut.AddDataPoint(pipeline.DataPoint{KeyNames: []string{"code"}, Data: map[string]interface{}{"id": 2.0, "code": "b"}})
+			So(sut.Shape().Keys, ShouldResemble, []string{"code"})
+
+			sut.AddDataPoint(pipeline.DataPoint{KeyNames: []string{"id"}, Data: map[string]interface{}{"id": 3.0, "code": "c"}})
+			So(sut.Shape().Keys, ShouldResemble, []string{"id"})
+		})
+
+		Convey("should read JSON arrays", func() {
+			n, err := sut.AddJSON(strings.NewReader(` [{"id": 1, "score": 1.5}, {"id": 2, "score": 2}, {"id": 3}]`), 2)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(sut.Shape().Properties, ShouldResemble, []pipeline.PropertyDefinition{
+				{Name: "id", Type: "integer"},
+				{Name: "score", Type: "number"},
+			})
+		})
+
+		Convey("should read newline-delimited JSON", func() {
+			n, err := sut.AddJSON(strings.NewReader("{\"id\": 1}\n{\"id\": 2.5}\n"), 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(sut.Properties()[0].Type, ShouldEqual, "number")
+		})
+
+		Convey("should read CSV", func() {
+			n, err := sut.AddCSV(strings.NewReader("name,id,active,joined\nJane,1,true,2020-01-02\nJohn,2,,2021-03-04\n"), 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(sut.Properties(), ShouldResemble, []InferredProperty{
+				{Name: "name", Type: "string", Count: 2},
+				{Name: "id", Type: "integer", Count: 2},
+				{Name: "active", Type: "boolean", Nullable: true, Count: 1},
+				{Name: "joined", Type: "datetime", Count: 2},
+			})
+			So(sut.CandidateKeys(), ShouldResemble, []string{"id", "name", "joined"})
+		})
+	})
+}
@@ -0,0 +1,165 @@
+// Package shapes checks data points against the shape definitions
+// publishers and subscribers return from DiscoverShapes.
+package shapes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/internal/numeric"
+)
+
+// Violation describes a way in which a data point doesn't conform to its shape.
+type Violation struct {
+	// Property is the name of the property at fault. It's empty
+	// if the data point as a whole doesn't conform.
+	Property string `json:"property"`
+	Message  string `json:"message"`
+}
+
+func (v Violation) Error() string {
+	if v.Property == "" {
+		return v.Message
+	}
+	return v.Property + ": " + v.Message
+}
+
+// Violations lists every way in which a data point doesn't conform to its shape.
+type Violations []Violation
+
+func (v Violations) Error() string {
+	msgs := make([]string, len(v))
+	for i, violation := range v {
+		msgs[i] = violation.Error()
+	}
+	return "invalid data point: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks dp against def, returning every violation it finds, or nil
+// if there are none. Every key must be present and not null, every property
+// must have a value of its declared type or null, and properties which aren't
+// in def are reported as unknown. Properties of a type Validate doesn't know
+// may hold anything.
+func Validate(def pipeline.ShapeDefinition, dp pipeline.DataPoint) Violations {
+	var violations Violations
+
+	for _, key := range def.Keys {
+		if dp.Data[key] == nil {
+			violations = append(violations, Violation{Property: key, Message: "missing key"})
+		}
+	}
+
+	types := propertyTypes(def)
+	for _, name := range sortedNames(dp.Data) {
+		typ, ok := types[name]
+		if !ok {
+			violations = append(violations, Violation{Property: name, Message: "unknown property"})
+			continue
+		}
+		if v := dp.Data[name]; v != nil && !isType(typ, v) {
+			violations = append(violations, Violation{Property: name, Message: fmt.Sprintf("must be %s", article(typ))})
+		}
+	}
+
+	return violations
+}
+
+// Conform converts the values of dp to the types declared by def with Convert,
+// and drops the properties which aren't in def. It returns the result, along
+// with the violations it couldn't fix: missing keys and values which couldn't
+// be converted. The properties holding those values are left as they were.
+// dp itself isn't modified.
+func Conform(def pipeline.ShapeDefinition, dp pipeline.DataPoint) (pipeline.DataPoint, Violations) {
+	var violations Violations
+
+	types := propertyTypes(def)
+	data := make(map[string]interface{}, len(dp.Data))
+	for name, v := range dp.Data {
+		typ, ok := types[name]
+		if !ok {
+			continue
+		}
+		converted, err := Convert(typ, v)
+		if err != nil {
+			violations = append(violations, Violation{Property: name, Message: err.Error()})
+			converted = v
+		}
+		data[name] = converted
+	}
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Property < violations[j].Property })
+
+	var missing Violations
+	for _, key := range def.Keys {
+		if data[key] == nil {
+			missing = append(missing, Violation{Property: key, Message: "missing key"})
+		}
+	}
+
+	dp.Data = data
+	return dp, append(missing, violations...)
+}
+
+// propertyTypes returns the declared type of each property of def.
+func propertyTypes(def pipeline.ShapeDefinition) map[string]string {
+	types := make(map[string]string, len(def.Properties))
+	for _, p := range def.Properties {
+		types[p.Name] = p.Type
+	}
+	return types
+}
+
+// isType reports whether v, which isn't nil, is of the property type typ.
+// Times may be sent as RFC 3339 strings, since that's how they're encoded in JSON.
+func isType(typ string, v interface{}) bool {
+	switch normalizeType(typ) {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := numeric.Float(v)
+		return ok
+	case "integer":
+		return numeric.IsInteger(v)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "datetime":
+		switch v := v.(type) {
+		case time.Time:
+			return true
+		case string:
+			_, err := toDateTime(v)
+			return err == nil
+		}
+		return false
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	}
+	return true
+}
+
+func article(typ string) string {
+	switch typ = normalizeType(typ); typ {
+	case "integer", "array", "object":
+		return "an " + typ
+	case "datetime":
+		return "a date or time"
+	}
+	return "a " + typ
+}
+
+func sortedNames(data map[string]interface{}) []string {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
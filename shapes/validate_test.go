@@ -0,0 +1,150 @@
+package shapes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var person = pipeline.ShapeDefinition{
+	Name: "person",
+	Keys: []string{"id"},
+	Properties: []pipeline.PropertyDefinition{
+		{Name: "id", Type: "integer"},
+		{Name: "name", Type: "string"},
+		{Name: "born", Type: "date"},
+		{Name: "score", Type: "number"},
+		{Name: "tags", Type: "custom"},
+	},
+}
+
+func TestValidate(t *testing.T) {
+
+	Convey("Validate", t, func() {
+
+		Convey("should accept a conforming data point", func() {
+			violations := Validate(person, pipeline.DataPoint{Data: map[string]interface{}{
+				"id":    1.0,
+				"name":  "Jane",
+				"born":  "1980-02-03T00:00:00Z",
+				"score": 2.5,
+				"tags":  []interface{}{"a"},
+			}})
+			So(violations, ShouldBeNil)
+		})
+
+		Convey("should accept nulls in properties which aren't keys", func() {
+			violations := Validate(person, pipeline.DataPoint{Data: map[string]interface{}{"id": 1, "name": nil}})
+			So(violations, ShouldBeNil)
+		})
+
+		Convey("should report missing keys, wrong types and unknown properties", func() {
+			violations := Validate(person, pipeline.DataPoint{Data: map[string]interface{}{
+				"name":  7.0,
+				"score": "high",
+				"age":   40.0,
+			}})
+			So(violations, ShouldResemble, Violations{
+				{Property: "id", Message: "missing key"},
+				{Property: "age", Message: "unknown property"},
+				{Property: "name", Message: "must be a string"},
+				{Property: "score", Message: "must be a number"},
+			})
+			So(violations.Error(), ShouldStartWith, "invalid data point: id: missing key; ")
+		})
+
+		Convey("should accept numbers of any width", func() {
+			violations := Validate(person, pipeline.DataPoint{Data: map[string]interface{}{"id": uint64(1), "score": float32(2.5)}})
+			So(violations, ShouldBeNil)
+		})
+
+		Convey("should reject fractional integers", func() {
+			violations := Validate(person, pipeline.DataPoint{Data: map[string]interface{}{"id": 1.5}})
+			So(violations, ShouldResemble, Violations{{Property: "id", Message: "must be an integer"}})
+		})
+	})
+}
+
+func TestConform(t *testing.T) {
+
+	Convey("Conform", t, func() {
+
+		Convey("should convert values and drop unknown properties", func() {
+			dp := pipeline.DataPoint{Entity: "person", Data: map[string]interface{}{
+				"id":    "7",
+				"name":  12.0,
+				"born":  "1980-02-03",
+				"score": "2.5",
+				"age":   40.0,
+			}}
+
+			coerced, violations := Conform(person, dp)
+			So(violations, ShouldBeNil)
+			So(coerced.Entity, ShouldEqual, "person")
+			So(coerced.Data, ShouldResemble, map[string]interface{}{
+				"id":    int64(7),
+				"name":  "12",
+				"born":  time.Date(1980, 2, 3, 0, 0, 0, 0, time.UTC),
+				"score": 2.5,
+			})
+			So(dp.Data["id"], ShouldEqual, "7")
+		})
+
+		Convey("should report what it can't fix", func() {
+			_, violations := Conform(person, pipeline.DataPoint{Data: map[string]interface{}{"score": "high"}})
+			So(violations, ShouldResemble, Violations{
+				{Property: "id", Message: "missing key"},
+				{Property: "score", Message: `"high" is not a number`},
+			})
+		})
+	})
+}
+
+func TestValidator(t *testing.T) {
+
+	bad := pipeline.DataPoint{Entity: "person", Data: map[string]interface{}{"id": "7", "age": 40.0}}
+
+	Convey("A validator", t, func() {
+
+		Convey("with the reject policy should refuse a data point which doesn't conform", func() {
+			sut := NewValidator(pipeline.ShapeDefinitions{person}, Reject)
+			dp, violations, err := sut.Check("", bad)
+			So(err, ShouldNotBeNil)
+			So(violations, ShouldHaveLength, 2)
+			So(dp, ShouldResemble, bad)
+		})
+
+		Convey("with the warn policy should accept it as it is", func() {
+			sut := NewValidator(pipeline.ShapeDefinitions{person}, Warn)
+			dp, violations, err := sut.Check("", bad)
+			So(err, ShouldBeNil)
+			So(violations, ShouldHaveLength, 2)
+			So(dp, ShouldResemble, bad)
+		})
+
+		Convey("with the coerce policy should fix it", func() {
+			sut := NewValidator(pipeline.ShapeDefinitions{person}, Coerce)
+			dp, violations, err := sut.Check("", bad)
+			So(err, ShouldBeNil)
+			So(violations, ShouldHaveLength, 2)
+			So(dp.Data, ShouldResemble, map[string]interface{}{"id": int64(7)})
+		})
+
+		Convey("should refuse a shape it has no definition for", func() {
+			sut := NewValidator(pipeline.ShapeDefinitions{person}, Coerce)
+			_, _, err := sut.Check("order", bad)
+			So(err, ShouldResemble, Violations{{Message: `unknown shape "order"`}})
+		})
+	})
+
+	Convey("ParsePolicy should parse policy names", t, func() {
+		p, err := ParsePolicy("Coerce")
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, Coerce)
+
+		_, err = ParsePolicy("ignore")
+		So(err, ShouldNotBeNil)
+	})
+}
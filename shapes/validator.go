@@ -0,0 +1,127 @@
+package shapes
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/naveego/api/types/pipeline"
+)
+
+// Policy decides what a Validator does with a data point which doesn't conform to its shape.
+type Policy int
+
+const (
+	// Reject refuses the data point.
+	Reject Policy = iota
+	// Warn accepts the data point as it is, reporting its violations.
+	Warn
+	// Coerce conforms the data point to its shape with Conform,
+	// and refuses it if that doesn't fix it.
+	Coerce
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Reject:
+		return "reject"
+	case Warn:
+		return "warn"
+	case Coerce:
+		return "coerce"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy returns the policy named s, which is "reject", "warn" or "coerce".
+func ParsePolicy(s string) (Policy, error) {
+	for _, p := range []Policy{Reject, Warn, Coerce} {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return Reject, fmt.Errorf("unknown policy %q", s)
+}
+
+// Validator checks data points against a set of shape definitions
+// and applies a policy to those which don't conform.
+// It's safe for concurrent use.
+type Validator struct {
+	policy Policy
+
+	mu     sync.RWMutex
+	shapes map[string]pipeline.ShapeDefinition
+}
+
+// NewValidator returns a Validator for the shapes in defs, usually
+// those returned by DiscoverShapes, which applies policy.
+func NewValidator(defs pipeline.ShapeDefinitions, policy Policy) *Validator {
+	v := &Validator{
+		shapes: make(map[string]pipeline.ShapeDefinition, len(defs)),
+		policy: policy,
+	}
+	for _, def := range defs {
+		v.shapes[def.Name] = def
+	}
+	return v
+}
+
+// Policy returns the policy the Validator applies.
+func (v *Validator) Policy() Policy {
+	return v.policy
+}
+
+// Shape returns the definition of the shape called name, if the Validator has one.
+func (v *Validator) Shape(name string) (pipeline.ShapeDefinition, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	def, ok := v.shapes[name]
+	return def, ok
+}
+
+// SetShape adds the definition of a shape, replacing any it had for a shape of
+// the same name. Data points checked afterwards are checked against def.
+func (v *Validator) SetShape(def pipeline.ShapeDefinition) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.shapes[def.Name] = def
+}
+
+// Check validates dp against the definition of shapeName, or of dp.Entity if
+// shapeName is empty, and applies the Validator's policy. A data point of a
+// shape the Validator has no definition for doesn't conform.
+//
+// It returns the data point to use in place of dp and the violations found.
+// The error is non-nil, and holds the violations which remain, if the data
+// point is refused.
+func (v *Validator) Check(shapeName string, dp pipeline.DataPoint) (pipeline.DataPoint, Violations, error) {
+	if shapeName == "" {
+		shapeName = dp.Entity
+	}
+
+	def, ok := v.Shape(shapeName)
+	if !ok {
+		violations := Violations{{Message: fmt.Sprintf("unknown shape %q", shapeName)}}
+		if v.policy == Warn {
+			return dp, violations, nil
+		}
+		return dp, violations, violations
+	}
+
+	violations := Validate(def, dp)
+	if len(violations) == 0 {
+		return dp, nil, nil
+	}
+
+	switch v.policy {
+	case Warn:
+		return dp, violations, nil
+	case Coerce:
+		coerced, remaining := Conform(def, dp)
+		if len(remaining) > 0 {
+			return dp, violations, remaining
+		}
+		return coerced, violations, nil
+	}
+	return dp, violations, violations
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/naveego/navigator-go/subscribers/protocol"
+)
+
+// BatchSubscriber is the part of a subscriber a Batcher calls.
+// A SubscriberProxy is one.
+type BatchSubscriber interface {
+	ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+	protocol.TransactionalReceiver
+}
+
+// BatchError is returned by a Batcher when it aborts a batch.
+// None of the batch's data points were written.
+type BatchError struct {
+	BatchID string
+	Reason  string
+	// Requests holds the batch's data points, in the order they were sent,
+	// so they can be sent again.
+	Requests []protocol.ReceiveShapeRequest
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch %s of %d data points aborted: %s", e.BatchID, len(e.Requests), e.Reason)
+}
+
+// Batcher delivers data points to a subscriber which implements
+// protocol.TransactionalReceiver in batches which are written atomically.
+// It opens a batch before the first data point it's given, and commits it
+// once it holds size data points or Flush is called. If the subscriber
+// refuses a data point, or the batch fails to commit, the batch is aborted
+// and a *BatchError holding its data points is returned.
+//
+// A Batcher must not be shared between goroutines.
+type Batcher struct {
+	subscriber BatchSubscriber
+	size       int
+
+	batchID string
+	pending []protocol.ReceiveShapeRequest
+}
+
+// NewBatcher returns a Batcher which delivers data points to subscriber
+// in batches of up to size data points.
+func NewBatcher(subscriber BatchSubscriber, size int) *Batcher {
+	if size < 1 {
+		size = 1
+	}
+	return &Batcher{
+		subscriber: subscriber,
+		size:       size,
+	}
+}
+
+// ReceiveDataPoint sends the data point to the subscriber as part of the open
+// batch, opening one first if necessary, and commits the batch if it's full.
+func (b *Batcher) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	if b.batchID == "" {
+		if err := b.begin(); err != nil {
+			return protocol.ReceiveShapeResponse{}, err
+		}
+	}
+
+	request.BatchID = b.batchID
+	b.pending = append(b.pending, request)
+
+	resp, err := b.subscriber.ReceiveDataPoint(request)
+	if err == nil && !resp.Success {
+		err = errors.New(resp.Message)
+	}
+	if err != nil {
+		return resp, b.abort("data point refused: " + err.Error())
+	}
+
+	if len(b.pending) >= b.size {
+		return resp, b.Flush()
+	}
+	return resp, nil
+}
+
+// Flush commits the open batch, if there is one.
+func (b *Batcher) Flush() error {
+	if b.batchID == "" {
+		return nil
+	}
+
+	resp, err := b.subscriber.CommitBatch(protocol.CommitBatchRequest{BatchID: b.batchID})
+	if err == nil && !resp.Success {
+		err = errors.New(resp.Message)
+	}
+	if err != nil {
+		return b.abort("commit failed: " + err.Error())
+	}
+
+	b.batchID = ""
+	b.pending = nil
+	return nil
+}
+
+// Abort aborts the open batch, if there is one, returning the *BatchError
+// describing it.
+func (b *Batcher) Abort(reason string) error {
+	if b.batchID == "" {
+		return nil
+	}
+	return b.abort(reason)
+}
+
+// Pending returns the number of data points in the open batch.
+func (b *Batcher) Pending() int {
+	return len(b.pending)
+}
+
+func (b *Batcher) begin() error {
+	batchID := newBatchID()
+	resp, err := b.subscriber.BeginBatch(protocol.BeginBatchRequest{BatchID: batchID})
+	if err == nil && !resp.Success {
+		err = errors.New(resp.Message)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't begin batch: %s", err)
+	}
+
+	b.batchID = batchID
+	return nil
+}
+
+// abort aborts the open batch and returns the *BatchError describing it.
+// If the abort itself fails, its failure is added to the reason.
+func (b *Batcher) abort(reason string) error {
+	batchErr := &BatchError{
+		BatchID:  b.batchID,
+		Reason:   reason,
+		Requests: b.pending,
+	}
+
+	resp, err := b.subscriber.AbortBatch(protocol.AbortBatchRequest{BatchID: b.batchID, Reason: reason})
+	if err == nil && !resp.Success {
+		err = errors.New(resp.Message)
+	}
+	if err != nil {
+		batchErr.Reason += " (abort failed: " + err.Error() + ")"
+	}
+
+	b.batchID = ""
+	b.pending = nil
+	return batchErr
+}
+
+// newBatchID returns a random identifier for a batch.
+func newBatchID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
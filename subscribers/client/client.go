@@ -5,50 +5,109 @@ import (
 	"net/rpc"
 	"net/rpc/jsonrpc"
 
+	"github.com/naveego/navigator-go/internal/inflight"
+	"github.com/naveego/navigator-go/logging"
 	"github.com/naveego/navigator-go/subscribers/protocol"
 )
 
 type subscriberProxy struct {
-	client *rpc.Client
-	seq    int64
+	client   *rpc.Client
+	inFlight *inflight.Limiter
+	logger   logging.Logger
+}
+
+// SubscriberProxy is a protocol.Subscriber which calls a subscriber plugin,
+// and can call the optional parts of the protocol too.
+type SubscriberProxy interface {
+	protocol.Subscriber
+	protocol.SettingsSchemaProvider
+	protocol.ShapeTruncater
+	protocol.TransactionalReceiver
 }
 
 // NewSubscriber returns a protocol.Subscriber proxy which
 // communicates with a real subscriber over the provided connection.
-// The subscriber must own the connection and must not be shared between goroutines.
-func NewSubscriber(conn io.ReadWriteCloser) (protocol.Subscriber, error) {
+// The proxy must own the connection.
+//
+// The proxy is safe for concurrent use. Calls made from several goroutines
+// are sent over the connection at once, up to the limit set by WithMaxInFlight,
+// and each gets the response to its own request. Calls beyond the limit wait
+// their turn in the order they were made. The subscriber's server handles
+// the calls it receives concurrently, so calls whose order matters, such as
+// the data points of one key, should be made from a single goroutine. While a
+// batch is open, data points sent without a BatchID from any goroutine join it.
+func NewSubscriber(conn io.ReadWriteCloser, opts ...Option) (SubscriberProxy, error) {
 
-	//jsonClient := jsonrpc.NewClient(conn)
+	o := applyOptions(opts)
 
 	subscriberProxy := &subscriberProxy{
-		client: jsonrpc.NewClient(conn),
+		client:   jsonrpc.NewClient(conn),
+		inFlight: inflight.New(o.maxInFlight),
+		logger:   o.logger.With(logging.FieldRemoteAddr, remoteAddr(conn)),
 	}
 
 	return subscriberProxy, nil
 }
 
+func (p *subscriberProxy) call(method string, request interface{}, response interface{}) error {
+	p.inFlight.Acquire()
+	defer p.inFlight.Release()
+
+	p.logger.Debug("Calling "+method, logging.FieldMethod, method)
+	err := p.client.Call("Subscriber."+method, request, response)
+	if err != nil {
+		p.logger.Warn("Call failed", logging.FieldMethod, method, "error", err)
+	}
+	return err
+}
+
 func (p *subscriberProxy) TestConnection(request protocol.TestConnectionRequest) (resp protocol.TestConnectionResponse, err error) {
 	resp = protocol.TestConnectionResponse{}
-	err = p.client.Call("Subscriber.TestConnection", request, &resp)
+	err = p.call("TestConnection", request, &resp)
 	return
 }
 
 func (p *subscriberProxy) Init(request protocol.InitRequest) (resp protocol.InitResponse, err error) {
-	err = p.client.Call("Subscriber.Init", request, &resp)
+	err = p.call("Init", request, &resp)
 	return
 }
 
 func (p *subscriberProxy) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (resp protocol.ReceiveShapeResponse, err error) {
-	err = p.client.Call("Subscriber.ReceiveDataPoint", request, &resp)
+	err = p.call("ReceiveDataPoint", request, &resp)
 	return
 }
 
 func (p *subscriberProxy) Dispose(request protocol.DisposeRequest) (resp protocol.DisposeResponse, err error) {
-	err = p.client.Call("Subscriber.Dispose", request, &resp)
+	err = p.call("Dispose", request, &resp)
 	return
 }
 
 func (p *subscriberProxy) DiscoverShapes(request protocol.DiscoverShapesRequest) (resp protocol.DiscoverShapesResponse, err error) {
-	err = p.client.Call("Subscriber.DiscoverShapes", request, &resp)
+	err = p.call("DiscoverShapes", request, &resp)
+	return
+}
+
+func (p *subscriberProxy) SettingsSchema(request protocol.SettingsSchemaRequest) (resp protocol.SettingsSchemaResponse, err error) {
+	err = p.call("SettingsSchema", request, &resp)
+	return
+}
+
+func (p *subscriberProxy) TruncateShape(request protocol.TruncateShapeRequest) (resp protocol.TruncateShapeResponse, err error) {
+	err = p.call("TruncateShape", request, &resp)
+	return
+}
+
+func (p *subscriberProxy) BeginBatch(request protocol.BeginBatchRequest) (resp protocol.BeginBatchResponse, err error) {
+	err = p.call("BeginBatch", request, &resp)
+	return
+}
+
+func (p *subscriberProxy) CommitBatch(request protocol.CommitBatchRequest) (resp protocol.CommitBatchResponse, err error) {
+	err = p.call("CommitBatch", request, &resp)
+	return
+}
+
+func (p *subscriberProxy) AbortBatch(request protocol.AbortBatchRequest) (resp protocol.AbortBatchResponse, err error) {
+	err = p.call("AbortBatch", request, &resp)
 	return
 }
@@ -1,12 +1,24 @@
 package client
 
 import (
+	"context"
 	"io"
 	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/naveego/api/types/pipeline"
 	"github.com/sirupsen/logrus"
+	"github.com/naveego/navigator-go/metadata"
+	"github.com/naveego/navigator-go/settings"
+	"github.com/naveego/navigator-go/shapes"
 	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/navigator-go/subscribers/router"
+	"github.com/naveego/navigator-go/subscribers/sequence"
 	"github.com/naveego/navigator-go/subscribers/server"
 
 	"github.com/maraino/go-mock"
@@ -66,10 +78,15 @@ var (
 
 func init() {
 
-	go func() {
-		srv := server.NewSubscriberServer(addr, mockSubscriberInstance)
+	srv := server.NewSubscriberServer(addr, mockSubscriberInstance)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:54321")
+	if err != nil {
+		panic(err)
+	}
 
-		err := srv.ListenAndServe()
+	go func() {
+		err := srv.Serve(listener)
 		if err != nil {
 			logrus.Fatal("Error shutting down server: ", err)
 		}
@@ -77,6 +94,56 @@ func init() {
 
 }
 
+// testSubscriber is a SubscriberServer listening on a free port,
+// and a proxy connected to it.
+type testSubscriber struct {
+	addr  string
+	srv   *server.SubscriberServer
+	conn  net.Conn
+	proxy SubscriberProxy
+
+	conns []net.Conn
+}
+
+// serveSubscriber serves handler with a SubscriberServer configured with opts
+// on a free port, and connects a proxy to it. The caller should defer close.
+func serveSubscriber(handler interface{}, opts ...server.Option) *testSubscriber {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+
+	f := &testSubscriber{addr: listener.Addr().String()}
+	f.srv = server.NewSubscriberServer("tcp://"+f.addr, handler, opts...)
+	go f.srv.Serve(listener)
+
+	f.proxy = f.connect()
+	f.conn = f.conns[0]
+	return f
+}
+
+// dial opens another connection to the server.
+func (f *testSubscriber) dial() (io.ReadWriteCloser, error) {
+	return net.Dial("tcp", f.addr)
+}
+
+// connect returns another proxy configured with opts, connected to the server.
+func (f *testSubscriber) connect(opts ...Option) SubscriberProxy {
+	conn, err := net.Dial("tcp", f.addr)
+	So(err, ShouldBeNil)
+	f.conns = append(f.conns, conn)
+
+	proxy, err := NewSubscriber(conn, opts...)
+	So(err, ShouldBeNil)
+	return proxy
+}
+
+// close closes the connections opened by connect, and the server.
+func (f *testSubscriber) close() {
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.srv.Close()
+}
+
 func Test_publisherProxy_TestConnection(t *testing.T) {
 
 	Convey("should call method and get response", t, func() {
@@ -128,3 +195,1045 @@ func Test_subscriberProxy_ReceiveDataPoint(t *testing.T) {
 	})
 
 }
+
+func Test_subscriberProxy_Metadata(t *testing.T) {
+
+	Convey("should echo request metadata on the response", t, func() {
+		mockSubscriberInstance.Reset()
+		mockSubscriberInstance.When("ReceiveDataPoint", mock.Any).Return(protocol.ReceiveShapeResponse{Success: true}, nil)
+
+		conn, err := net.Dial("tcp", "127.0.0.1:54321")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		sut, err := NewSubscriber(conn)
+		So(err, ShouldBeNil)
+
+		actual, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+			Metadata: metadata.Metadata{
+				RequestID:     "request-1",
+				CorrelationID: "job-1",
+				Headers:       map[string]string{"x-test": "yes"},
+			},
+		})
+
+		So(err, ShouldBeNil)
+		So(actual.Metadata.RequestID, ShouldEqual, "request-1")
+		So(actual.Metadata.CorrelationID, ShouldEqual, "job-1")
+		So(actual.Metadata.Headers, ShouldBeNil)
+	})
+}
+
+type contextSubscriber struct {
+	received chan metadata.Metadata
+	canceled chan struct{}
+}
+
+func (c *contextSubscriber) Init(ctx context.Context, request protocol.InitRequest) (protocol.InitResponse, error) {
+	return protocol.InitResponse{Success: true}, nil
+}
+
+func (c *contextSubscriber) ReceiveDataPoint(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	md, _ := metadata.FromContext(ctx)
+	c.received <- md
+	<-ctx.Done()
+	close(c.canceled)
+	return protocol.ReceiveShapeResponse{}, ctx.Err()
+}
+
+func (c *contextSubscriber) Dispose(ctx context.Context, request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
+	return protocol.DisposeResponse{Success: true}, nil
+}
+
+func Test_subscriberProxy_ContextCancelledOnDisconnect(t *testing.T) {
+
+	Convey("should cancel the handler's context when the client disconnects", t, func() {
+		handler := &contextSubscriber{
+			received: make(chan metadata.Metadata, 1),
+			canceled: make(chan struct{}),
+		}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		sut := f.proxy
+
+		go sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+			Metadata: metadata.Metadata{RequestID: "request-2"},
+		})
+
+		select {
+		case md := <-handler.received:
+			So(md.RequestID, ShouldEqual, "request-2")
+		case <-time.After(time.Second):
+			So("handler was not called", ShouldBeEmpty)
+		}
+
+		f.conn.Close()
+
+		select {
+		case <-handler.canceled:
+		case <-time.After(time.Second):
+			So("context was not cancelled", ShouldBeEmpty)
+		}
+	})
+}
+
+type schemaSubscriber struct {
+	mockSubscriber
+	inited bool
+}
+
+func (s *schemaSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
+	s.inited = true
+	return protocol.InitResponse{Success: true}, nil
+}
+
+func (s *schemaSubscriber) SettingsSchema(request protocol.SettingsSchemaRequest) (protocol.SettingsSchemaResponse, error) {
+	return protocol.SettingsSchemaResponse{
+		Init: &settings.Schema{
+			Type: "object",
+			Properties: map[string]*settings.Schema{
+				"count": {Type: "integer"},
+			},
+			Required: []string{"count"},
+		},
+	}, nil
+}
+
+func Test_subscriberProxy_SettingsSchema(t *testing.T) {
+
+	Convey("should validate settings against the subscriber's schema", t, func() {
+		handler := &schemaSubscriber{}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		sut := f.proxy
+
+		schemas, err := sut.SettingsSchema(protocol.SettingsSchemaRequest{})
+		So(err, ShouldBeNil)
+		So(schemas.Init, ShouldNotBeNil)
+		So(schemas.Init.Required, ShouldResemble, []string{"count"})
+
+		resp, err := sut.Init(protocol.InitRequest{Settings: map[string]interface{}{"count": "ten"}})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.ValidationErrors, ShouldResemble, settings.ValidationErrors{
+			{Field: "count", Message: "must be an integer"},
+		})
+		So(handler.inited, ShouldBeFalse)
+
+		resp, err = sut.Init(protocol.InitRequest{Settings: map[string]interface{}{"count": 10}})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+		So(handler.inited, ShouldBeTrue)
+	})
+}
+
+type secretSubscriber struct {
+	mockSubscriber
+	password string
+	user     string
+}
+
+func (s *secretSubscriber) SettingsSchema(request protocol.SettingsSchemaRequest) (protocol.SettingsSchemaResponse, error) {
+	return protocol.SettingsSchemaResponse{
+		Init: &settings.Schema{
+			Type: "object",
+			Properties: map[string]*settings.Schema{
+				"user":     {Type: "string"},
+				"password": {Type: "string", Secret: true},
+			},
+		},
+	}, nil
+}
+
+func (s *secretSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
+	s.password, _ = request.Settings["password"].(string)
+	s.user, _ = request.Settings["user"].(string)
+	if s.user == "nobody" {
+		return protocol.InitResponse{Success: false, Message: "login failed for nobody:" + s.password}, nil
+	}
+	return protocol.InitResponse{Success: true}, nil
+}
+
+func Test_subscriberProxy_SecretSettings(t *testing.T) {
+
+	Convey("should resolve secret references before calling the subscriber", t, func() {
+		os.Setenv("SUBSCRIBER_TEST_PASSWORD", "hunter22")
+		defer os.Unsetenv("SUBSCRIBER_TEST_PASSWORD")
+
+		handler := &secretSubscriber{}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		sut := f.proxy
+
+		resp, err := sut.Init(protocol.InitRequest{Settings: map[string]interface{}{
+			"user":     "env:SUBSCRIBER_TEST_PASSWORD",
+			"password": "env:SUBSCRIBER_TEST_PASSWORD",
+		}})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+		So(handler.password, ShouldEqual, "hunter22")
+		So(handler.user, ShouldEqual, "env:SUBSCRIBER_TEST_PASSWORD")
+
+		resp, err = sut.Init(protocol.InitRequest{Settings: map[string]interface{}{"user": "nobody", "password": "env:SUBSCRIBER_TEST_PASSWORD"}})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.Message, ShouldEqual, "login failed for nobody:"+settings.Redacted)
+
+		resp, err = sut.Init(protocol.InitRequest{Settings: map[string]interface{}{"password": "env:SUBSCRIBER_TEST_MISSING"}})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.ValidationErrors[0].Field, ShouldEqual, "password")
+		So(handler.password, ShouldEqual, "hunter22")
+	})
+}
+
+type recordingSubscriber struct {
+	mockSubscriber
+	received []pipeline.DataPoint
+}
+
+func (s *recordingSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	s.received = append(s.received, request.DataPoint)
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func Test_subscriberProxy_ValidateShapes(t *testing.T) {
+
+	Convey("should check data points against their shape before the subscriber receives them", t, func() {
+		handler := &recordingSubscriber{}
+
+		validator := shapes.NewValidator(pipeline.ShapeDefinitions{
+			{
+				Name:       "person",
+				Keys:       []string{"id"},
+				Properties: []pipeline.PropertyDefinition{{Name: "id", Type: "integer"}},
+			},
+		}, shapes.Coerce)
+
+		f := serveSubscriber(handler, server.WithMiddleware(server.ValidateShapes(validator, nil)))
+		defer f.close()
+
+		sut := f.proxy
+
+		resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+			ShapeName: "person",
+			DataPoint: pipeline.DataPoint{Data: map[string]interface{}{"id": "7"}},
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+
+		resp, err = sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+			ShapeName: "person",
+			DataPoint: pipeline.DataPoint{Data: map[string]interface{}{"id": "seven"}},
+		})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.Violations, ShouldResemble, shapes.Violations{{Property: "id", Message: `"seven" is not a number`}})
+
+		So(handler.received, ShouldHaveLength, 1)
+		So(handler.received[0].Data, ShouldResemble, map[string]interface{}{"id": int64(7)})
+	})
+}
+
+func Test_subscriberProxy_Deduplicate(t *testing.T) {
+
+	Convey("should drop data points the subscriber has already received", t, func() {
+		handler := &recordingSubscriber{}
+		store := sequence.NewMemoryStore()
+		So(store.Save(sequence.Key("session-1", "person"), 1), ShouldBeNil)
+
+		f := serveSubscriber(handler, server.WithMiddleware(server.Deduplicate(store, nil)))
+		defer f.close()
+
+		sut := f.proxy
+
+		receive := func(sessionID string, seq int64) protocol.ReceiveShapeResponse {
+			resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+				ShapeName: "person",
+				SessionID: sessionID,
+				Sequence:  seq,
+				DataPoint: pipeline.DataPoint{Data: map[string]interface{}{"id": seq}},
+			})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeTrue)
+			return resp
+		}
+
+		So(receive("session-1", 1).Duplicate, ShouldBeTrue)
+		So(receive("session-1", 2).Duplicate, ShouldBeFalse)
+		So(receive("session-1", 2).Duplicate, ShouldBeTrue)
+		So(receive("session-2", 1).Duplicate, ShouldBeFalse)
+		So(receive("", 0).Duplicate, ShouldBeFalse)
+		So(receive("", 0).Duplicate, ShouldBeFalse)
+
+		So(handler.received, ShouldHaveLength, 4)
+
+		mark, _, err := store.Load(sequence.Key("session-1", "person"))
+		So(err, ShouldBeNil)
+		So(mark, ShouldEqual, 2)
+	})
+}
+
+type transactionalSubscriber struct {
+	mockSubscriber
+	staged    []pipeline.DataPoint
+	committed []pipeline.DataPoint
+	aborted   chan protocol.AbortBatchRequest
+}
+
+func (s *transactionalSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	if request.BatchID == "" {
+		return protocol.ReceiveShapeResponse{Success: false, Message: "no batch"}, nil
+	}
+	if request.DataPoint.Data["id"] == "bad" {
+		return protocol.ReceiveShapeResponse{Success: false, Message: "bad id"}, nil
+	}
+	s.staged = append(s.staged, request.DataPoint)
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func (s *transactionalSubscriber) BeginBatch(request protocol.BeginBatchRequest) (protocol.BeginBatchResponse, error) {
+	s.staged = nil
+	return protocol.BeginBatchResponse{Success: true}, nil
+}
+
+func (s *transactionalSubscriber) CommitBatch(request protocol.CommitBatchRequest) (protocol.CommitBatchResponse, error) {
+	s.committed = append(s.committed, s.staged...)
+	s.staged = nil
+	return protocol.CommitBatchResponse{Success: true}, nil
+}
+
+func (s *transactionalSubscriber) AbortBatch(request protocol.AbortBatchRequest) (protocol.AbortBatchResponse, error) {
+	s.staged = nil
+	s.aborted <- request
+	return protocol.AbortBatchResponse{Success: true}, nil
+}
+
+func Test_subscriberProxy_DeduplicateOutOfOrder(t *testing.T) {
+
+	Convey("should recognise data points which arrive out of order", t, func() {
+		handler := &recordingSubscriber{}
+		store := sequence.NewMemoryStore()
+
+		f := serveSubscriber(handler, server.WithMiddleware(server.Deduplicate(store, nil)))
+		defer f.close()
+
+		receive := func(seq int64) bool {
+			resp, err := f.proxy.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+				ShapeName: "person",
+				SessionID: "session-1",
+				Sequence:  seq,
+			})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeTrue)
+			return resp.Duplicate
+		}
+
+		So(receive(3), ShouldBeFalse)
+		So(receive(2), ShouldBeFalse)
+		So(receive(3), ShouldBeTrue)
+		So(receive(2), ShouldBeTrue)
+
+		mark, _, err := store.Load(sequence.Key("session-1", "person"))
+		So(err, ShouldBeNil)
+		So(mark, ShouldEqual, 0)
+
+		So(receive(1), ShouldBeFalse)
+		So(handler.received, ShouldHaveLength, 3)
+
+		mark, _, err = store.Load(sequence.Key("session-1", "person"))
+		So(err, ShouldBeNil)
+		So(mark, ShouldEqual, 3)
+
+		Convey("giving up on data points missing for too long", func() {
+			So(receive(5000), ShouldBeFalse)
+			So(receive(4), ShouldBeTrue)
+			So(receive(905), ShouldBeFalse)
+
+			mark, _, err := store.Load(sequence.Key("session-1", "person"))
+			So(err, ShouldBeNil)
+			So(mark, ShouldEqual, 905)
+		})
+	})
+
+	Convey("should receive data points without waiting for each other", t, func() {
+		handler := &gatedSubscriber{
+			gate:    1,
+			arrived: make(chan struct{}, 1),
+			release: make(chan struct{}),
+		}
+		f := serveSubscriber(handler, server.WithMiddleware(server.Deduplicate(sequence.NewMemoryStore(), nil)))
+		defer f.close()
+
+		receive := func(seq int64) <-chan protocol.ReceiveShapeResponse {
+			responses := make(chan protocol.ReceiveShapeResponse, 1)
+			go func() {
+				resp, _ := f.proxy.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+					ShapeName: "person",
+					SessionID: "session-1",
+					Sequence:  seq,
+				})
+				responses <- resp
+			}()
+			return responses
+		}
+
+		first := receive(1)
+		<-handler.arrived
+
+		select {
+		case resp := <-receive(2):
+			So(resp.Success, ShouldBeTrue)
+			So(resp.Duplicate, ShouldBeFalse)
+		case <-time.After(time.Second):
+			So("data point 2 waited for data point 1", ShouldBeEmpty)
+		}
+
+		copied := receive(1)
+		select {
+		case <-copied:
+			So("copy of data point 1 didn't wait for it", ShouldBeEmpty)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(handler.release)
+		So((<-first).Duplicate, ShouldBeFalse)
+		So((<-copied).Duplicate, ShouldBeTrue)
+		So(handler.sequences(), ShouldResemble, []int64{2, 1})
+	})
+}
+
+// gatedSubscriber holds back the data point numbered gate until release is
+// closed, signalling arrived when it gets it.
+type gatedSubscriber struct {
+	mockSubscriber
+	gate    int64
+	arrived chan struct{}
+	release chan struct{}
+
+	mu       sync.Mutex
+	received []int64
+}
+
+func (s *gatedSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	if request.Sequence == s.gate {
+		s.arrived <- struct{}{}
+		<-s.release
+	}
+	s.mu.Lock()
+	s.received = append(s.received, request.Sequence)
+	s.mu.Unlock()
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func (s *gatedSubscriber) sequences() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.received...)
+}
+
+func Test_subscriberProxy_DeduplicateBatches(t *testing.T) {
+
+	Convey("should only count data points received in a batch once it's committed", t, func() {
+		handler := &transactionalSubscriber{aborted: make(chan protocol.AbortBatchRequest, 1)}
+		store := sequence.NewMemoryStore()
+
+		f := serveSubscriber(handler, server.WithMiddleware(server.Deduplicate(store, nil)))
+		defer f.close()
+
+		sut := f.proxy
+
+		receive := func(seq int64) protocol.ReceiveShapeResponse {
+			resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+				ShapeName: "person",
+				SessionID: "session-1",
+				Sequence:  seq,
+				DataPoint: pipeline.DataPoint{Data: map[string]interface{}{"id": seq}},
+			})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeTrue)
+			return resp
+		}
+
+		_, err := sut.BeginBatch(protocol.BeginBatchRequest{BatchID: "b1"})
+		So(err, ShouldBeNil)
+		So(receive(1).Duplicate, ShouldBeFalse)
+		So(receive(1).Duplicate, ShouldBeTrue)
+		_, err = sut.AbortBatch(protocol.AbortBatchRequest{BatchID: "b1"})
+		So(err, ShouldBeNil)
+		<-handler.aborted
+
+		_, ok, err := store.Load(sequence.Key("session-1", "person"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		_, err = sut.BeginBatch(protocol.BeginBatchRequest{BatchID: "b2"})
+		So(err, ShouldBeNil)
+		So(receive(1).Duplicate, ShouldBeFalse)
+		_, err = sut.CommitBatch(protocol.CommitBatchRequest{BatchID: "b2"})
+		So(err, ShouldBeNil)
+
+		So(receive(1).Duplicate, ShouldBeTrue)
+		So(handler.committed, ShouldHaveLength, 1)
+
+		mark, _, err := store.Load(sequence.Key("session-1", "person"))
+		So(err, ShouldBeNil)
+		So(mark, ShouldEqual, 1)
+	})
+}
+
+func Test_subscriberProxy_Batches(t *testing.T) {
+
+	Convey("should deliver data points in batches", t, func() {
+		handler := &transactionalSubscriber{aborted: make(chan protocol.AbortBatchRequest, 1)}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		sut := f.proxy
+
+		batcher := NewBatcher(sut, 2)
+		receive := func(id string) error {
+			_, err := batcher.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+				ShapeName: "person",
+				DataPoint: pipeline.DataPoint{Data: map[string]interface{}{"id": id}},
+			})
+			return err
+		}
+
+		Convey("committing each full batch and the rest when flushed", func() {
+			So(receive("1"), ShouldBeNil)
+			So(receive("2"), ShouldBeNil)
+			So(receive("3"), ShouldBeNil)
+			So(handler.committed, ShouldHaveLength, 2)
+			So(batcher.Pending(), ShouldEqual, 1)
+
+			So(batcher.Flush(), ShouldBeNil)
+			So(handler.committed, ShouldHaveLength, 3)
+			So(batcher.Pending(), ShouldEqual, 0)
+		})
+
+		Convey("aborting a batch when a data point is refused", func() {
+			So(receive("1"), ShouldBeNil)
+			err := receive("bad")
+			So(err, ShouldHaveSameTypeAs, &BatchError{})
+			So(err.(*BatchError).Requests, ShouldHaveLength, 2)
+			So((<-handler.aborted).Reason, ShouldContainSubstring, "bad id")
+			So(handler.committed, ShouldBeEmpty)
+
+			So(receive("2"), ShouldBeNil)
+			So(batcher.Flush(), ShouldBeNil)
+			So(handler.committed, ShouldHaveLength, 1)
+		})
+
+		Convey("refusing to commit a batch which isn't open", func() {
+			resp, err := sut.CommitBatch(protocol.CommitBatchRequest{BatchID: "nope"})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeFalse)
+		})
+
+		Convey("aborting the open batch when the connection drops", func() {
+			So(receive("1"), ShouldBeNil)
+			f.conn.Close()
+
+			select {
+			case request := <-handler.aborted:
+				So(request.Reason, ShouldEqual, "connection dropped")
+			case <-time.After(5 * time.Second):
+				So("batch was not aborted", ShouldBeEmpty)
+			}
+			So(handler.committed, ShouldBeEmpty)
+		})
+	})
+}
+
+// flakySubscriber refuses data points with a retryable response until it has been sent failures of them.
+type flakySubscriber struct {
+	mockSubscriber
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (s *flakySubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls <= s.failures {
+		return protocol.ReceiveShapeResponse{Success: false, Message: "database unavailable", Retryable: true}, nil
+	}
+	if request.ShapeName == "bad" {
+		return protocol.ReceiveShapeResponse{Success: false, Message: "bad shape"}, nil
+	}
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func (s *flakySubscriber) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func Test_RetryingSubscriber(t *testing.T) {
+
+	Convey("should retry data points the subscriber couldn't receive", t, func() {
+		handler := &flakySubscriber{failures: 2}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		dial := func() (SubscriberProxy, error) {
+			conn, err := f.dial()
+			if err != nil {
+				return nil, err
+			}
+			return NewSubscriber(conn)
+		}
+		conn, proxy := f.conn, f.proxy
+
+		opts := []Option{
+			WithBackoff(time.Millisecond, 5*time.Millisecond),
+			WithMaxAttempts(3),
+			WithReconnect(dial),
+		}
+
+		Convey("until it's received", func() {
+			sut := NewRetryingSubscriber(proxy, opts...)
+			resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person"})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeTrue)
+			So(handler.callCount(), ShouldEqual, 3)
+		})
+
+		Convey("until it runs out of attempts", func() {
+			handler.failures = 10
+			sut := NewRetryingSubscriber(proxy, opts...)
+			resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person"})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeFalse)
+			So(resp.Retryable, ShouldBeTrue)
+			So(handler.callCount(), ShouldEqual, 3)
+		})
+
+		Convey("but not when it's refused for good", func() {
+			handler.failures = 0
+			sut := NewRetryingSubscriber(proxy, opts...)
+			resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "bad"})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeFalse)
+			So(handler.callCount(), ShouldEqual, 1)
+		})
+
+		Convey("reconnecting when the connection drops", func() {
+			handler.failures = 0
+			sut := NewRetryingSubscriber(proxy, opts...)
+			conn.Close()
+			resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person"})
+			So(err, ShouldBeNil)
+			So(resp.Success, ShouldBeTrue)
+			So(handler.callCount(), ShouldEqual, 1)
+		})
+
+		Convey("but not when the connection drops and it can't reconnect", func() {
+			handler.failures = 0
+			sut := NewRetryingSubscriber(proxy, WithBackoff(50*time.Millisecond, 50*time.Millisecond), WithMaxAttempts(10))
+			conn.Close()
+			start := time.Now()
+			_, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person"})
+			So(err, ShouldEqual, rpc.ErrShutdown)
+			// The write which finds the connection closed may be retried once,
+			// but nothing is retried once the client has shut down.
+			So(time.Since(start), ShouldBeLessThan, 250*time.Millisecond)
+			So(handler.callCount(), ShouldEqual, 0)
+		})
+
+		Convey("opening the circuit after repeated failures", func() {
+			handler.failures = 10
+			sut := NewRetryingSubscriber(proxy, append(opts, WithCircuitBreaker(2, time.Hour))...)
+			_, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person"})
+			So(err, ShouldEqual, ErrCircuitOpen)
+			So(sut.CircuitOpen(), ShouldBeTrue)
+			So(handler.callCount(), ShouldEqual, 2)
+
+			_, err = sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person"})
+			So(err, ShouldEqual, ErrCircuitOpen)
+			So(handler.callCount(), ShouldEqual, 2)
+		})
+	})
+}
+
+func Test_breaker(t *testing.T) {
+
+	Convey("should let a call through once the cooldown has passed", t, func() {
+		now := time.Unix(0, 0)
+		b := newBreaker(2, time.Minute)
+		b.now = func() time.Time { return now }
+
+		b.failed()
+		So(b.allow(), ShouldBeTrue)
+		b.failed()
+		So(b.allow(), ShouldBeFalse)
+
+		now = now.Add(time.Minute)
+		So(b.allow(), ShouldBeTrue)
+		So(b.allow(), ShouldBeFalse)
+
+		Convey("and close if it succeeds", func() {
+			b.succeeded()
+			So(b.open(), ShouldBeFalse)
+			So(b.allow(), ShouldBeTrue)
+		})
+
+		Convey("and stay open if it fails", func() {
+			b.failed()
+			So(b.open(), ShouldBeTrue)
+			So(b.allow(), ShouldBeFalse)
+		})
+	})
+}
+
+// orderingSubscriber records the sequence numbers of the data points it receives for each id.
+type orderingSubscriber struct {
+	mockSubscriber
+	mu       sync.Mutex
+	received map[interface{}][]int64
+}
+
+func (s *orderingSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := request.DataPoint.Data["id"]
+	s.received[id] = append(s.received[id], request.Sequence)
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func Test_Dispatcher(t *testing.T) {
+
+	Convey("should deliver data points in parallel, in order for each key", t, func() {
+		handler := &orderingSubscriber{received: make(map[interface{}][]int64)}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		var mu sync.Mutex
+		connections := make(map[int]int)
+		sut, err := NewDispatcher(DialReceivers(f.dial), 3, func(result DispatchResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			if result.Err == nil && result.Response.Success {
+				connections[result.Connection]++
+			}
+		})
+		So(err, ShouldBeNil)
+
+		for i := 1; i <= 300; i++ {
+			So(sut.Dispatch(protocol.ReceiveShapeRequest{
+				ShapeName: "person",
+				Sequence:  int64(i),
+				DataPoint: pipeline.DataPoint{
+					KeyNames: []string{"id"},
+					Data:     map[string]interface{}{"id": i % 10},
+				},
+			}), ShouldBeNil)
+		}
+		sut.Flush()
+
+		mu.Lock()
+		So(len(connections), ShouldBeGreaterThan, 1)
+		mu.Unlock()
+
+		handler.mu.Lock()
+		So(handler.received, ShouldHaveLength, 10)
+		for _, sequences := range handler.received {
+			So(sequences, ShouldHaveLength, 30)
+			for i := 1; i < len(sequences); i++ {
+				So(sequences[i], ShouldBeGreaterThan, sequences[i-1])
+			}
+		}
+		handler.mu.Unlock()
+
+		So(sut.Close(), ShouldBeNil)
+		So(sut.Dispatch(protocol.ReceiveShapeRequest{}), ShouldEqual, ErrDispatcherClosed)
+	})
+
+	Convey("should send data points to the receivers its factory returns", t, func() {
+		handler := &flakySubscriber{failures: 2}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		dial := DialReceivers(f.dial)
+		var opened []int
+		var failed int
+		sut, err := NewDispatcher(func(i int) (Receiver, io.Closer, error) {
+			opened = append(opened, i)
+			receiver, conn, err := dial(i)
+			if err != nil {
+				return nil, nil, err
+			}
+			retrying := NewRetryingSubscriber(receiver.(SubscriberProxy), WithBackoff(time.Millisecond, time.Millisecond))
+			return retrying, conn, nil
+		}, 2, func(result DispatchResult) {
+			if result.Err != nil || !result.Response.Success {
+				failed++
+			}
+		})
+		So(err, ShouldBeNil)
+		So(opened, ShouldResemble, []int{0, 1})
+
+		So(sut.Dispatch(protocol.ReceiveShapeRequest{ShapeName: "person"}), ShouldBeNil)
+		sut.Flush()
+		So(sut.Close(), ShouldBeNil)
+		So(failed, ShouldEqual, 0)
+		So(handler.callCount(), ShouldEqual, 3)
+	})
+}
+
+func Test_Dispatcher_Deduplicate(t *testing.T) {
+
+	Convey("should deliver every numbered data point to a deduplicating subscriber when a connection is slow", t, func() {
+		handler := &sessionSubscriber{received: make(map[string][]int64)}
+		f := serveSubscriber(handler, server.WithMiddleware(server.Deduplicate(sequence.NewMemoryStore(), nil)))
+		defer f.close()
+
+		dial := DialReceivers(f.dial)
+		var mu sync.Mutex
+		var failed, duplicates int
+		connections := make(map[int]bool)
+		sut, err := NewDispatcher(func(i int) (Receiver, io.Closer, error) {
+			receiver, conn, err := dial(i)
+			if err != nil || i != 0 {
+				return receiver, conn, err
+			}
+			return slowReceiver{receiver}, conn, nil
+		}, 3, func(result DispatchResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			connections[result.Connection] = true
+			if result.Err != nil || !result.Response.Success {
+				failed++
+			}
+			if result.Response.Duplicate {
+				duplicates++
+			}
+		})
+		So(err, ShouldBeNil)
+
+		sessions := []string{"session-1", "session-2", "session-3", "session-4"}
+		for i := 1; i <= 100; i++ {
+			for _, sessionID := range sessions {
+				So(sut.Dispatch(protocol.ReceiveShapeRequest{
+					ShapeName: "person",
+					SessionID: sessionID,
+					Sequence:  int64(i),
+					DataPoint: pipeline.DataPoint{
+						KeyNames: []string{"id"},
+						Data:     map[string]interface{}{"id": i},
+					},
+				}), ShouldBeNil)
+			}
+		}
+		So(sut.Close(), ShouldBeNil)
+
+		So(failed, ShouldEqual, 0)
+		So(duplicates, ShouldEqual, 0)
+		So(connections[0], ShouldBeTrue)
+		So(len(connections), ShouldBeGreaterThan, 1)
+
+		handler.mu.Lock()
+		defer handler.mu.Unlock()
+		So(handler.received, ShouldHaveLength, len(sessions))
+		for _, sequences := range handler.received {
+			So(sequences, ShouldHaveLength, 100)
+			for i, seq := range sequences {
+				So(seq, ShouldEqual, i+1)
+			}
+		}
+	})
+}
+
+// slowReceiver delays each data point before passing it on.
+type slowReceiver struct {
+	Receiver
+}
+
+func (r slowReceiver) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	time.Sleep(time.Millisecond)
+	return r.Receiver.ReceiveDataPoint(request)
+}
+
+// sessionSubscriber records the sequences it receives for each session.
+type sessionSubscriber struct {
+	mockSubscriber
+	mu       sync.Mutex
+	received map[string][]int64
+}
+
+func (s *sessionSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received[request.SessionID] = append(s.received[request.SessionID], request.Sequence)
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func Test_partitionHash(t *testing.T) {
+
+	Convey("should hash data points by shape and key values", t, func() {
+		dp := func(keys []string, data map[string]interface{}) pipeline.DataPoint {
+			return pipeline.DataPoint{KeyNames: keys, Data: data}
+		}
+
+		a, ok := partitionHash("person", dp([]string{"id"}, map[string]interface{}{"id": 1, "name": "Ann"}))
+		So(ok, ShouldBeTrue)
+		b, _ := partitionHash("person", dp([]string{"id"}, map[string]interface{}{"id": 1, "name": "Bob"}))
+		So(b, ShouldEqual, a)
+		c, _ := partitionHash("company", dp([]string{"id"}, map[string]interface{}{"id": 1}))
+		So(c, ShouldNotEqual, a)
+
+		fromShape := pipeline.DataPoint{Shape: pipeline.Shape{KeyNames: []string{"id"}}, Data: map[string]interface{}{"id": 1}}
+		d, ok := partitionHash("person", fromShape)
+		So(ok, ShouldBeTrue)
+		So(d, ShouldEqual, a)
+
+		_, ok = partitionHash("person", dp(nil, map[string]interface{}{"id": 1}))
+		So(ok, ShouldBeFalse)
+		_, ok = partitionHash("person", dp([]string{"id"}, map[string]interface{}{}))
+		So(ok, ShouldBeFalse)
+	})
+}
+
+// echoSubscriber answers each data point with its shape name, and records
+// the most calls it was in at once.
+type echoSubscriber struct {
+	mockSubscriber
+	mu      sync.Mutex
+	current int
+	most    int
+}
+
+func (s *echoSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	s.mu.Lock()
+	s.current++
+	if s.current > s.most {
+		s.most = s.current
+	}
+	s.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	s.mu.Lock()
+	s.current--
+	s.mu.Unlock()
+
+	return protocol.ReceiveShapeResponse{Success: true, Message: request.ShapeName}, nil
+}
+
+func Test_subscriberProxy_Concurrent(t *testing.T) {
+
+	Convey("should be safe to share between goroutines", t, func() {
+		handler := &echoSubscriber{}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		sut := f.connect(WithMaxInFlight(4))
+
+		var wg sync.WaitGroup
+		mismatches := make(chan string, 100)
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				shape := "shape-" + strconv.Itoa(i)
+				resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: shape})
+				if err != nil || resp.Message != shape {
+					mismatches <- shape
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(mismatches)
+
+		So(len(mismatches), ShouldEqual, 0)
+		handler.mu.Lock()
+		defer handler.mu.Unlock()
+		So(handler.most, ShouldBeGreaterThan, 1)
+		So(handler.most, ShouldBeLessThanOrEqualTo, 4)
+	})
+}
+
+type routingSubscriber struct {
+	mockSubscriber
+	upserted  []pipeline.DataPoint
+	deleted   []pipeline.DataPoint
+	truncated []string
+}
+
+func (s *routingSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	return router.Route(context.Background(), request, s)
+}
+
+func (s *routingSubscriber) Upsert(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	s.upserted = append(s.upserted, request.DataPoint)
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func (s *routingSubscriber) Delete(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	s.deleted = append(s.deleted, request.DataPoint)
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func (s *routingSubscriber) TruncateShape(request protocol.TruncateShapeRequest) (protocol.TruncateShapeResponse, error) {
+	s.truncated = append(s.truncated, request.ShapeName)
+	return protocol.TruncateShapeResponse{Success: true}, nil
+}
+
+func Test_subscriberProxy_Operations(t *testing.T) {
+
+	Convey("should route data points by operation and truncate shapes", t, func() {
+		handler := &routingSubscriber{}
+		f := serveSubscriber(handler)
+		defer f.close()
+
+		sut := f.proxy
+
+		upsert := pipeline.DataPoint{Action: "insert", KeyNames: []string{"id"}, Data: map[string]interface{}{"id": 1.0, "name": "a"}}
+		tombstone := pipeline.DataPoint{Action: pipeline.DataPointDelete, KeyNames: []string{"id"}, Data: map[string]interface{}{"id": 1.0}}
+
+		resp, err := sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person", DataPoint: upsert})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+
+		resp, err = sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person", DataPoint: tombstone})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+
+		resp, err = sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person", DataPoint: pipeline.DataPoint{Action: pipeline.DataPointDelete}})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+
+		resp, err = sut.ReceiveDataPoint(protocol.ReceiveShapeRequest{ShapeName: "person", DataPoint: upsert, Operation: "merge"})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+		So(resp.Message, ShouldEqual, `unsupported operation "merge"`)
+
+		So(handler.upserted, ShouldResemble, []pipeline.DataPoint{upsert})
+		So(handler.deleted, ShouldResemble, []pipeline.DataPoint{tombstone})
+
+		truncated, err := sut.TruncateShape(protocol.TruncateShapeRequest{ShapeName: "person"})
+		So(err, ShouldBeNil)
+		So(truncated.Success, ShouldBeTrue)
+		So(handler.truncated, ShouldResemble, []string{"person"})
+	})
+
+	Convey("should refuse to truncate a shape for a subscriber which can't", t, func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:54321")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		sut, err := NewSubscriber(conn)
+		So(err, ShouldBeNil)
+
+		resp, err := sut.TruncateShape(protocol.TruncateShapeRequest{ShapeName: "person"})
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+	})
+}
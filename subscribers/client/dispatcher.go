@@ -0,0 +1,255 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+)
+
+// ErrDispatcherClosed is returned by Dispatch after Close is called.
+var ErrDispatcherClosed = errors.New("dispatcher closed")
+
+// dispatchQueueSize is the number of data points which can wait for each connection
+// before Dispatch blocks.
+const dispatchQueueSize = 100
+
+// DispatchResult is the outcome of delivering a dispatched data point.
+type DispatchResult struct {
+	Request  protocol.ReceiveShapeRequest
+	Response protocol.ReceiveShapeResponse
+	Err      error
+	// Connection is the index of the connection the data point was sent over.
+	Connection int
+}
+
+// Receiver is the part of a subscriber a Dispatcher sends data points to.
+// A SubscriberProxy, a RetryingSubscriber and a deadletter.DeadLetterer are all one.
+type Receiver interface {
+	ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+}
+
+// ReceiverFactory opens the i'th of a Dispatcher's connections. It returns
+// the Receiver the connection's data points are sent to, and the Closer which
+// closes the connection when the Dispatcher is closed; the Closer may be nil.
+type ReceiverFactory func(i int) (Receiver, io.Closer, error)
+
+// DialReceivers returns a ReceiverFactory which opens each connection with
+// dial and sends its data points to a SubscriberProxy configured with opts.
+func DialReceivers(dial func() (io.ReadWriteCloser, error), opts ...Option) ReceiverFactory {
+	return func(i int) (Receiver, io.Closer, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, nil, err
+		}
+		subscriber, err := NewSubscriber(conn, opts...)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		return subscriber, conn, nil
+	}
+}
+
+// Dispatcher delivers data points to a subscriber over several connections
+// at once. Each data point is sent over the connection picked by a hash of its
+// shape and key values, so data points with the same key are delivered in the
+// order they're dispatched while data points with different keys are delivered
+// in parallel. Data points without key values have no order to keep, and are
+// spread across the connections in turn.
+//
+// Data points with a SessionID and a Sequence are the exception: each session's
+// are sent over the connection picked by a hash of its SessionID, so they arrive
+// in the order they're numbered. Otherwise a slow connection could hold some of
+// them back until the subscriber's server.Deduplicate had given up on them, and
+// they'd be dropped. Sessions are still delivered in parallel with each other.
+//
+// A data point which fails to be delivered doesn't hold up the ones after it,
+// even if they have the same key; the result handler decides what to do about it.
+// Init and Dispose aren't sent over the dispatcher's connections, and should be
+// called on a proxy of their own.
+type Dispatcher struct {
+	opts     options
+	onResult func(DispatchResult)
+
+	conns      []io.Closer
+	partitions []chan protocol.ReceiveShapeRequest
+	workers    sync.WaitGroup
+	pending    sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+
+	// next is the connection to send the next data point without key values over.
+	nextMu sync.Mutex
+	next   int
+}
+
+// NewDispatcher returns a Dispatcher which opens connections connections to
+// a subscriber with factory, so each connection's Receiver can wrap its proxy
+// in a RetryingSubscriber or a deadletter.DeadLetterer; use DialReceivers to
+// send to plain proxies. It calls onResult, if it isn't nil, with the outcome
+// of delivering each data point; it may be called from several goroutines at
+// once. Without it, failures are logged.
+func NewDispatcher(factory ReceiverFactory, connections int, onResult func(DispatchResult), opts ...Option) (*Dispatcher, error) {
+	if connections < 1 {
+		connections = 1
+	}
+
+	d := &Dispatcher{
+		opts:     applyOptions(opts),
+		onResult: onResult,
+	}
+	if d.onResult == nil {
+		d.onResult = d.logFailure
+	}
+
+	receivers := make([]Receiver, 0, connections)
+	for i := 0; i < connections; i++ {
+		receiver, conn, err := factory(i)
+		if err != nil {
+			d.closeConns()
+			return nil, fmt.Errorf("couldn't open connection %d: %s", i, err)
+		}
+		if conn != nil {
+			d.conns = append(d.conns, conn)
+		}
+		receivers = append(receivers, receiver)
+	}
+
+	for i, receiver := range receivers {
+		requests := make(chan protocol.ReceiveShapeRequest, dispatchQueueSize)
+		d.partitions = append(d.partitions, requests)
+		d.workers.Add(1)
+		go d.deliver(i, receiver, requests)
+	}
+
+	return d, nil
+}
+
+// deliver sends the data points dispatched to the i'th connection, in order.
+func (d *Dispatcher) deliver(i int, receiver Receiver, requests <-chan protocol.ReceiveShapeRequest) {
+	defer d.workers.Done()
+
+	for request := range requests {
+		resp, err := receiver.ReceiveDataPoint(request)
+		d.onResult(DispatchResult{
+			Request:    request,
+			Response:   resp,
+			Err:        err,
+			Connection: i,
+		})
+		d.pending.Done()
+	}
+}
+
+func (d *Dispatcher) logFailure(result DispatchResult) {
+	if result.Err != nil || !result.Response.Success {
+		d.opts.logger.Warn("Couldn't deliver data point", "shape", result.Request.ShapeName, "connection", result.Connection, "error", result.Err, "message", result.Response.Message)
+	}
+}
+
+// Dispatch queues a data point for delivery over its connection. It blocks
+// while the connection's queue is full.
+func (d *Dispatcher) Dispatch(request protocol.ReceiveShapeRequest) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrDispatcherClosed
+	}
+
+	var i int
+	if request.SessionID != "" && request.Sequence != 0 {
+		i = int(sessionHash(request.SessionID) % uint32(len(d.partitions)))
+	} else if hash, ok := partitionHash(request.ShapeName, request.DataPoint); ok {
+		i = int(hash % uint32(len(d.partitions)))
+	} else {
+		i = d.roundRobin()
+	}
+
+	d.pending.Add(1)
+	d.partitions[i] <- request
+	return nil
+}
+
+// roundRobin returns the connection to send a data point without key values over.
+func (d *Dispatcher) roundRobin() int {
+	d.nextMu.Lock()
+	defer d.nextMu.Unlock()
+	i := d.next % len(d.partitions)
+	d.next++
+	return i
+}
+
+// Flush waits until every data point dispatched so far has been delivered.
+// It must not be called at the same time as Dispatch.
+func (d *Dispatcher) Flush() {
+	d.pending.Wait()
+}
+
+// Close delivers the data points already dispatched, then closes the connections.
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for _, requests := range d.partitions {
+		close(requests)
+	}
+	d.mu.Unlock()
+
+	d.workers.Wait()
+	return d.closeConns()
+}
+
+func (d *Dispatcher) closeConns() error {
+	var err error
+	for _, conn := range d.conns {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// sessionHash returns a hash of a session ID.
+func sessionHash(sessionID string) uint32 {
+	h := fnv.New32a()
+	io.WriteString(h, sessionID)
+	return h.Sum32()
+}
+
+// partitionHash returns a hash of the shape and key values of dp, and false
+// if dp has no key values. The key names are taken from dp, or from its Shape
+// if it has none.
+func partitionHash(shapeName string, dp pipeline.DataPoint) (uint32, bool) {
+	keyNames := dp.KeyNames
+	if len(keyNames) == 0 {
+		keyNames = dp.Shape.KeyNames
+	}
+	if len(keyNames) == 0 {
+		return 0, false
+	}
+
+	names := append([]string(nil), keyNames...)
+	sort.Strings(names)
+
+	h := fnv.New32a()
+	io.WriteString(h, shapeName)
+	for _, name := range names {
+		v, ok := dp.Data[name]
+		if !ok || v == nil {
+			return 0, false
+		}
+		fmt.Fprintf(h, "\x00%s=%v", name, v)
+	}
+	return h.Sum32(), true
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/naveego/navigator-go/logging"
+)
+
+// Option configures a subscriber proxy or a RetryingSubscriber.
+type Option func(*options)
+
+type options struct {
+	logger      logging.Logger
+	maxInFlight int
+
+	maxAttempts      int
+	initialBackoff   time.Duration
+	maxBackoff       time.Duration
+	jitter           float64
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	reconnect        func() (SubscriberProxy, error)
+}
+
+func defaultOptions() options {
+	return options{
+		logger:           logging.Default(),
+		maxAttempts:      5,
+		initialBackoff:   100 * time.Millisecond,
+		maxBackoff:       10 * time.Second,
+		jitter:           0.2,
+		breakerThreshold: 10,
+		breakerCooldown:  30 * time.Second,
+	}
+}
+
+func applyOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger used by the proxy or RetryingSubscriber.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = logging.Nop()
+		}
+		o.logger = logger
+	}
+}
+
+// WithMaxInFlight sets the number of calls a proxy sends over its connection at
+// once. Calls beyond it wait their turn in the order they were made. The default,
+// 0, means there's no limit.
+func WithMaxInFlight(calls int) Option {
+	return func(o *options) {
+		o.maxInFlight = calls
+	}
+}
+
+// WithMaxAttempts sets the number of times a RetryingSubscriber sends a data
+// point before giving up, including the first. The default is 5.
+func WithMaxAttempts(attempts int) Option {
+	return func(o *options) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		o.maxAttempts = attempts
+	}
+}
+
+// WithBackoff sets how long a RetryingSubscriber waits before sending a data
+// point again. It waits initial before the first retry, and doubles the wait
+// before each retry after that up to max. The defaults are 100ms and 10s.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(o *options) {
+		if max < initial {
+			max = initial
+		}
+		o.initialBackoff = initial
+		o.maxBackoff = max
+	}
+}
+
+// WithJitter sets the fraction by which a RetryingSubscriber randomly varies
+// each wait, so that many hosts retrying at once don't retry in step. A jitter
+// of 0.2, the default, makes a wait of 1s anywhere from 0.8s to 1.2s.
+func WithJitter(fraction float64) Option {
+	return func(o *options) {
+		if fraction < 0 {
+			fraction = 0
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		o.jitter = fraction
+	}
+}
+
+// WithCircuitBreaker sets how many attempts in a row must fail before a
+// RetryingSubscriber stops sending data points, and how long it waits before
+// trying again. The defaults are 10 failures and 30s. A threshold of 0
+// disables the circuit breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.breakerThreshold = threshold
+		o.breakerCooldown = cooldown
+	}
+}
+
+// WithReconnect sets a function a RetryingSubscriber calls to replace its
+// subscriber proxy after a transport error, such as when the connection drops.
+// The function is responsible for anything the new connection needs before it
+// can receive data points. Without it, retries use the same proxy, and data
+// points aren't retried once its connection has closed.
+func WithReconnect(reconnect func() (SubscriberProxy, error)) Option {
+	return func(o *options) {
+		o.reconnect = reconnect
+	}
+}
+
+// remoteAddr returns the remote address of conn if it has one.
+func remoteAddr(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(net.Conn); ok && c.RemoteAddr() != nil {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
@@ -0,0 +1,248 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/naveego/navigator-go/subscribers/protocol"
+)
+
+// ErrCircuitOpen is returned by a RetryingSubscriber while its circuit
+// breaker is open, without the data point being sent.
+var ErrCircuitOpen = errors.New("circuit breaker open: subscriber is failing")
+
+// RetryingSubscriber is a SubscriberProxy which sends a data point again
+// when the call fails with a transport error, such as a dropped connection,
+// or the subscriber refuses it with a Retryable response. A closed connection
+// is only retried if it can reconnect; see WithReconnect. It waits with
+// exponential backoff and jitter between attempts, and gives up after the
+// maximum number of attempts, returning the last response and error.
+//
+// Its circuit breaker opens when too many attempts in a row fail, after which
+// ReceiveDataPoint returns ErrCircuitOpen without calling the subscriber until
+// the cooldown has passed. The next call is then let through, closing the
+// circuit if it succeeds and opening it again if it fails.
+//
+// Retried requests are sent unchanged, so a subscriber deduplicating by
+// Sequence recognises a data point which arrived the first time even though
+// its response didn't. Calls other than ReceiveDataPoint are passed to the
+// current proxy without being retried. Like the proxies it wraps, it's safe
+// for concurrent use.
+type RetryingSubscriber struct {
+	opts    options
+	breaker *breaker
+
+	mu         sync.Mutex
+	subscriber SubscriberProxy
+}
+
+// NewRetryingSubscriber returns a RetryingSubscriber which sends data points to subscriber.
+func NewRetryingSubscriber(subscriber SubscriberProxy, opts ...Option) *RetryingSubscriber {
+	o := applyOptions(opts)
+	return &RetryingSubscriber{
+		opts:       o,
+		breaker:    newBreaker(o.breakerThreshold, o.breakerCooldown),
+		subscriber: subscriber,
+	}
+}
+
+// current returns the proxy calls are sent to.
+func (r *RetryingSubscriber) current() SubscriberProxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subscriber
+}
+
+// reconnect replaces failed, the proxy whose call failed with a transport error,
+// unless it has already been replaced.
+func (r *RetryingSubscriber) reconnect(failed SubscriberProxy) {
+	if r.opts.reconnect == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.subscriber != failed {
+		return
+	}
+	subscriber, err := r.opts.reconnect()
+	if err != nil {
+		r.opts.logger.Warn("Couldn't reconnect to subscriber", "error", err)
+		return
+	}
+	r.opts.logger.Info("Reconnected to subscriber")
+	r.subscriber = subscriber
+}
+
+// CircuitOpen reports whether the circuit breaker is open.
+func (r *RetryingSubscriber) CircuitOpen() bool {
+	return r.breaker.open()
+}
+
+func (r *RetryingSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (resp protocol.ReceiveShapeResponse, err error) {
+	for attempt := 1; ; attempt++ {
+		if !r.breaker.allow() {
+			return protocol.ReceiveShapeResponse{}, ErrCircuitOpen
+		}
+
+		subscriber := r.current()
+		resp, err = subscriber.ReceiveDataPoint(request)
+
+		var retry bool
+		switch {
+		case err != nil && isTransportError(err):
+			retry = r.opts.reconnect != nil || !isConnectionClosed(err)
+			r.reconnect(subscriber)
+		case err == nil && !resp.Success && resp.Retryable:
+			retry = true
+		}
+
+		if !retry && !isTransportError(err) {
+			r.breaker.succeeded()
+			return resp, err
+		}
+		r.breaker.failed()
+		if !retry {
+			r.opts.logger.Warn("Giving up on data point: the connection is closed and there's no way to reconnect", "shape", request.ShapeName, "error", err)
+			return resp, err
+		}
+
+		if attempt >= r.opts.maxAttempts {
+			r.opts.logger.Warn("Giving up on data point", "shape", request.ShapeName, "attempts", attempt, "error", err, "message", resp.Message)
+			return resp, err
+		}
+
+		wait := r.backoff(attempt)
+		r.opts.logger.Debug("Retrying data point", "shape", request.ShapeName, "attempt", attempt, "wait", wait, "error", err, "message", resp.Message)
+		time.Sleep(wait)
+	}
+}
+
+// backoff returns how long to wait after the attempt'th attempt fails.
+func (r *RetryingSubscriber) backoff(attempt int) time.Duration {
+	wait := float64(r.opts.initialBackoff) * math.Pow(2, float64(attempt-1))
+	if max := float64(r.opts.maxBackoff); wait > max {
+		wait = max
+	}
+	wait += wait * r.opts.jitter * (2*rand.Float64() - 1)
+	return time.Duration(wait)
+}
+
+// isTransportError reports whether err means the call didn't reach the
+// subscriber or its response didn't come back, rather than that the
+// subscriber returned an error.
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(rpc.ServerError)
+	return !ok
+}
+
+// isConnectionClosed reports whether err means the proxy's connection is gone,
+// so that every later call through it will fail too.
+func isConnectionClosed(err error) bool {
+	return err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF
+}
+
+func (r *RetryingSubscriber) TestConnection(request protocol.TestConnectionRequest) (protocol.TestConnectionResponse, error) {
+	return r.current().TestConnection(request)
+}
+
+func (r *RetryingSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
+	return r.current().Init(request)
+}
+
+func (r *RetryingSubscriber) Dispose(request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
+	return r.current().Dispose(request)
+}
+
+func (r *RetryingSubscriber) DiscoverShapes(request protocol.DiscoverShapesRequest) (protocol.DiscoverShapesResponse, error) {
+	return r.current().DiscoverShapes(request)
+}
+
+func (r *RetryingSubscriber) SettingsSchema(request protocol.SettingsSchemaRequest) (protocol.SettingsSchemaResponse, error) {
+	return r.current().SettingsSchema(request)
+}
+
+func (r *RetryingSubscriber) TruncateShape(request protocol.TruncateShapeRequest) (protocol.TruncateShapeResponse, error) {
+	return r.current().TruncateShape(request)
+}
+
+func (r *RetryingSubscriber) BeginBatch(request protocol.BeginBatchRequest) (protocol.BeginBatchResponse, error) {
+	return r.current().BeginBatch(request)
+}
+
+func (r *RetryingSubscriber) CommitBatch(request protocol.CommitBatchRequest) (protocol.CommitBatchResponse, error) {
+	return r.current().CommitBatch(request)
+}
+
+func (r *RetryingSubscriber) AbortBatch(request protocol.AbortBatchRequest) (protocol.AbortBatchResponse, error) {
+	return r.current().AbortBatch(request)
+}
+
+// breaker is a circuit breaker which opens after threshold failures in a row,
+// and lets a call through to test the subscriber once cooldown has passed.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a call may be made. Once the cooldown has passed it
+// lets one call through and holds back the rest until that call's outcome is
+// recorded.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	// Restart the cooldown, so only this call is let through.
+	b.openedAt = b.now()
+	return true
+}
+
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+func (b *breaker) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openedAt = time.Time{}
+}
+
+func (b *breaker) failed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
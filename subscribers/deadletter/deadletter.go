@@ -0,0 +1,170 @@
+// Package deadletter captures the data points a subscriber rejects, so they
+// aren't lost when delivery carries on without them, and replays them once
+// the subscriber has been fixed.
+package deadletter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/naveego/navigator-go/subscribers/client"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+)
+
+// Letter is a data point a subscriber rejected, with why.
+type Letter struct {
+	// Time is when the data point was rejected.
+	Time time.Time `json:"time"`
+	// Request is the rejected request, including its metadata.
+	Request protocol.ReceiveShapeRequest `json:"request"`
+	// Response is the subscriber's response, if it sent one.
+	Response *protocol.ReceiveShapeResponse `json:"response,omitempty"`
+	// Error is the error the call returned, or the response's message
+	// if the call succeeded but the subscriber refused the data point.
+	Error string `json:"error"`
+}
+
+// Sink is where rejected data points are put.
+type Sink interface {
+	Put(letter Letter) error
+}
+
+// MemorySink is a Sink which keeps letters in memory.
+// It's safe for concurrent use.
+type MemorySink struct {
+	mu      sync.Mutex
+	letters []Letter
+}
+
+// NewMemorySink returns an empty MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (m *MemorySink) Put(letter Letter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, letter)
+	return nil
+}
+
+// Letters returns the letters put in the sink, in order.
+func (m *MemorySink) Letters() []Letter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Letter(nil), m.letters...)
+}
+
+// Receiver is the part of a subscriber which receives data points.
+// A client.SubscriberProxy is one.
+type Receiver interface {
+	ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+}
+
+// SinkError is returned when a rejected data point couldn't be put in the sink.
+type SinkError struct {
+	Letter Letter
+	Err    error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("couldn't dead-letter data point rejected with %q: %s", e.Letter.Error, e.Err)
+}
+
+// DeadLetterer is a Receiver which puts the data points its subscriber
+// rejects in a sink. A data point is rejected if the call returns an error
+// or the response isn't successful.
+type DeadLetterer struct {
+	subscriber Receiver
+	sink       Sink
+
+	mu       sync.Mutex
+	rejected int
+}
+
+// New returns a DeadLetterer which sends data points to subscriber
+// and puts the ones it rejects in sink.
+func New(subscriber Receiver, sink Sink) *DeadLetterer {
+	return &DeadLetterer{
+		subscriber: subscriber,
+		sink:       sink,
+	}
+}
+
+// ReceiveDataPoint sends the data point to the subscriber. If it's rejected
+// it's put in the sink, and the subscriber's response and error are returned
+// as usual so the caller can decide whether to carry on. If it can't be put in
+// the sink a *SinkError is returned instead.
+//
+// The subscriber can be a client.Batcher, in which case every data point of
+// a batch it aborts is put in the sink.
+func (d *DeadLetterer) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	resp, err := d.subscriber.ReceiveDataPoint(request)
+	if batchErr, ok := err.(*client.BatchError); ok {
+		if putErr := d.PutBatch(batchErr); putErr != nil {
+			return resp, putErr
+		}
+		return resp, err
+	}
+
+	letter, rejected := reject(request, resp, err)
+	if !rejected {
+		return resp, nil
+	}
+
+	d.mu.Lock()
+	d.rejected++
+	d.mu.Unlock()
+
+	if putErr := d.sink.Put(letter); putErr != nil {
+		return resp, &SinkError{Letter: letter, Err: putErr}
+	}
+	return resp, err
+}
+
+// PutBatch puts every data point of an aborted batch in the sink,
+// such as when the batch fails to commit.
+func (d *DeadLetterer) PutBatch(batchErr *client.BatchError) error {
+	d.mu.Lock()
+	d.rejected += len(batchErr.Requests)
+	d.mu.Unlock()
+
+	for _, request := range batchErr.Requests {
+		letter := Letter{
+			Time:    time.Now().UTC(),
+			Request: request,
+			Error:   batchErr.Error(),
+		}
+		if err := d.sink.Put(letter); err != nil {
+			return &SinkError{Letter: letter, Err: err}
+		}
+	}
+	return nil
+}
+
+// Rejected returns the number of data points the subscriber has rejected.
+func (d *DeadLetterer) Rejected() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rejected
+}
+
+// reject returns the letter for a request the subscriber responded to with
+// resp and err, and whether it was rejected.
+func reject(request protocol.ReceiveShapeRequest, resp protocol.ReceiveShapeResponse, err error) (Letter, bool) {
+	letter := Letter{
+		Time:    time.Now().UTC(),
+		Request: request,
+	}
+	switch {
+	case err != nil:
+		letter.Error = err.Error()
+	case !resp.Success:
+		letter.Response = &resp
+		letter.Error = resp.Message
+	default:
+		return letter, false
+	}
+	return letter, true
+}
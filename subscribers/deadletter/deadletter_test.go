@@ -0,0 +1,196 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/metadata"
+	"github.com/naveego/navigator-go/subscribers/client"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/navigator-go/subscribers/sequence"
+	"github.com/naveego/navigator-go/subscribers/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// pickySubscriber rejects the data points whose id it's told to.
+type pickySubscriber struct {
+	refuse   map[interface{}]bool
+	fail     map[interface{}]bool
+	received []protocol.ReceiveShapeRequest
+}
+
+func (s *pickySubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	id := request.DataPoint.Data["id"]
+	if s.fail[id] {
+		return protocol.ReceiveShapeResponse{}, errors.New("connection reset")
+	}
+	if s.refuse[id] {
+		return protocol.ReceiveShapeResponse{Success: false, Message: "refused"}, nil
+	}
+	s.received = append(s.received, request)
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func request(id string) protocol.ReceiveShapeRequest {
+	return protocol.ReceiveShapeRequest{
+		ShapeName: "person",
+		DataPoint: pipeline.DataPoint{Data: map[string]interface{}{"id": id}},
+	}
+}
+
+func TestDeadLetterer(t *testing.T) {
+
+	Convey("should put rejected data points in the sink", t, func() {
+		subscriber := &pickySubscriber{
+			refuse: map[interface{}]bool{"2": true},
+			fail:   map[interface{}]bool{"3": true},
+		}
+		sink := NewMemorySink()
+		sut := New(subscriber, sink)
+
+		resp, err := sut.ReceiveDataPoint(request("1"))
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeTrue)
+
+		resp, err = sut.ReceiveDataPoint(request("2"))
+		So(err, ShouldBeNil)
+		So(resp.Success, ShouldBeFalse)
+
+		_, err = sut.ReceiveDataPoint(request("3"))
+		So(err, ShouldNotBeNil)
+
+		So(sut.Rejected(), ShouldEqual, 2)
+
+		letters := sink.Letters()
+		So(letters, ShouldHaveLength, 2)
+		So(letters[0].Request.DataPoint.Data["id"], ShouldEqual, "2")
+		So(letters[0].Error, ShouldEqual, "refused")
+		So(letters[0].Response, ShouldNotBeNil)
+		So(letters[1].Request.DataPoint.Data["id"], ShouldEqual, "3")
+		So(letters[1].Error, ShouldEqual, "connection reset")
+		So(letters[1].Response, ShouldBeNil)
+	})
+}
+
+// abortingBatcher aborts every batch, like a client.Batcher whose subscriber refuses a data point.
+type abortingBatcher struct {
+	pending []protocol.ReceiveShapeRequest
+}
+
+func (b *abortingBatcher) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	b.pending = append(b.pending, request)
+	if len(b.pending) < 2 {
+		return protocol.ReceiveShapeResponse{Success: true}, nil
+	}
+	err := &client.BatchError{BatchID: "b1", Reason: "refused", Requests: b.pending}
+	b.pending = nil
+	return protocol.ReceiveShapeResponse{Success: false, Message: "refused"}, err
+}
+
+func TestDeadLetterer_Batches(t *testing.T) {
+
+	Convey("should put every data point of an aborted batch in the sink", t, func() {
+		sink := NewMemorySink()
+		sut := New(&abortingBatcher{}, sink)
+
+		_, err := sut.ReceiveDataPoint(request("1"))
+		So(err, ShouldBeNil)
+		_, err = sut.ReceiveDataPoint(request("2"))
+		So(err, ShouldHaveSameTypeAs, &client.BatchError{})
+
+		So(sut.Rejected(), ShouldEqual, 2)
+		letters := sink.Letters()
+		So(letters, ShouldHaveLength, 2)
+		So(letters[0].Request.DataPoint.Data["id"], ShouldEqual, "1")
+		So(letters[1].Error, ShouldContainSubstring, "batch b1")
+	})
+}
+
+func TestFileSink(t *testing.T) {
+
+	Convey("should round-trip letters through a file", t, func() {
+		dir, err := ioutil.TempDir("", "deadletter")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "letters.ndjson")
+
+		deadline := time.Now().Add(time.Minute)
+		letter := Letter{
+			Time:    time.Now().UTC().Truncate(time.Second),
+			Request: request("1"),
+			Error:   "refused",
+		}
+		letter.Request.Metadata = metadata.Metadata{RequestID: "r1", Deadline: &deadline}
+
+		sink, err := NewFileSink(path)
+		So(err, ShouldBeNil)
+		So(sink.Put(letter), ShouldBeNil)
+		So(sink.Put(Letter{Request: request("2"), Error: "refused"}), ShouldBeNil)
+		So(sink.Close(), ShouldBeNil)
+
+		letters, err := ReadFile(path)
+		So(err, ShouldBeNil)
+		So(letters, ShouldHaveLength, 2)
+		So(letters[0].Time.Equal(letter.Time), ShouldBeTrue)
+		So(letters[0].Request.Metadata.RequestID, ShouldEqual, "r1")
+		So(letters[0].Request.DataPoint.Data["id"], ShouldEqual, "1")
+		So(letters[1].Request.DataPoint.Data["id"], ShouldEqual, "2")
+
+		Convey("and replay them once the subscriber is fixed", func() {
+			subscriber := &pickySubscriber{refuse: map[interface{}]bool{"2": true}}
+			again := NewMemorySink()
+
+			result, err := Replay(subscriber, letters, again)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, ReplayResult{Delivered: 1, Rejected: 1})
+
+			So(subscriber.received, ShouldHaveLength, 1)
+			So(subscriber.received[0].Metadata.RequestID, ShouldEqual, "r1")
+			So(subscriber.received[0].Metadata.Deadline, ShouldBeNil)
+			So(again.Letters(), ShouldHaveLength, 1)
+			So(again.Letters()[0].Request.DataPoint.Data["id"], ShouldEqual, "2")
+		})
+	})
+}
+
+// receiveFunc is a Receiver which calls a server.ReceiveFunc, so middleware
+// can be tested without a server.
+type receiveFunc server.ReceiveFunc
+
+func (f receiveFunc) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	return f(context.Background(), request)
+}
+
+func TestReplay_Deduplicate(t *testing.T) {
+
+	Convey("should replay data points a deduplicating subscriber has received later ones of", t, func() {
+		subscriber := &pickySubscriber{refuse: map[interface{}]bool{"2": true}}
+		sink := NewMemorySink()
+		dedup := receiveFunc(server.Deduplicate(sequence.NewMemoryStore(), nil)(
+			func(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+				return subscriber.ReceiveDataPoint(request)
+			}))
+		sut := New(dedup, sink)
+
+		for i, id := range []string{"1", "2", "3"} {
+			r := request(id)
+			r.SessionID = "s1"
+			r.Sequence = int64(i + 1)
+			sut.ReceiveDataPoint(r)
+		}
+		So(sink.Letters(), ShouldHaveLength, 1)
+
+		subscriber.refuse = nil
+		result, err := Replay(dedup, sink.Letters(), nil)
+		So(err, ShouldBeNil)
+		So(result, ShouldResemble, ReplayResult{Delivered: 1})
+		So(subscriber.received, ShouldHaveLength, 3)
+		So(subscriber.received[2].DataPoint.Data["id"], ShouldEqual, "2")
+	})
+}
@@ -0,0 +1,74 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileSink is a Sink which appends letters to a file as newline-delimited JSON,
+// one letter per line. It's safe for concurrent use within a process.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink returns a FileSink which appends to the file at path,
+// creating it if necessary.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (f *FileSink) Put(letter Letter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Each letter is written with a single call, so a crash never
+	// leaves more than the last line partial.
+	if _, err = f.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Close closes the file.
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// ReadFile returns the letters in a file written by a FileSink, in order.
+func ReadFile(path string) ([]Letter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []Letter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var letter Letter
+		if err := json.Unmarshal(line, &letter); err != nil {
+			return letters, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
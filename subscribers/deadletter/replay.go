@@ -0,0 +1,51 @@
+package deadletter
+
+// ReplayResult counts the letters Replay sent.
+type ReplayResult struct {
+	// Delivered is the number of letters the subscriber accepted.
+	Delivered int `json:"delivered"`
+	// Rejected is the number of letters the subscriber rejected again.
+	Rejected int `json:"rejected"`
+	// Duplicate is the number of letters the subscriber answered as
+	// already received, without receiving them again.
+	Duplicate int `json:"duplicate"`
+}
+
+// Replay sends the request of each letter to subscriber again, in order.
+// Deadlines in the requests' metadata are dropped, since they will have
+// passed, and so are batch IDs, since their batches were aborted. Sequence
+// numbers are dropped too: the subscriber will usually have received later
+// data points of the session since, so a deduplicating subscriber would
+// otherwise answer the replayed ones as duplicates without receiving them. Letters
+// which are rejected again are put in sink, if it isn't nil, with the new
+// error. Replay stops early only if sink returns an error.
+func Replay(subscriber Receiver, letters []Letter, sink Sink) (ReplayResult, error) {
+	var result ReplayResult
+
+	for _, l := range letters {
+		request := l.Request
+		request.Metadata.Deadline = nil
+		request.BatchID = ""
+		request.Sequence = 0
+
+		resp, err := subscriber.ReceiveDataPoint(request)
+		letter, rejected := reject(request, resp, err)
+		if !rejected {
+			if resp.Duplicate {
+				result.Duplicate++
+			} else {
+				result.Delivered++
+			}
+			continue
+		}
+
+		result.Rejected++
+		if sink != nil {
+			if err := sink.Put(letter); err != nil {
+				return result, &SinkError{Letter: letter, Err: err}
+			}
+		}
+	}
+
+	return result, nil
+}
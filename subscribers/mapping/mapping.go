@@ -0,0 +1,187 @@
+// Package mapping applies the shape mappings a subscriber receives in its
+// InitRequest to the data points it's sent, renaming their properties,
+// converting their values and picking the shapes they're written to.
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/shapes"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+)
+
+// ErrNoMapping is returned by Map for a data point whose shape isn't mapped.
+var ErrNoMapping = errors.New("no mapping for shape")
+
+// Mapper maps data points according to a set of shape mappings.
+// It's safe for concurrent use.
+type Mapper struct {
+	// mappings holds the mappings for each source shape, in the order they were given.
+	mappings map[string][]shapeMapping
+}
+
+type shapeMapping struct {
+	to         string
+	properties []propertyMapping
+	// bySource maps source property names to their mapping.
+	bySource map[string]propertyMapping
+}
+
+type propertyMapping struct {
+	from string
+	to   string
+	// typ is the type values are converted to, or empty to leave them as they are.
+	typ string
+}
+
+// New returns a Mapper for mappings, usually those of an InitRequest.
+// A source shape may be mapped to more than one target shape. Values are
+// converted with shapes.Convert. It returns an error if a mapping is missing
+// a shape or property name, or converts to a type it doesn't know.
+func New(mappings []pipeline.ShapeMapping) (*Mapper, error) {
+	m := &Mapper{mappings: make(map[string][]shapeMapping)}
+
+	for i, sm := range mappings {
+		if sm.From == "" {
+			return nil, fmt.Errorf("mapping %d: missing source shape", i)
+		}
+		to := sm.To
+		if to == "" {
+			to = sm.From
+		}
+
+		mapped := shapeMapping{
+			to:       to,
+			bySource: make(map[string]propertyMapping, len(sm.Properties)),
+		}
+		for _, pm := range sm.Properties {
+			if pm.From == "" {
+				return nil, fmt.Errorf("mapping %s to %s: property mapping missing source property", sm.From, to)
+			}
+			if pm.Type != "" && !shapes.KnownType(pm.Type) {
+				return nil, fmt.Errorf("mapping %s to %s: property %s: unknown type %q", sm.From, to, pm.From, pm.Type)
+			}
+			p := propertyMapping{from: pm.From, to: pm.To, typ: pm.Type}
+			if p.to == "" {
+				p.to = p.from
+			}
+			mapped.properties = append(mapped.properties, p)
+			mapped.bySource[p.from] = p
+		}
+
+		m.mappings[sm.From] = append(m.mappings[sm.From], mapped)
+	}
+
+	return m, nil
+}
+
+// NewFromInit returns a Mapper for the mappings in request.
+func NewFromInit(request protocol.InitRequest) (*Mapper, error) {
+	return New(request.Mappings)
+}
+
+// Result is a data point mapped to one target shape.
+type Result struct {
+	// ShapeName is the target shape.
+	ShapeName string
+	// DataPoint is the mapped data point. Its Entity is the target shape,
+	// its KeyNames are renamed, and its Data holds only the mapped properties.
+	DataPoint pipeline.DataPoint
+	// Unmapped lists the properties of the source data point which
+	// aren't mapped to the target shape, in order.
+	Unmapped []string
+	// Missing lists the mapped properties which the source data
+	// point doesn't have, in order. They're left out of Data.
+	Missing []string
+	// Errors lists the properties whose values couldn't be converted.
+	// They're left out of Data.
+	Errors []PropertyError
+}
+
+// PropertyError describes a value which couldn't be converted.
+type PropertyError struct {
+	// Property is the name of the source property.
+	Property string
+	Message  string
+}
+
+func (e PropertyError) Error() string {
+	return e.Property + ": " + e.Message
+}
+
+// Shapes returns the source shapes the Mapper has mappings for, in order.
+func (m *Mapper) Shapes() []string {
+	shapes := make([]string, 0, len(m.mappings))
+	for shape := range m.mappings {
+		shapes = append(shapes, shape)
+	}
+	sort.Strings(shapes)
+	return shapes
+}
+
+// Map maps dp, a data point of shapeName, to each of the target shapes it's
+// mapped to. If shapeName is empty the data point's Entity is used. It returns
+// ErrNoMapping if the shape isn't mapped.
+func (m *Mapper) Map(shapeName string, dp pipeline.DataPoint) ([]Result, error) {
+	if shapeName == "" {
+		shapeName = dp.Entity
+	}
+
+	mappings, ok := m.mappings[shapeName]
+	if !ok {
+		return nil, ErrNoMapping
+	}
+
+	results := make([]Result, len(mappings))
+	for i, sm := range mappings {
+		results[i] = sm.apply(dp)
+	}
+	return results, nil
+}
+
+// MapRequest maps the data point of a ReceiveShapeRequest.
+func (m *Mapper) MapRequest(request protocol.ReceiveShapeRequest) ([]Result, error) {
+	return m.Map(request.ShapeName, request.DataPoint)
+}
+
+func (sm shapeMapping) apply(dp pipeline.DataPoint) Result {
+	r := Result{ShapeName: sm.to}
+
+	data := make(map[string]interface{}, len(sm.properties))
+	for _, p := range sm.properties {
+		v, ok := dp.Data[p.from]
+		if !ok {
+			r.Missing = append(r.Missing, p.from)
+			continue
+		}
+		converted, err := shapes.Convert(p.typ, v)
+		if err != nil {
+			r.Errors = append(r.Errors, PropertyError{Property: p.from, Message: err.Error()})
+			continue
+		}
+		data[p.to] = converted
+	}
+
+	for name := range dp.Data {
+		if _, ok := sm.bySource[name]; !ok {
+			r.Unmapped = append(r.Unmapped, name)
+		}
+	}
+	sort.Strings(r.Unmapped)
+
+	var keyNames []string
+	for _, key := range dp.KeyNames {
+		if p, ok := sm.bySource[key]; ok {
+			keyNames = append(keyNames, p.to)
+		}
+	}
+
+	r.DataPoint = dp
+	r.DataPoint.Entity = sm.to
+	r.DataPoint.KeyNames = keyNames
+	r.DataPoint.Data = data
+	return r
+}
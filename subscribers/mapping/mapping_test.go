@@ -0,0 +1,110 @@
+package mapping
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMapper(t *testing.T) {
+
+	Convey("Given a mapper", t, func() {
+		sut, err := New([]pipeline.ShapeMapping{
+			{
+				From: "person",
+				To:   "contact",
+				Properties: []pipeline.PropertyMapping{
+					{From: "id", To: "ContactID", Type: "integer"},
+					{From: "name", To: "FullName"},
+					{From: "born", To: "BirthDate", Type: "date"},
+					{From: "active", To: "IsActive", Type: "boolean"},
+				},
+			},
+			{
+				From: "person",
+				To:   "audit",
+				Properties: []pipeline.PropertyMapping{
+					{From: "id", Type: "string"},
+				},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		dp := pipeline.DataPoint{
+			Entity:   "person",
+			KeyNames: []string{"id"},
+			Data: map[string]interface{}{
+				"id":     42.0,
+				"name":   "Jane",
+				"born":   "1980-02-03",
+				"active": "true",
+				"extra":  1,
+			},
+		}
+
+		Convey("should map the data point to each target shape", func() {
+			results, err := sut.Map("", dp)
+			So(err, ShouldBeNil)
+			So(results, ShouldHaveLength, 2)
+
+			contact := results[0]
+			So(contact.ShapeName, ShouldEqual, "contact")
+			So(contact.DataPoint.Entity, ShouldEqual, "contact")
+			So(contact.DataPoint.KeyNames, ShouldResemble, []string{"ContactID"})
+			So(contact.DataPoint.Data, ShouldResemble, map[string]interface{}{
+				"ContactID": int64(42),
+				"FullName":  "Jane",
+				"BirthDate": time.Date(1980, 2, 3, 0, 0, 0, 0, time.UTC),
+				"IsActive":  true,
+			})
+			So(contact.Unmapped, ShouldResemble, []string{"extra"})
+			So(contact.Missing, ShouldBeEmpty)
+			So(contact.Errors, ShouldBeEmpty)
+
+			audit := results[1]
+			So(audit.DataPoint.Data, ShouldResemble, map[string]interface{}{"id": "42"})
+			So(audit.DataPoint.KeyNames, ShouldResemble, []string{"id"})
+			So(audit.Unmapped, ShouldResemble, []string{"active", "born", "extra", "name"})
+		})
+
+		Convey("should report missing properties and conversion errors", func() {
+			dp.Data = map[string]interface{}{"id": 4.5, "name": "Jane"}
+
+			results, err := sut.Map("person", dp)
+			So(err, ShouldBeNil)
+
+			contact := results[0]
+			So(contact.DataPoint.Data, ShouldResemble, map[string]interface{}{"FullName": "Jane"})
+			So(contact.Missing, ShouldResemble, []string{"born", "active"})
+			So(contact.Errors, ShouldResemble, []PropertyError{
+				{Property: "id", Message: "4.5 is not a whole number"},
+			})
+		})
+
+		Convey("should not modify the source data point", func() {
+			_, err := sut.Map("", dp)
+			So(err, ShouldBeNil)
+			So(dp.Entity, ShouldEqual, "person")
+			So(dp.Data["id"], ShouldEqual, 42.0)
+		})
+
+		Convey("should return ErrNoMapping for an unmapped shape", func() {
+			_, err := sut.Map("order", dp)
+			So(err, ShouldEqual, ErrNoMapping)
+		})
+
+		Convey("should list the mapped shapes", func() {
+			So(sut.Shapes(), ShouldResemble, []string{"person"})
+		})
+	})
+
+	Convey("New should reject an unknown type", t, func() {
+		_, err := New([]pipeline.ShapeMapping{
+			{From: "person", Properties: []pipeline.PropertyMapping{{From: "id", Type: "uuid"}}},
+		})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, `unknown type "uuid"`)
+	})
+}
@@ -1,62 +1,171 @@
 package protocol
 
 import (
+	"context"
+
 	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/metadata"
+	"github.com/naveego/navigator-go/settings"
+	"github.com/naveego/navigator-go/shapes"
 )
 
 type InitializeSubscriberRequest struct {
+	Metadata metadata.Metadata      `json:"metadata"`
 	Settings map[string]interface{} `json:"settings"`
 }
 
 type DiscoverShapesRequest struct {
+	Metadata metadata.Metadata      `json:"metadata"`
 	Settings map[string]interface{} `json:"settings"`
 }
 
 type DiscoverShapesResponse struct {
-	Shapes pipeline.ShapeDefinitions `json:"shapes"`
+	Metadata metadata.Metadata         `json:"metadata"`
+	Shapes   pipeline.ShapeDefinitions `json:"shapes"`
+	// ValidationErrors lists the problems with the request's settings.
+	// If it's not empty the handler wasn't called.
+	ValidationErrors settings.ValidationErrors `json:"validationErrors,omitempty"`
 }
 
 type ShapeDiscoverer interface {
 	DiscoverShapes(request DiscoverShapesRequest) (DiscoverShapesResponse, error)
 }
 
+// ContextShapeDiscoverer is a ShapeDiscoverer which receives a context.
+// The wrapper prefers it over ShapeDiscoverer when a handler implements it.
+type ContextShapeDiscoverer interface {
+	DiscoverShapes(ctx context.Context, request DiscoverShapesRequest) (DiscoverShapesResponse, error)
+}
+
 type TestConnectionRequest struct {
+	Metadata metadata.Metadata      `json:"metadata"`
 	Settings map[string]interface{} `json:"settings"`
 }
 
 type TestConnectionResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Metadata metadata.Metadata `json:"metadata"`
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
+	// ValidationErrors lists the problems with the request's settings.
+	// If it's not empty the handler wasn't called.
+	ValidationErrors settings.ValidationErrors `json:"validationErrors,omitempty"`
 }
 
 type ConnectionTester interface {
 	TestConnection(request TestConnectionRequest) (TestConnectionResponse, error)
 }
 
+// ContextConnectionTester is a ConnectionTester which receives a context.
+// The wrapper prefers it over ConnectionTester when a handler implements it.
+type ContextConnectionTester interface {
+	TestConnection(ctx context.Context, request TestConnectionRequest) (TestConnectionResponse, error)
+}
+
 type InitRequest struct {
+	Metadata metadata.Metadata       `json:"metadata"`
 	Settings map[string]interface{}  `json:"settings"`
 	Mappings []pipeline.ShapeMapping `json:"mappings"`
 }
 
 type InitResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Metadata metadata.Metadata `json:"metadata"`
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
+	// ValidationErrors lists the problems with the request's settings.
+	// If it's not empty the handler wasn't called.
+	ValidationErrors settings.ValidationErrors `json:"validationErrors,omitempty"`
+}
+
+type SettingsSchemaRequest struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
+
+// SettingsSchemaResponse holds the schema of the settings of each operation
+// which takes them. A nil schema means the operation's settings aren't described
+// or validated.
+type SettingsSchemaResponse struct {
+	Metadata       metadata.Metadata `json:"metadata"`
+	Init           *settings.Schema  `json:"init,omitempty"`
+	TestConnection *settings.Schema  `json:"testConnection,omitempty"`
+	DiscoverShapes *settings.Schema  `json:"discoverShapes,omitempty"`
+}
+
+// SettingsSchemaProvider is implemented by handlers which describe their settings.
+// The wrapper validates the settings of each request against the schema before
+// calling the handler, and responds with the validation errors instead of calling
+// it if there are any.
+type SettingsSchemaProvider interface {
+	SettingsSchema(request SettingsSchemaRequest) (SettingsSchemaResponse, error)
 }
 
-type DisposeRequest struct{}
+type DisposeRequest struct {
+	Metadata metadata.Metadata `json:"metadata"`
+}
 type DisposeResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Metadata metadata.Metadata `json:"metadata"`
+	Success  bool              `json:"success"`
+	Message  string            `json:"message"`
+}
+
+// Operation is what a subscriber should do with a data point it receives.
+type Operation string
+
+const (
+	// OperationUpsert writes the data point, inserting it or replacing the
+	// data point with the same key values.
+	OperationUpsert Operation = "upsert"
+	// OperationDelete deletes the data point with the same key values. The
+	// data point is a tombstone: its Data holds the values of its KeyNames,
+	// and any other properties it holds should be ignored.
+	OperationDelete Operation = "delete"
+)
+
+// OperationOf returns the operation for a data point with action. Deletes are
+// OperationDelete, and every other action, including inserts, updates, upserts
+// and no action at all, is OperationUpsert.
+func OperationOf(action pipeline.DataPointAction) Operation {
+	if action == pipeline.DataPointDelete {
+		return OperationDelete
+	}
+	return OperationUpsert
 }
 
 type ReceiveShapeRequest struct {
+	Metadata  metadata.Metadata  `json:"metadata" mapstructure:"metadata"`
 	ShapeName string             `json:"shape_name" mapstructure:"shape"`
 	DataPoint pipeline.DataPoint `json:"data" mapstructure:"data"`
+	// Operation is what to do with the data point. The wrapper fills it
+	// in from the data point's Action if the host leaves it empty.
+	Operation Operation `json:"operation,omitempty" mapstructure:"operation"`
+	// SessionID identifies the delivery the data point is part of,
+	// such as the publication it came from.
+	SessionID string `json:"sessionId,omitempty" mapstructure:"sessionId"`
+	// Sequence numbers the data points of a session, increasing by one
+	// for each new data point. A data point sent again after a failure
+	// keeps its number, so it can be recognised. Zero means unnumbered.
+	Sequence int64 `json:"sequence,omitempty" mapstructure:"sequence"`
+	// BatchID identifies the batch the data point is part of. The wrapper
+	// fills it in from the connection's open batch if the host leaves it empty,
+	// so while a batch is open every data point sent over the connection joins
+	// it, whichever goroutine sent it. Data points which mustn't be part of a
+	// batch should be sent over a connection of their own.
+	BatchID string `json:"batchId,omitempty" mapstructure:"batchId"`
 }
 
 type ReceiveShapeResponse struct {
-	Success bool   `json:"success" mapstructure:"success"`
-	Message string `json:"message" mapstructure:"message"`
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	Success  bool              `json:"success" mapstructure:"success"`
+	Message  string            `json:"message" mapstructure:"message"`
+	// Violations lists the ways in which the data point doesn't conform to
+	// its shape, if it was refused for that reason.
+	Violations shapes.Violations `json:"violations,omitempty" mapstructure:"violations"`
+	// Duplicate is true if the data point had already been received,
+	// and so was acknowledged without being received again.
+	Duplicate bool `json:"duplicate,omitempty" mapstructure:"duplicate"`
+	// Retryable is true if the data point was refused because of a problem
+	// which may be temporary, such as a lost database connection, so the
+	// host may send it again.
+	Retryable bool `json:"retryable,omitempty" mapstructure:"retryable"`
 }
 
 type DataPointReceiver interface {
@@ -65,6 +174,97 @@ type DataPointReceiver interface {
 	Dispose(request DisposeRequest) (DisposeResponse, error)
 }
 
+// ContextDataPointReceiver is a DataPointReceiver which receives a context.
+// The wrapper prefers it over DataPointReceiver when a handler implements it.
+// The context is cancelled when the call returns, when the deadline in the
+// request metadata passes, when the connection to the host drops or when
+// the server shuts down.
+type ContextDataPointReceiver interface {
+	Init(ctx context.Context, request InitRequest) (InitResponse, error)
+	ReceiveDataPoint(ctx context.Context, request ReceiveShapeRequest) (ReceiveShapeResponse, error)
+	Dispose(ctx context.Context, request DisposeRequest) (DisposeResponse, error)
+}
+
+// TruncateShapeRequest asks the subscriber to delete every data point of a shape,
+// such as before a full reload of the shape from its source.
+type TruncateShapeRequest struct {
+	Metadata  metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	ShapeName string            `json:"shape_name" mapstructure:"shape"`
+}
+
+type TruncateShapeResponse struct {
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	Success  bool              `json:"success" mapstructure:"success"`
+	Message  string            `json:"message" mapstructure:"message"`
+}
+
+// ShapeTruncater is implemented by subscribers which can delete every data point of a shape.
+type ShapeTruncater interface {
+	TruncateShape(request TruncateShapeRequest) (TruncateShapeResponse, error)
+}
+
+// ContextShapeTruncater is a ShapeTruncater which receives a context.
+// The wrapper prefers it over ShapeTruncater when a handler implements it.
+type ContextShapeTruncater interface {
+	TruncateShape(ctx context.Context, request TruncateShapeRequest) (TruncateShapeResponse, error)
+}
+
+// BeginBatchRequest opens a batch. The data points received until the batch
+// is committed or aborted are written together, or not at all.
+type BeginBatchRequest struct {
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	BatchID  string            `json:"batchId" mapstructure:"batchId"`
+}
+
+type BeginBatchResponse struct {
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	Success  bool              `json:"success" mapstructure:"success"`
+	Message  string            `json:"message" mapstructure:"message"`
+}
+
+// CommitBatchRequest writes the data points received since the batch was opened.
+type CommitBatchRequest struct {
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	BatchID  string            `json:"batchId" mapstructure:"batchId"`
+}
+
+type CommitBatchResponse struct {
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	Success  bool              `json:"success" mapstructure:"success"`
+	Message  string            `json:"message" mapstructure:"message"`
+}
+
+// AbortBatchRequest discards the data points received since the batch was opened.
+type AbortBatchRequest struct {
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	BatchID  string            `json:"batchId" mapstructure:"batchId"`
+	// Reason says why the batch was aborted, for the subscriber's logs.
+	Reason string `json:"reason,omitempty" mapstructure:"reason"`
+}
+
+type AbortBatchResponse struct {
+	Metadata metadata.Metadata `json:"metadata" mapstructure:"metadata"`
+	Success  bool              `json:"success" mapstructure:"success"`
+	Message  string            `json:"message" mapstructure:"message"`
+}
+
+// TransactionalReceiver is implemented by subscribers which can write a batch of
+// data points atomically. A connection has at most one open batch at a time, and
+// the wrapper aborts it if the connection drops before it's committed.
+type TransactionalReceiver interface {
+	BeginBatch(request BeginBatchRequest) (BeginBatchResponse, error)
+	CommitBatch(request CommitBatchRequest) (CommitBatchResponse, error)
+	AbortBatch(request AbortBatchRequest) (AbortBatchResponse, error)
+}
+
+// ContextTransactionalReceiver is a TransactionalReceiver which receives a context.
+// The wrapper prefers it over TransactionalReceiver when a handler implements it.
+type ContextTransactionalReceiver interface {
+	BeginBatch(ctx context.Context, request BeginBatchRequest) (BeginBatchResponse, error)
+	CommitBatch(ctx context.Context, request CommitBatchRequest) (CommitBatchResponse, error)
+	AbortBatch(ctx context.Context, request AbortBatchRequest) (AbortBatchResponse, error)
+}
+
 type Subscriber interface {
 	ConnectionTester
 	DataPointReceiver
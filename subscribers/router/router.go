@@ -0,0 +1,68 @@
+// Package router routes the data points a subscriber receives
+// to a separate method for each operation.
+package router
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+)
+
+// Handler handles each operation a subscriber can be asked to perform on a data point.
+type Handler interface {
+	// Upsert inserts the data point, or replaces the one with the same key values.
+	Upsert(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+	// Delete deletes the data point with the same key values, which are
+	// the only values in the request's data point that can be relied on.
+	Delete(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+}
+
+// Route calls the method of h for the request's operation, which is taken from
+// the data point's Action if the request doesn't have one. A subscriber's
+// ReceiveDataPoint can simply return Route(ctx, request, h). Requests for
+// operations h doesn't know, and deletes whose data point is missing a key
+// value, are answered with an unsuccessful response.
+func Route(ctx context.Context, request protocol.ReceiveShapeRequest, h Handler) (protocol.ReceiveShapeResponse, error) {
+	op := request.Operation
+	if op == "" {
+		op = protocol.OperationOf(request.DataPoint.Action)
+	}
+
+	switch op {
+	case protocol.OperationUpsert:
+		return h.Upsert(ctx, request)
+	case protocol.OperationDelete:
+		if _, err := KeyValues(request.DataPoint); err != nil {
+			return protocol.ReceiveShapeResponse{
+				Success: false,
+				Message: err.Error(),
+			}, nil
+		}
+		return h.Delete(ctx, request)
+	}
+
+	return protocol.ReceiveShapeResponse{
+		Success: false,
+		Message: fmt.Sprintf("unsupported operation %q", op),
+	}, nil
+}
+
+// KeyValues returns the values of the keys of dp, keyed by their names.
+// It returns an error if dp has no KeyNames, or if it's missing a value for one.
+func KeyValues(dp pipeline.DataPoint) (map[string]interface{}, error) {
+	if len(dp.KeyNames) == 0 {
+		return nil, fmt.Errorf("data point has no key names")
+	}
+
+	keys := make(map[string]interface{}, len(dp.KeyNames))
+	for _, name := range dp.KeyNames {
+		v, ok := dp.Data[name]
+		if !ok || v == nil {
+			return nil, fmt.Errorf("data point is missing a value for key %q", name)
+		}
+		keys[name] = v
+	}
+	return keys, nil
+}
@@ -0,0 +1,86 @@
+package sequence
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileStore is a Store which keeps each mark in a file in a directory.
+// Files are replaced atomically, so a crash never leaves a partial mark.
+// It's safe for concurrent use within a process.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore returns a FileStore which keeps its files in dir,
+// creating it if necessary.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) path(key string) string {
+	return filepath.Join(f.dir, url.PathEscape(key)+".seq")
+}
+
+func (f *FileStore) Load(key string) (int64, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := ioutil.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	sequence, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return sequence, true, nil
+}
+
+func (f *FileStore) Save(key string, sequence int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(f.dir, ".sequence-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(strconv.FormatInt(sequence, 10))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path(key))
+}
+
+func (f *FileStore) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
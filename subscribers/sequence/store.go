@@ -0,0 +1,60 @@
+// Package sequence provides the stores a subscriber uses to remember, for
+// each session and shape, the sequence number up to which it has acknowledged
+// every data point, so data points delivered again after a reconnect can be
+// recognised.
+package sequence
+
+import "sync"
+
+// Store persists a mark for each key: the sequence number up to which
+// every data point has been acknowledged. Keys are made with Key.
+type Store interface {
+	// Load returns the mark saved under key. The bool
+	// is false if nothing has been saved.
+	Load(key string) (int64, bool, error)
+	// Save replaces the mark saved under key.
+	Save(key string, sequence int64) error
+	// Delete forgets the mark saved under key.
+	Delete(key string) error
+}
+
+// Key returns the key under which the mark of a shape
+// delivered in a session is kept.
+func Key(sessionID, shapeName string) string {
+	return sessionID + "/" + shapeName
+}
+
+// MemoryStore is a Store which keeps marks in memory.
+// It's safe for concurrent use.
+type MemoryStore struct {
+	mu    sync.Mutex
+	marks map[string]int64
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		marks: make(map[string]int64),
+	}
+}
+
+func (m *MemoryStore) Load(key string) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sequence, ok := m.marks[key]
+	return sequence, ok, nil
+}
+
+func (m *MemoryStore) Save(key string, sequence int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.marks[key] = sequence
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.marks, key)
+	return nil
+}
@@ -0,0 +1,52 @@
+package sequence
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStores(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sequences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]Store{
+		"MemoryStore": NewMemoryStore(),
+		"FileStore":   fileStore,
+	}
+
+	for name, store := range stores {
+		Convey(name+" should round-trip high-water marks", t, func() {
+			key := Key("session-1", "items/2017")
+			So(store.Delete(key), ShouldBeNil)
+
+			_, ok, err := store.Load(key)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			So(store.Save(key, 41), ShouldBeNil)
+			So(store.Save(key, 42), ShouldBeNil)
+
+			sequence, ok, err := store.Load(key)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(sequence, ShouldEqual, 42)
+
+			So(store.Delete(key), ShouldBeNil)
+			_, ok, err = store.Load(key)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	}
+}
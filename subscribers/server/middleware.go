@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/shapes"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/navigator-go/subscribers/sequence"
+)
+
+// ReceiveFunc handles a ReceiveDataPoint call.
+type ReceiveFunc func(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+
+// Middleware wraps the handling of ReceiveDataPoint calls. It can change
+// the request before calling next, answer the call without calling next,
+// or change the response next returns.
+type Middleware func(next ReceiveFunc) ReceiveFunc
+
+// batchEndKey is the context key for the batchEnd of a data point's batch.
+type batchEndKey struct{}
+
+// batchEnd holds the functions to call when a batch is committed or aborted.
+type batchEnd struct {
+	mu sync.Mutex
+	fs []func(committed bool)
+}
+
+func (b *batchEnd) add(f func(committed bool)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fs = append(b.fs, f)
+}
+
+// run calls the functions, in the order they were added.
+func (b *batchEnd) run(committed bool) {
+	b.mu.Lock()
+	fs := b.fs
+	b.fs = nil
+	b.mu.Unlock()
+
+	for _, f := range fs {
+		f(committed)
+	}
+}
+
+// OnBatchEnd arranges for f to be called when the batch of the data point
+// being received with ctx is committed or aborted, with whether it was
+// committed. Middleware uses it to hold back whatever depends on the data
+// point being written until its batch commits. It returns false, without
+// arranging anything, if the data point isn't part of a batch.
+func OnBatchEnd(ctx context.Context, f func(committed bool)) bool {
+	end, ok := ctx.Value(batchEndKey{}).(*batchEnd)
+	if !ok {
+		return false
+	}
+	end.add(f)
+	return true
+}
+
+// chain returns receive wrapped in middleware, the first of which is the outermost.
+func chain(receive ReceiveFunc, middleware []Middleware) ReceiveFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		receive = middleware[i](receive)
+	}
+	return receive
+}
+
+// ValidateShapes returns middleware which checks each data point against
+// its shape with v before the subscriber receives it. Data points the
+// validator refuses are answered with an unsuccessful response listing
+// their violations. Violations in data points it accepts are logged to
+// logger as warnings.
+func ValidateShapes(v *shapes.Validator, logger logging.Logger) Middleware {
+	if logger == nil {
+		logger = logging.Nop()
+	}
+
+	return func(next ReceiveFunc) ReceiveFunc {
+		return func(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+			dp, violations, err := v.Check(request.ShapeName, request.DataPoint)
+			if err != nil {
+				// Check only returns Violations, but don't panic if that changes.
+				remaining, _ := err.(shapes.Violations)
+				logger.Warn("Refused data point which doesn't conform to its shape", "shape", request.ShapeName, "policy", v.Policy(), "error", err)
+				return protocol.ReceiveShapeResponse{
+					Success:    false,
+					Message:    err.Error(),
+					Violations: remaining,
+				}, nil
+			}
+			if len(violations) > 0 {
+				logger.Warn("Data point doesn't conform to its shape", "shape", request.ShapeName, "policy", v.Policy(), "error", violations)
+			}
+
+			request.DataPoint = dp
+			return next(ctx, request)
+		}
+	}
+}
+
+// dedupWindow is the most Sequences Deduplicate remembers above
+// the low-water mark of a session and shape.
+const dedupWindow = 4096
+
+// Deduplicate returns middleware which drops data points the subscriber has
+// already received. For each session and shape it remembers the Sequences
+// received successfully as a low-water mark, at or below which every one has
+// been received, and the ones received above it. Data points may arrive out
+// of order, as they do when a session is delivered over several connections,
+// so a data point numbered above the mark is only a duplicate if its own
+// Sequence has been received. Duplicates are answered with a successful
+// response marked Duplicate without calling next. Data points without a
+// SessionID or Sequence are always passed on.
+//
+// Only the mark is saved in store, so after a restart the data points received
+// above it may be received again. At most dedupWindow Sequences are remembered
+// above it: once one that far past a missing Sequence is received, the missing
+// one is given up on and the mark passes it.
+//
+// Data points are passed to next without waiting for each other. A copy of
+// a data point which arrives while it's being received waits to see whether
+// it's received, and is then dropped or passed on accordingly.
+//
+// The Sequence of a data point received as part of a batch only counts once
+// the batch is committed. Until then it's only a duplicate of data points of
+// the same batch, and if the batch is aborted it's forgotten, so the data
+// point is received again when it's sent again.
+func Deduplicate(store sequence.Store, logger logging.Logger) Middleware {
+	if logger == nil {
+		logger = logging.Nop()
+	}
+
+	var (
+		mu      sync.Mutex
+		windows = make(map[string]*sequenceWindow)
+	)
+
+	// window returns the locked window for key, loading its mark from store the first time.
+	window := func(key string) (*sequenceWindow, error) {
+		mu.Lock()
+		w, ok := windows[key]
+		if !ok {
+			w = &sequenceWindow{}
+			windows[key] = w
+		}
+		mu.Unlock()
+
+		w.mu.Lock()
+		if !w.loaded {
+			mark, _, err := store.Load(key)
+			if err != nil {
+				w.mu.Unlock()
+				return nil, err
+			}
+			w.mark = mark
+			w.loaded = true
+		}
+		return w, nil
+	}
+
+	return func(next ReceiveFunc) ReceiveFunc {
+		return func(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+			if request.SessionID == "" || request.Sequence == 0 {
+				return next(ctx, request)
+			}
+
+			seq := request.Sequence
+			key := sequence.Key(request.SessionID, request.ShapeName)
+			w, err := window(key)
+			if err != nil {
+				logger.Error("Couldn't load sequence mark", logging.FieldSessionID, request.SessionID, "shape", request.ShapeName, "error", err)
+				return protocol.ReceiveShapeResponse{
+					Success:   false,
+					Message:   "couldn't load sequence mark: " + err.Error(),
+					Retryable: true,
+				}, nil
+			}
+
+			for {
+				if w.received(seq, request.BatchID) {
+					w.mu.Unlock()
+					logger.Debug("Dropped data point already received", logging.FieldSessionID, request.SessionID, "shape", request.ShapeName, "sequence", seq)
+					return protocol.ReceiveShapeResponse{
+						Success:   true,
+						Duplicate: true,
+					}, nil
+				}
+				receiving, ok := w.receiving[seq]
+				if !ok {
+					break
+				}
+				w.mu.Unlock()
+				<-receiving
+				w.mu.Lock()
+			}
+
+			receiving := make(chan struct{})
+			if w.receiving == nil {
+				w.receiving = make(map[int64]chan struct{})
+			}
+			w.receiving[seq] = receiving
+			w.mu.Unlock()
+
+			response, err := next(ctx, request)
+
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			delete(w.receiving, seq)
+			close(receiving)
+
+			if err != nil || !response.Success {
+				return response, err
+			}
+
+			if request.BatchID == "" {
+				w.record(seq, store, key, logger)
+				return response, nil
+			}
+
+			batchID := request.BatchID
+			if _, ok := w.pending[batchID]; !ok {
+				if !OnBatchEnd(ctx, func(committed bool) {
+					w.mu.Lock()
+					defer w.mu.Unlock()
+					seqs := w.pending[batchID]
+					delete(w.pending, batchID)
+					if committed {
+						for seq := range seqs {
+							w.record(seq, store, key, logger)
+						}
+					}
+				}) {
+					// The batch isn't known to the server, so there's nothing to wait for.
+					w.record(seq, store, key, logger)
+					return response, nil
+				}
+				if w.pending == nil {
+					w.pending = make(map[string]map[int64]bool)
+				}
+				w.pending[batchID] = make(map[int64]bool)
+			}
+			w.pending[batchID][seq] = true
+			return response, nil
+		}
+	}
+}
+
+// sequenceWindow is what Deduplicate knows about the
+// Sequences received for a session and shape.
+type sequenceWindow struct {
+	mu     sync.Mutex
+	loaded bool
+	// mark is the low-water mark: every Sequence up to it has been received.
+	mark int64
+	// seen holds the Sequences above mark which have been received.
+	seen map[int64]bool
+	// receiving holds a channel for each Sequence being passed to next,
+	// closed when next returns.
+	receiving map[int64]chan struct{}
+	// pending holds the Sequences received in each open batch.
+	pending map[string]map[int64]bool
+}
+
+// received reports whether seq has been received, or received in the open
+// batch batchID. w.mu must be held.
+func (w *sequenceWindow) received(seq int64, batchID string) bool {
+	return seq <= w.mark || w.seen[seq] || w.pending[batchID][seq]
+}
+
+// record remembers that seq has been received, raising the mark over the
+// Sequences received after it and saving it in store. w.mu must be held.
+func (w *sequenceWindow) record(seq int64, store sequence.Store, key string, logger logging.Logger) {
+	if seq <= w.mark || w.seen[seq] {
+		return
+	}
+	if w.seen == nil {
+		w.seen = make(map[int64]bool)
+	}
+	w.seen[seq] = true
+
+	mark := w.mark
+	if seq-mark > dedupWindow {
+		mark = seq - dedupWindow
+		logger.Warn("Gave up on missing sequences", "key", key, "from", w.mark+1, "to", mark)
+		for s := range w.seen {
+			if s <= mark {
+				delete(w.seen, s)
+			}
+		}
+	}
+	for w.seen[mark+1] {
+		delete(w.seen, mark+1)
+		mark++
+	}
+	if mark == w.mark {
+		return
+	}
+
+	w.mark = mark
+	if err := store.Save(key, mark); err != nil {
+		logger.Warn("Couldn't save sequence mark", "key", key, "error", err)
+	}
+}
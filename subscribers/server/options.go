@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/settings"
+)
+
+// Option configures a SubscriberServer.
+type Option func(*options)
+
+type options struct {
+	logger          logging.Logger
+	secretResolvers map[string]settings.SecretResolver
+	middleware      []Middleware
+}
+
+func defaultOptions() options {
+	return options{
+		logger:          logging.Default(),
+		secretResolvers: settings.DefaultSecretResolvers(),
+	}
+}
+
+// WithLogger sets the logger used by the server and the wrappers it creates.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = logging.Nop()
+		}
+		o.logger = logger
+	}
+}
+
+// WithSecretResolvers sets the resolvers for the secret references in settings,
+// keyed by scheme, replacing settings.DefaultSecretResolvers. References are
+// resolved in the settings the handler's settings schema marks secret, before
+// the settings are validated and passed to the handler. Passing nil leaves
+// settings as they're sent.
+func WithSecretResolvers(resolvers map[string]settings.SecretResolver) Option {
+	return func(o *options) {
+		o.secretResolvers = resolvers
+	}
+}
+
+// WithMiddleware adds middleware to the handling of ReceiveDataPoint calls.
+// The first middleware added is the first to see each request.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, middleware...)
+	}
+}
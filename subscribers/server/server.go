@@ -1,25 +1,60 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"strings"
+	"sync"
 
-	"github.com/sirupsen/logrus"
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/settings"
 )
 
+// ErrServerClosed is returned by Serve and ListenAndServe after Close is called.
+var ErrServerClosed = errors.New("server closed")
+
 type SubscriberServer struct {
 	Addr    string
 	handler interface{}
+	opts    options
+
+	// ctx is the parent of the context of every connection,
+	// and is cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+
+	// redactor removes the secrets found in settings from everything the server logs.
+	redactor *settings.Redactor
 }
 
-func NewSubscriberServer(addr string, handler interface{}) *SubscriberServer {
-	return &SubscriberServer{
+func NewSubscriberServer(addr string, handler interface{}, opts ...Option) *SubscriberServer {
+	srv := &SubscriberServer{
 		Addr:    addr,
 		handler: handler,
+		opts:    defaultOptions(),
+		conns:   make(map[net.Conn]struct{}),
 	}
+
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(&srv.opts)
+	}
+
+	srv.redactor = settings.NewRedactor()
+	srv.opts.logger = logging.Redacting(srv.opts.logger, srv.redactor.Redact)
+
+	return srv
 }
 
 func (srv *SubscriberServer) ListenAndServe() error {
@@ -50,23 +85,101 @@ func (srv *SubscriberServer) ListenAndServe() error {
 func (srv *SubscriberServer) Serve(listener net.Listener) error {
 	defer listener.Close()
 
-	logrus.Infof("Listening for connections on %s", srv.Addr)
+	srv.mu.Lock()
+	if srv.ctx.Err() != nil {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listener = listener
+	srv.mu.Unlock()
+
+	srv.opts.logger.Info("Listening for connections", "addr", srv.Addr)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if srv.ctx.Err() != nil {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		logrus.Infof("Client connected")
+		logger := srv.opts.logger.With(
+			logging.FieldRemoteAddr, conn.RemoteAddr().String(),
+			logging.FieldConnectionID, newConnectionID(),
+		)
+
+		logger.Info("Client connected")
+
+		// The connection's context is cancelled when the client disconnects
+		// or the server is closed, whichever happens first.
+		ctx, cancel := context.WithCancel(srv.ctx)
+		srv.trackConn(conn, true)
+
 		server := rpc.NewServer()
-		wrapper := &wrapper{subscriber: srv.handler}
+		wrapper := &wrapper{
+			subscriber: srv.handler,
+			logger:     logger,
+			ctx:        ctx,
+			opts:       srv.opts,
+			redactor:   srv.redactor,
+		}
 		server.RegisterName("Subscriber", wrapper)
-		codec := jsonrpc.NewServerCodec(conn)
-		go server.ServeCodec(codec)
+		codec := &cancelingCodec{ServerCodec: jsonrpc.NewServerCodec(conn), cancel: cancel}
+		go func() {
+			server.ServeCodec(codec)
+			cancel()
+			wrapper.abortOpenBatch()
+			srv.trackConn(conn, false)
+			logger.Info("Client disconnected")
+		}()
+	}
+}
+
+// Close stops the server from accepting connections, closes the open connections
+// and cancels the contexts passed to handlers.
+func (srv *SubscriberServer) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.cancel()
+
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (srv *SubscriberServer) trackConn(conn net.Conn, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		srv.conns[conn] = struct{}{}
+	} else {
+		delete(srv.conns, conn)
 	}
 }
 
+// cancelingCodec cancels the connection's context as soon as a request can't be read.
+// ServeCodec waits for in-flight calls to return before it returns, so without this
+// a handler blocked on its context would never see the disconnect.
+type cancelingCodec struct {
+	rpc.ServerCodec
+	cancel context.CancelFunc
+}
+
+func (c *cancelingCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	if err != nil {
+		c.cancel()
+	}
+	return err
+}
+
 type ServerError struct {
 	Code    int
 	Message string
@@ -75,3 +188,10 @@ type ServerError struct {
 func (s *ServerError) Error() string {
 	return fmt.Sprintf("[server] %d - %s", s.Code, s.Message)
 }
+
+// newConnectionID returns a random identifier for a connection.
+func newConnectionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
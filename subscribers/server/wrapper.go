@@ -1,16 +1,137 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/naveego/navigator-go/logging"
+	"github.com/naveego/navigator-go/metadata"
+	"github.com/naveego/navigator-go/settings"
 	"github.com/naveego/navigator-go/subscribers/protocol"
 )
 
 // wrapper adapts the protocol.* interfaces to the pattern required by net/rpc/jsonrpc.
 type wrapper struct {
 	subscriber interface{}
+	logger     logging.Logger
+	// ctx is cancelled when the connection drops or the server is closed.
+	ctx      context.Context
+	opts     options
+	redactor *settings.Redactor
+
+	// mu guards batchID. ReceiveDataPoint holds it for reading while the data
+	// point is received, so a batch can't be begun, committed or aborted
+	// while a data point is being written to it.
+	mu sync.RWMutex
+	// batchID is the ID of the connection's open batch, if it has one.
+	batchID string
+	// batchEnd is called when the open batch is committed or aborted.
+	batchEnd *batchEnd
+}
+
+// requestLogger returns a logger for a call to method carrying md.
+func (w *wrapper) requestLogger(method string, md metadata.Metadata) logging.Logger {
+	return w.logger.With(append([]interface{}{logging.FieldMethod, method}, md.LogFields()...)...)
+}
+
+// requestContext returns the context for a call carrying md.
+func (w *wrapper) requestContext(md metadata.Metadata) (context.Context, context.CancelFunc) {
+	return metadata.WithDeadline(w.ctx, md)
+}
+
+// prepareSettings resolves the secret references in the settings of a call to
+// method which the handler's settings schema marks secret, and validates the
+// result against the schema. The secrets it finds are redacted from the server's
+// logs and responses from then on. Without a schema the settings are passed on
+// as they are. It returns the settings to pass to the handler, or the problems
+// with them.
+func (w *wrapper) prepareSettings(method string, values map[string]interface{}, logger logging.Logger) (map[string]interface{}, settings.ValidationErrors) {
+	schema := w.settingsSchema(method, logger)
+	if schema == nil {
+		return values, nil
+	}
+
+	values, secrets, errs := settings.ResolveSecrets(schema, values, w.opts.secretResolvers)
+	w.redactor.Add(secrets...)
+	if len(errs) > 0 {
+		logger.Warn("Could not resolve secrets in settings", "error", errs)
+		return nil, errs
+	}
+
+	w.redactor.AddSettings(schema, values)
+
+	errs = schema.Validate(values)
+	if len(errs) > 0 {
+		logger.Warn("Invalid settings", "error", errs)
+		return nil, errs
+	}
+	return values, nil
 }
 
-func (w *wrapper) TestConnection(request protocol.TestConnectionRequest, response *protocol.TestConnectionResponse) error {
-	if s, ok := w.subscriber.(protocol.ConnectionTester); ok {
+// settingsSchema returns the handler's schema for the settings of a call
+// to method, or nil if it doesn't provide one.
+func (w *wrapper) settingsSchema(method string, logger logging.Logger) *settings.Schema {
+	p, ok := w.subscriber.(protocol.SettingsSchemaProvider)
+	if !ok {
+		return nil
+	}
+
+	schemas, err := p.SettingsSchema(protocol.SettingsSchemaRequest{})
+	if err != nil {
+		logger.Warn("Could not get settings schema", "error", err)
+		return nil
+	}
+
+	switch method {
+	case "Init":
+		return schemas.Init
+	case "TestConnection":
+		return schemas.TestConnection
+	case "DiscoverShapes":
+		return schemas.DiscoverShapes
+	}
+	return nil
+}
+
+func (w *wrapper) SettingsSchema(request protocol.SettingsSchemaRequest, response *protocol.SettingsSchemaResponse) (err error) {
+	logger := w.requestLogger("SettingsSchema", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling SettingsSchema")
+
+	if p, ok := w.subscriber.(protocol.SettingsSchemaProvider); ok {
+		r, err := p.SettingsSchema(request)
+		*response = r
+		return err
+	}
+	return nil
+}
+
+func (w *wrapper) TestConnection(request protocol.TestConnectionRequest, response *protocol.TestConnectionResponse) (err error) {
+	logger := w.requestLogger("TestConnection", request.Metadata)
+	defer func() {
+		response.Message = w.redactor.Redact(response.Message)
+		response.ValidationErrors = w.redactor.RedactErrors(response.ValidationErrors)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+	}()
+
+	logger.Debug("Calling TestConnection")
+	var errs settings.ValidationErrors
+	if request.Settings, errs = w.prepareSettings("TestConnection", request.Settings, logger); len(errs) > 0 {
+		*response = protocol.TestConnectionResponse{Success: false, Message: errs.Error(), ValidationErrors: errs}
+		return nil
+	}
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.subscriber.(type) {
+	case protocol.ContextConnectionTester:
+		r, err := s.TestConnection(ctx, request)
+		*response = r
+		return err
+	case protocol.ConnectionTester:
 		r, err := s.TestConnection(request)
 		*response = r
 		return err
@@ -19,7 +140,29 @@ func (w *wrapper) TestConnection(request protocol.TestConnectionRequest, respons
 }
 
 func (w *wrapper) Init(request protocol.InitRequest, response *protocol.InitResponse) (err error) {
-	if s, ok := w.subscriber.(protocol.DataPointReceiver); ok {
+	logger := w.requestLogger("Init", request.Metadata)
+	defer func() {
+		response.Message = w.redactor.Redact(response.Message)
+		response.ValidationErrors = w.redactor.RedactErrors(response.ValidationErrors)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+	}()
+
+	logger.Debug("Calling Init")
+	var errs settings.ValidationErrors
+	if request.Settings, errs = w.prepareSettings("Init", request.Settings, logger); len(errs) > 0 {
+		*response = protocol.InitResponse{Success: false, Message: errs.Error(), ValidationErrors: errs}
+		return nil
+	}
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.subscriber.(type) {
+	case protocol.ContextDataPointReceiver:
+		r, err := s.Init(ctx, request)
+		*response = r
+		return err
+	case protocol.DataPointReceiver:
 		r, err := s.Init(request)
 		*response = r
 		return err
@@ -28,16 +171,242 @@ func (w *wrapper) Init(request protocol.InitRequest, response *protocol.InitResp
 }
 
 func (w *wrapper) ReceiveDataPoint(request protocol.ReceiveShapeRequest, response *protocol.ReceiveShapeResponse) (err error) {
-	if s, ok := w.subscriber.(protocol.DataPointReceiver); ok {
-		r, err := s.ReceiveDataPoint(request)
+	logger := w.requestLogger("ReceiveDataPoint", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling ReceiveDataPoint")
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	if request.Operation == "" {
+		request.Operation = protocol.OperationOf(request.DataPoint.Action)
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	// A data point without a BatchID joins the open batch, even if it was sent
+	// by a goroutine which didn't begin it. A data point sent for a batch which
+	// isn't open, such as one aborted when an earlier connection dropped, must
+	// not be written outside it.
+	if request.BatchID == "" {
+		request.BatchID = w.batchID
+	} else if request.BatchID != w.batchID {
+		*response = protocol.ReceiveShapeResponse{
+			Success: false,
+			Message: "Batch " + request.BatchID + " isn't open.",
+		}
+		return nil
+	}
+	if request.BatchID != "" {
+		ctx = context.WithValue(ctx, batchEndKey{}, w.batchEnd)
+	}
+
+	var receive ReceiveFunc
+	switch s := w.subscriber.(type) {
+	case protocol.ContextDataPointReceiver:
+		receive = s.ReceiveDataPoint
+	case protocol.DataPointReceiver:
+		receive = func(ctx context.Context, request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+			return s.ReceiveDataPoint(request)
+		}
+	default:
+		return nil
+	}
+
+	r, err := chain(receive, w.opts.middleware)(ctx, request)
+	*response = r
+	return err
+}
+
+func (w *wrapper) TruncateShape(request protocol.TruncateShapeRequest, response *protocol.TruncateShapeResponse) (err error) {
+	logger := w.requestLogger("TruncateShape", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling TruncateShape", "shape", request.ShapeName)
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.subscriber.(type) {
+	case protocol.ContextShapeTruncater:
+		r, err := s.TruncateShape(ctx, request)
 		*response = r
 		return err
+	case protocol.ShapeTruncater:
+		r, err := s.TruncateShape(request)
+		*response = r
+		return err
+	}
+
+	*response = protocol.TruncateShapeResponse{
+		Success: false,
+		Message: "Handler doesn't implement ShapeTruncater.",
 	}
 	return nil
 }
 
+func (w *wrapper) BeginBatch(request protocol.BeginBatchRequest, response *protocol.BeginBatchResponse) (err error) {
+	logger := w.requestLogger("BeginBatch", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling BeginBatch", "batch", request.BatchID)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if request.BatchID == "" {
+		*response = protocol.BeginBatchResponse{
+			Success: false,
+			Message: "BatchID is required.",
+		}
+		return nil
+	}
+	if w.batchID != "" {
+		*response = protocol.BeginBatchResponse{
+			Success: false,
+			Message: "Batch " + w.batchID + " is already open.",
+		}
+		return nil
+	}
+
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.subscriber.(type) {
+	case protocol.ContextTransactionalReceiver:
+		*response, err = s.BeginBatch(ctx, request)
+	case protocol.TransactionalReceiver:
+		*response, err = s.BeginBatch(request)
+	default:
+		*response = protocol.BeginBatchResponse{
+			Success: false,
+			Message: "Handler doesn't implement TransactionalReceiver.",
+		}
+		return nil
+	}
+
+	if err == nil && response.Success {
+		w.batchID = request.BatchID
+		w.batchEnd = &batchEnd{}
+	}
+	return err
+}
+
+func (w *wrapper) CommitBatch(request protocol.CommitBatchRequest, response *protocol.CommitBatchResponse) (err error) {
+	logger := w.requestLogger("CommitBatch", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling CommitBatch", "batch", request.BatchID)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.batchID == "" || request.BatchID != w.batchID {
+		*response = protocol.CommitBatchResponse{
+			Success: false,
+			Message: "Batch " + request.BatchID + " isn't open.",
+		}
+		return nil
+	}
+
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.subscriber.(type) {
+	case protocol.ContextTransactionalReceiver:
+		*response, err = s.CommitBatch(ctx, request)
+	case protocol.TransactionalReceiver:
+		*response, err = s.CommitBatch(request)
+	}
+
+	// A batch which fails to commit stays open, for the host to abort.
+	if err == nil && response.Success {
+		w.endBatch(true)
+	}
+	return err
+}
+
+func (w *wrapper) AbortBatch(request protocol.AbortBatchRequest, response *protocol.AbortBatchResponse) (err error) {
+	logger := w.requestLogger("AbortBatch", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling AbortBatch", "batch", request.BatchID, "reason", request.Reason)
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.batchID == "" || request.BatchID != w.batchID {
+		*response = protocol.AbortBatchResponse{
+			Success: false,
+			Message: "Batch " + request.BatchID + " isn't open.",
+		}
+		return nil
+	}
+
+	*response, err = w.abortBatch(ctx, request)
+	return err
+}
+
+// abortBatch aborts the open batch. w.mu must be held.
+func (w *wrapper) abortBatch(ctx context.Context, request protocol.AbortBatchRequest) (response protocol.AbortBatchResponse, err error) {
+	switch s := w.subscriber.(type) {
+	case protocol.ContextTransactionalReceiver:
+		response, err = s.AbortBatch(ctx, request)
+	case protocol.TransactionalReceiver:
+		response, err = s.AbortBatch(request)
+	}
+	w.endBatch(false)
+	return
+}
+
+// endBatch closes the open batch. w.mu must be held.
+func (w *wrapper) endBatch(committed bool) {
+	end := w.batchEnd
+	w.batchID = ""
+	w.batchEnd = nil
+	end.run(committed)
+}
+
+// abortOpenBatch aborts the connection's open batch, if it has one.
+// It's called when the connection drops.
+func (w *wrapper) abortOpenBatch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.batchID == "" {
+		return
+	}
+
+	batchID := w.batchID
+	w.logger.Warn("Aborting batch left open by disconnected client", "batch", batchID)
+	response, err := w.abortBatch(context.Background(), protocol.AbortBatchRequest{
+		BatchID: batchID,
+		Reason:  "connection dropped",
+	})
+	if err == nil && !response.Success {
+		err = errors.New(response.Message)
+	}
+	if err != nil {
+		w.logger.Error("Couldn't abort batch", "batch", batchID, "error", err)
+	}
+}
+
 func (w *wrapper) Dispose(request protocol.DisposeRequest, response *protocol.DisposeResponse) (err error) {
-	if s, ok := w.subscriber.(protocol.DataPointReceiver); ok {
+	logger := w.requestLogger("Dispose", request.Metadata)
+	defer func() { response.Metadata = metadata.Reply(request.Metadata, response.Metadata) }()
+
+	logger.Debug("Calling Dispose")
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.subscriber.(type) {
+	case protocol.ContextDataPointReceiver:
+		r, err := s.Dispose(ctx, request)
+		*response = r
+		return err
+	case protocol.DataPointReceiver:
 		r, err := s.Dispose(request)
 		*response = r
 		return err
@@ -46,7 +415,28 @@ func (w *wrapper) Dispose(request protocol.DisposeRequest, response *protocol.Di
 }
 
 func (w *wrapper) DiscoverShapes(request protocol.DiscoverShapesRequest, response *protocol.DiscoverShapesResponse) (err error) {
-	if s, ok := w.subscriber.(protocol.ShapeDiscoverer); ok {
+	logger := w.requestLogger("DiscoverShapes", request.Metadata)
+	defer func() {
+		response.ValidationErrors = w.redactor.RedactErrors(response.ValidationErrors)
+		err = w.redactor.RedactError(err)
+		response.Metadata = metadata.Reply(request.Metadata, response.Metadata)
+	}()
+
+	logger.Debug("Calling DiscoverShapes")
+	var errs settings.ValidationErrors
+	if request.Settings, errs = w.prepareSettings("DiscoverShapes", request.Settings, logger); len(errs) > 0 {
+		*response = protocol.DiscoverShapesResponse{ValidationErrors: errs}
+		return nil
+	}
+	ctx, cancel := w.requestContext(request.Metadata)
+	defer cancel()
+
+	switch s := w.subscriber.(type) {
+	case protocol.ContextShapeDiscoverer:
+		r, err := s.DiscoverShapes(ctx, request)
+		*response = r
+		return err
+	case protocol.ShapeDiscoverer:
 		r, err := s.DiscoverShapes(request)
 		*response = r
 		return err